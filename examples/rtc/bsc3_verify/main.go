@@ -0,0 +1,55 @@
+// Command bsc3_verify checks a BSC3 audit bundle against a captured frame log,
+// without access to any session key.
+//
+// Usage: bsc3_verify <bundle.json> <frames.log> [local|remote]
+//
+// frames.log holds the BST2 frames of the audited direction back to back, in
+// wire order. The trail defaults to "remote" (checkpoints signed by the peer).
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+)
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "usage: bsc3_verify <bundle.json> <frames.log> [local|remote]")
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		fail(err)
+	}
+	var bundle rtc.AuditBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		fail(err)
+	}
+	trail := &bundle.Remote
+	if len(os.Args) > 3 && os.Args[3] == "local" {
+		trail = &bundle.Local
+	}
+
+	f, err := os.Open(os.Args[2])
+	if err != nil {
+		fail(err)
+	}
+	defer f.Close()
+	frames, err := rtc.ReadFrameLog(f)
+	if err != nil {
+		fail(err)
+	}
+
+	if err := rtc.VerifyAuditTrail(trail, frames); err != nil {
+		fail(err)
+	}
+	fmt.Printf("OK: %d checkpoints by %s verified over %d frames\n", len(trail.Checkpoints), trail.Signer, len(frames))
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "verify failed:", err)
+	os.Exit(1)
+}
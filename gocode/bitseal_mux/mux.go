@@ -0,0 +1,376 @@
+// Package bitsealmux multiplexes many logical streams over one BitSeal
+// message channel (a BitSealWSConn, a Pion Conn or a raw BST2 session).
+//
+// Every mux frame travels as the plaintext of one BitSeal message:
+//
+//	type(1) | stream_id(4) | value(4) | payload
+//
+//	0x01 OPEN    open stream_id                      value = 0
+//	0x02 DATA    payload is stream data              value = 0
+//	0x03 WINDOW  grant value more bytes of credit
+//	0x04 CLOSE   sender will send no more data (half-close)
+//	0x05 RESET   abort both directions               value = reset code
+//
+// Streams opened by the client side use odd IDs, the server side even IDs.
+// Each direction of a stream starts with InitialWindow bytes of credit; the
+// receiver returns credit with WINDOW frames as the application reads, so a
+// slow reader stalls only its own stream. The format is shared with the
+// TypeScript implementation in tscode/bitseal_mux.
+package bitsealmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	frameOpen   byte = 0x01
+	frameData   byte = 0x02
+	frameWindow byte = 0x03
+	frameClose  byte = 0x04
+	frameReset  byte = 0x05
+
+	headerLen = 9
+
+	// InitialWindow is the credit each side of a new stream starts with.
+	InitialWindow = 256 * 1024
+	// DefaultMaxData keeps a DATA frame within one FRAG_SIZE record.
+	DefaultMaxData = 16*1024 - headerLen
+	// DefaultAcceptBacklog is the number of opened streams waiting for Accept.
+	DefaultAcceptBacklog = 64
+)
+
+// Reset codes carried in the value of a RESET frame.
+const (
+	ResetCancel   uint32 = 0 // Stream.Reset by the application
+	ResetRefused  uint32 = 1 // accept backlog full or stream ID invalid
+	ResetProtocol uint32 = 2 // flow-control or sequencing violation
+)
+
+// Errors returned by Mux and Stream.
+var (
+	ErrMuxClosed    = errors.New("bitseal mux closed")
+	ErrStreamClosed = errors.New("bitseal mux: stream closed")
+	ErrStreamReset  = errors.New("bitseal mux: stream reset")
+	ErrStreamsSpent = errors.New("bitseal mux: stream IDs exhausted")
+)
+
+// MessageWriter sends one whole message to the peer. BitSealWSConn and
+// pion.Conn implement it.
+type MessageWriter interface {
+	Write(msg []byte) error
+}
+
+// Transport is a MessageWriter that can also be read from and closed.
+type Transport interface {
+	MessageWriter
+	Read() ([]byte, error)
+	Close() error
+}
+
+// WriterFunc adapts a function, such as a closure around Server.SendTo, to
+// MessageWriter.
+type WriterFunc func(msg []byte) error
+
+func (f WriterFunc) Write(msg []byte) error { return f(msg) }
+
+// Config tunes a Mux. The zero value is usable.
+type Config struct {
+	// Window is the receive window per stream; zero means InitialWindow.
+	// Larger values are granted to the peer right after a stream opens.
+	Window uint32
+	// MaxData is the largest DATA payload per frame; zero means DefaultMaxData.
+	MaxData int
+	// AcceptBacklog; zero means DefaultAcceptBacklog. Streams opened while
+	// the backlog is full are refused.
+	AcceptBacklog int
+	// Logger is optional; nil stays silent.
+	Logger *zap.Logger
+}
+
+// Mux is one side of a multiplexed connection. All methods are safe for
+// concurrent use.
+type Mux struct {
+	w      MessageWriter
+	cfg    Config
+	client bool
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error // set once the mux is dead
+
+	accept    chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Client runs the client side over t, reading frames in a background
+// goroutine until t fails or the Mux is closed.
+func Client(t Transport, cfg *Config) (*Mux, error) {
+	return start(t, true, cfg)
+}
+
+// Server runs the server side over t; see Client.
+func Server(t Transport, cfg *Config) (*Mux, error) {
+	return start(t, false, cfg)
+}
+
+func start(t Transport, client bool, cfg *Config) (*Mux, error) {
+	m, err := New(t, client, cfg)
+	if err != nil {
+		return nil, err
+	}
+	go m.readLoop(t)
+	return m, nil
+}
+
+// New returns a Mux that sends through w and is fed incoming messages by
+// the caller via Receive. It suits callback-driven transports such as
+// bitsealws.Server.OnMessage. client selects odd (true) or even stream IDs.
+func New(w MessageWriter, client bool, cfg *Config) (*Mux, error) {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.Window == 0 {
+		c.Window = InitialWindow
+	}
+	if c.Window < InitialWindow {
+		return nil, fmt.Errorf("window %d below initial window %d", c.Window, InitialWindow)
+	}
+	if c.MaxData == 0 {
+		c.MaxData = DefaultMaxData
+	}
+	if c.MaxData < 1 {
+		return nil, fmt.Errorf("max data %d must be positive", c.MaxData)
+	}
+	if c.AcceptBacklog <= 0 {
+		c.AcceptBacklog = DefaultAcceptBacklog
+	}
+	m := &Mux{
+		w:       w,
+		cfg:     c,
+		client:  client,
+		streams: make(map[uint32]*Stream),
+		accept:  make(chan *Stream, c.AcceptBacklog),
+		done:    make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	} else {
+		m.nextID = 2
+	}
+	return m, nil
+}
+
+func (m *Mux) readLoop(t Transport) {
+	for {
+		msg, err := t.Read()
+		if err != nil {
+			if err == io.EOF {
+				err = ErrMuxClosed
+			}
+			m.fail(err)
+			return
+		}
+		if err := m.Receive(msg); err != nil {
+			return
+		}
+	}
+}
+
+// Open starts a new stream. Data may be written right away; the peer sees
+// the stream once it calls Accept.
+func (m *Mux) Open() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		err := m.err
+		m.mu.Unlock()
+		return nil, err
+	}
+	id := m.nextID
+	if id > 0xFFFFFFFF-2 {
+		m.mu.Unlock()
+		return nil, ErrStreamsSpent
+	}
+	m.nextID += 2
+	s := newStream(m, id)
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(frameOpen, id, 0, nil); err != nil {
+		return nil, err
+	}
+	if err := m.grantExtra(id); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (m *Mux) Accept() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		// Streams that arrived before the mux died are still handed out.
+		select {
+		case s := <-m.accept:
+			return s, nil
+		default:
+			return nil, m.Err()
+		}
+	}
+}
+
+// Err returns the reason the mux stopped, or nil while it is running.
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close stops the mux, fails all streams and closes the transport if it
+// implements io.Closer.
+func (m *Mux) Close() error {
+	m.fail(ErrMuxClosed)
+	if c, ok := m.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (m *Mux) fail(err error) {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		m.err = err
+		streams := m.streams
+		m.streams = make(map[uint32]*Stream)
+		m.mu.Unlock()
+		for _, s := range streams {
+			s.abort(err)
+		}
+		close(m.done)
+		if m.cfg.Logger != nil && err != ErrMuxClosed {
+			m.cfg.Logger.Debug("bitseal mux stopped", zap.Error(err))
+		}
+	})
+}
+
+// Receive handles one incoming message. It must not be called concurrently.
+// A malformed frame stops the mux, closing the transport, and is returned.
+func (m *Mux) Receive(msg []byte) error {
+	if err := m.Err(); err != nil {
+		return err
+	}
+	if len(msg) < headerLen {
+		return m.protocolError(fmt.Errorf("frame of %d bytes shorter than header", len(msg)))
+	}
+	typ := msg[0]
+	id := binary.BigEndian.Uint32(msg[1:5])
+	value := binary.BigEndian.Uint32(msg[5:9])
+	payload := msg[headerLen:]
+	if typ != frameData && len(payload) != 0 {
+		return m.protocolError(fmt.Errorf("frame type 0x%02x with payload", typ))
+	}
+
+	m.mu.Lock()
+	s := m.streams[id]
+	m.mu.Unlock()
+
+	switch typ {
+	case frameOpen:
+		if s != nil || id == 0 || (id%2 == 1) == m.client {
+			return m.writeFrame(frameReset, id, ResetRefused, nil)
+		}
+		return m.acceptStream(id)
+	case frameData:
+		if s == nil {
+			return m.writeFrame(frameReset, id, ResetRefused, nil)
+		}
+		return s.receiveData(payload)
+	case frameWindow:
+		if s != nil {
+			s.receiveWindow(value)
+		}
+	case frameClose:
+		if s != nil {
+			s.receiveClose()
+		}
+	case frameReset:
+		if s != nil {
+			m.remove(id)
+			s.abort(ErrStreamReset)
+		}
+	default:
+		return m.protocolError(fmt.Errorf("unknown frame type 0x%02x", typ))
+	}
+	return nil
+}
+
+func (m *Mux) protocolError(err error) error {
+	err = fmt.Errorf("bitseal mux: %w", err)
+	m.fail(err)
+	if c, ok := m.w.(io.Closer); ok {
+		_ = c.Close()
+	}
+	return err
+}
+
+func (m *Mux) acceptStream(id uint32) error {
+	s := newStream(m, id)
+	m.mu.Lock()
+	m.streams[id] = s
+	m.mu.Unlock()
+	select {
+	case m.accept <- s:
+	default:
+		m.remove(id)
+		if m.cfg.Logger != nil {
+			m.cfg.Logger.Warn("bitseal mux: accept backlog full, refusing stream", zap.Uint32("stream", id))
+		}
+		return m.writeFrame(frameReset, id, ResetRefused, nil)
+	}
+	return m.grantExtra(id)
+}
+
+// grantExtra raises the peer's credit from InitialWindow to Config.Window.
+func (m *Mux) grantExtra(id uint32) error {
+	if extra := m.cfg.Window - InitialWindow; extra > 0 {
+		return m.writeFrame(frameWindow, id, extra, nil)
+	}
+	return nil
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func (m *Mux) writeFrame(typ byte, id, value uint32, payload []byte) error {
+	frame := make([]byte, headerLen+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], value)
+	copy(frame[headerLen:], payload)
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.Err(); err != nil {
+		return err
+	}
+	if err := m.w.Write(frame); err != nil {
+		m.fail(err)
+		return err
+	}
+	return nil
+}
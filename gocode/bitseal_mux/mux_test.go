@@ -0,0 +1,315 @@
+package bitsealmux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+// chanTransport is one end of an in-memory message pipe.
+type chanTransport struct {
+	in, out chan []byte
+	done    chan struct{}
+	once    *sync.Once
+}
+
+func pipe() (*chanTransport, *chanTransport) {
+	a, b := make(chan []byte, 1024), make(chan []byte, 1024)
+	done, once := make(chan struct{}), new(sync.Once)
+	return &chanTransport{in: a, out: b, done: done, once: once},
+		&chanTransport{in: b, out: a, done: done, once: once}
+}
+
+func (t *chanTransport) Write(msg []byte) error {
+	select {
+	case t.out <- append([]byte(nil), msg...):
+		return nil
+	case <-t.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (t *chanTransport) Read() ([]byte, error) {
+	select {
+	case msg := <-t.in:
+		return msg, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+func (t *chanTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+func muxPair(t *testing.T, cfg *Config) (*Mux, *Mux) {
+	t.Helper()
+	a, b := pipe()
+	client, err := Client(a, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := Server(b, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return client, server
+}
+
+// recorder captures frames as hex; the same vectors are checked by
+// tscode/bitseal_mux/Mux.test.ts.
+type recorder struct{ frames []string }
+
+func (r *recorder) Write(msg []byte) error {
+	r.frames = append(r.frames, hex.EncodeToString(msg))
+	return nil
+}
+
+func TestFrameVectors(t *testing.T) {
+	rec := &recorder{}
+	m, err := New(rec, true, &Config{Window: InitialWindow + 0x10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Receive([]byte{frameOpen, 0, 0, 0, 3, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Receive([]byte{frameData, 0, 0, 0, 9, 0, 0, 0, 0, 'x'}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"010000000100000000",     // OPEN 1
+		"030000000100010000",     // WINDOW 1 +64 KiB
+		"0200000001000000006869", // DATA 1 "hi"
+		"040000000100000000",     // CLOSE 1
+		"050000000300000001",     // RESET 3 refused: odd ID from the client side
+		"050000000900000001",     // RESET 9 refused: unknown stream
+	}
+	if len(rec.frames) != len(want) {
+		t.Fatalf("frames %v, want %v", rec.frames, want)
+	}
+	for i := range want {
+		if rec.frames[i] != want[i] {
+			t.Fatalf("frame %d = %s, want %s", i, rec.frames[i], want[i])
+		}
+	}
+
+	if err := m.Receive([]byte{0x7f, 0, 0, 0, 1, 0, 0, 0, 0}); err == nil {
+		t.Fatal("unknown frame type accepted")
+	}
+	if _, err := m.Open(); err == nil {
+		t.Fatal("Open succeeded on a failed mux")
+	}
+}
+
+// TestMuxEcho sends more than a window on several streams at once, so each
+// stream depends on WINDOW updates from a concurrently reading peer.
+func TestMuxEcho(t *testing.T) {
+	client, server := muxPair(t, nil)
+
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(s, s)
+				_ = s.CloseWrite()
+			}()
+		}
+	}()
+
+	const streams = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := client.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			payload := make([]byte, 3*InitialWindow+123)
+			rand.Read(payload)
+			go func() {
+				_, _ = s.Write(payload)
+				_ = s.CloseWrite()
+			}()
+			got, err := io.ReadAll(s)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, payload) {
+				errs <- errors.New("echo mismatch")
+			}
+			_ = s.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := muxPair(t, nil)
+
+	s, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID()%2 != 1 || peer.ID() != s.ID() {
+		t.Fatalf("stream IDs %d / %d", s.ID(), peer.ID())
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	// A reader blocked on the peer side wakes up with ErrStreamReset.
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := peer.Read(buf)
+		readErr <- err
+	}()
+	if err := s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, ErrStreamReset) {
+			t.Fatalf("peer read after reset: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer read did not fail after reset")
+	}
+	if _, err := s.Write([]byte("x")); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("write after reset: %v", err)
+	}
+
+	// Closing the mux fails streams and Accept.
+	s2, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if _, err := s2.Read(buf); !errors.Is(err, ErrMuxClosed) {
+		t.Fatalf("read after mux close: %v", err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatalf("stream opened before close not accepted: %v", err)
+	}
+	if _, err := server.Accept(); err == nil {
+		t.Fatal("Accept succeeded after peer closed")
+	}
+}
+
+// TestMuxOverWS runs the client over BitSealWSConn and the server side in
+// push mode from Server.OnMessage.
+func TestMuxOverWS(t *testing.T) {
+	serverPriv := fixedPriv(0x55)
+	srv := ws.NewServer(serverPriv, nil)
+	var (
+		mu    sync.Mutex
+		muxes = map[*rtc.Session]*Mux{}
+	)
+	srv.OnSession = func(sess *rtc.Session) {
+		m, _ := New(WriterFunc(func(msg []byte) error { return srv.SendTo(sess.PeerPub(), msg) }), false, nil)
+		mu.Lock()
+		muxes[sess] = m
+		mu.Unlock()
+		go func() {
+			for {
+				s, err := m.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(s, s)
+					_ = s.Close()
+				}()
+			}
+		}()
+	}
+	srv.OnMessage = func(sess *rtc.Session, plain []byte) ([]byte, error) {
+		mu.Lock()
+		m := muxes[sess]
+		mu.Unlock()
+		return nil, m.Receive(plain)
+	}
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+
+	u, _ := url.Parse(hs.URL)
+	conn, err := ws.ConnectBitSealWS(fixedPriv(0x33), serverPriv.PubKey(), "ws://"+u.Host+"/ws/socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		s, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := bytes.Repeat([]byte{byte(i)}, 100*1024)
+		go func() {
+			_, _ = s.Write(payload)
+			_ = s.CloseWrite()
+		}()
+		got, err := io.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("stream %d: echo mismatch (%d bytes)", s.ID(), len(got))
+		}
+	}
+}
+
+func fixedPriv(b byte) *ec.PrivateKey {
+	buf := make([]byte, 32)
+	buf[31] = b
+	k, _ := ec.PrivateKeyFromBytes(buf)
+	return k
+}
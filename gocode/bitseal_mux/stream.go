@@ -0,0 +1,228 @@
+package bitsealmux
+
+import (
+	"io"
+	"sync"
+)
+
+// Stream is one logical, reliable, ordered byte stream of a Mux. Read and
+// Write may be called concurrently with each other.
+type Stream struct {
+	id  uint32
+	mux *Mux
+
+	writeMu sync.Mutex // keeps the chunks of one Write together
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	recvWin uint32 // credit the peer still holds
+	unacked uint32 // bytes read but not yet returned as credit
+	credit  uint32 // bytes we may still send
+
+	readClosed  bool // peer sent CLOSE
+	writeClosed bool // we sent CLOSE
+	localClosed bool // Close called: reads fail, late data is discarded
+	err         error
+}
+
+var _ io.ReadWriteCloser = (*Stream)(nil)
+
+func newStream(m *Mux, id uint32) *Stream {
+	s := &Stream{id: id, mux: m, recvWin: m.cfg.Window, credit: InitialWindow}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID returns the stream ID; odd IDs were opened by the client side.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read reads stream data. It returns io.EOF after the peer's CLOSE once all
+// data has been read, ErrStreamReset after a reset, and the mux error if the
+// connection went away.
+func (s *Stream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 {
+		switch {
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		case s.localClosed:
+			s.mu.Unlock()
+			return 0, ErrStreamClosed
+		case s.readClosed:
+			s.mu.Unlock()
+			return 0, io.EOF
+		case len(b) == 0:
+			s.mu.Unlock()
+			return 0, nil
+		}
+		s.cond.Wait()
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	s.unacked += uint32(n)
+	var grant uint32
+	// Return credit in batches of half a window to limit WINDOW traffic.
+	if s.unacked >= s.mux.cfg.Window/2 && !s.readClosed {
+		grant, s.unacked = s.unacked, 0
+		s.recvWin += grant
+	}
+	s.mu.Unlock()
+	if grant > 0 {
+		if err := s.mux.writeFrame(frameWindow, s.id, grant, nil); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write sends b, blocking while the peer's window is exhausted.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		s.mu.Lock()
+		for s.err == nil && !s.writeClosed && s.credit == 0 {
+			s.cond.Wait()
+		}
+		switch {
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		case s.writeClosed:
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := len(b) - written
+		if n > s.mux.cfg.MaxData {
+			n = s.mux.cfg.MaxData
+		}
+		if uint32(n) > s.credit {
+			n = int(s.credit)
+		}
+		s.credit -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.mux.writeFrame(frameData, s.id, 0, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream: the peer reads io.EOF after the data
+// already sent, and this side can keep reading.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.writeClosed || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	done := s.readClosed
+	s.cond.Broadcast() // a Write waiting for credit gives up
+	s.mu.Unlock()
+	if done {
+		s.mux.remove(s.id)
+	}
+	// Taking writeMu lets an in-flight chunk go out before CLOSE.
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.mux.writeFrame(frameClose, s.id, 0, nil)
+}
+
+// Close half-closes the stream and stops reading; data that still arrives
+// is discarded.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	s.localClosed = true
+	drop := uint32(len(s.buf))
+	s.buf = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if drop > 0 {
+		// Discarded data still frees the peer's window.
+		s.creditBack(drop)
+	}
+	return s.CloseWrite()
+}
+
+// Reset aborts both directions; pending and future Reads and Writes on both
+// sides fail with ErrStreamReset.
+func (s *Stream) Reset() error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	s.mux.remove(s.id)
+	s.abort(ErrStreamReset)
+	return s.mux.writeFrame(frameReset, s.id, ResetCancel, nil)
+}
+
+func (s *Stream) abort(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+		s.buf = nil
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) creditBack(n uint32) {
+	s.mu.Lock()
+	s.recvWin += n
+	s.mu.Unlock()
+	_ = s.mux.writeFrame(frameWindow, s.id, n, nil)
+}
+
+func (s *Stream) receiveData(p []byte) error {
+	s.mu.Lock()
+	if s.readClosed || uint32(len(p)) > s.recvWin {
+		s.mu.Unlock()
+		s.mux.remove(s.id)
+		s.abort(ErrStreamReset)
+		return s.mux.writeFrame(frameReset, s.id, ResetProtocol, nil)
+	}
+	s.recvWin -= uint32(len(p))
+	if s.localClosed || s.err != nil {
+		s.mu.Unlock()
+		s.creditBack(uint32(len(p)))
+		return nil
+	}
+	s.buf = append(s.buf, p...)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Stream) receiveWindow(n uint32) {
+	s.mu.Lock()
+	if uint64(s.credit)+uint64(n) > 0xFFFFFFFF {
+		s.credit = 0xFFFFFFFF
+	} else {
+		s.credit += n
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) receiveClose() {
+	s.mu.Lock()
+	s.readClosed = true
+	done := s.writeClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if done {
+		s.mux.remove(s.id)
+	}
+}
@@ -0,0 +1,56 @@
+package bitsealmux
+
+import (
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+)
+
+// SessionTransport carries each mux frame as one BST2 record of Session,
+// for carriers that deliver whole records (a DataChannel, a UDP socket, a
+// WebSocket handled by hand). Frames up to DefaultMaxData fit in one
+// FRAG_SIZE record, so no fragmentation is needed.
+type SessionTransport struct {
+	Session *rtc.Session
+	// SendFrame sends one encoded record.
+	SendFrame func(frame []byte) error
+	// RecvFrame returns the next encoded record.
+	RecvFrame func() ([]byte, error)
+	// CloseFunc is optional and called by Close.
+	CloseFunc func() error
+}
+
+var _ Transport = (*SessionTransport)(nil)
+
+// Write encrypts msg into one record and sends it.
+func (t *SessionTransport) Write(msg []byte) error {
+	frame, err := t.Session.EncodeRecord(msg, 0)
+	if err != nil {
+		return err
+	}
+	return t.SendFrame(frame)
+}
+
+// Read returns the plaintext of the next data record; control records
+// (checkpoints) are handled by the session and skipped.
+func (t *SessionTransport) Read() ([]byte, error) {
+	for {
+		frame, err := t.RecvFrame()
+		if err != nil {
+			return nil, err
+		}
+		plain, flags, err := t.Session.DecodeRecordFlags(frame)
+		if err != nil {
+			return nil, err
+		}
+		if flags&rtc.FlagControl == 0 {
+			return plain, nil
+		}
+	}
+}
+
+// Close calls CloseFunc if set.
+func (t *SessionTransport) Close() error {
+	if t.CloseFunc == nil {
+		return nil
+	}
+	return t.CloseFunc()
+}
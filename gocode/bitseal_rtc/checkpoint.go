@@ -0,0 +1,357 @@
+package rtc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bsv-blockchain/go-sdk/message"
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+)
+
+// BSC3 – chained checkpoints (RTC spec §5).
+//
+// Each direction keeps a running transcript hash over every BST2 frame it
+// carries, exactly as the frame appears on the wire:
+//   T_0 = SHA256("BitSeal-BSC3" || pk_sender || salt_sender)
+//   T_i = SHA256(T_{i-1} || frame_i)
+// A checkpoint is a FlagControl record whose body is
+//   last_seq(8) || T(32) || sig
+// where sig = BRC-77 Sign("BSC3" || last_seq || T) for "anyone", so that any
+// auditor holding the sender's public key can verify it offline. Checkpoint
+// frames are themselves part of the transcript, which chains consecutive
+// checkpoints together.
+//
+// Receivers verify checkpoints against their own running hash, so BSC3
+// assumes ordered delivery (WebSocket, reliable DataChannel).
+
+const (
+	bsc3Label      = "BitSeal-BSC3"
+	bsc3SigPrefix  = "BSC3"
+	auditProto     = "BitSeal-BSC3/1"
+	minBRC77SigLen = 4 + 33 + 1 + 32 + 8
+)
+
+var (
+	// ErrCheckpointMismatch means a peer checkpoint does not match the frames
+	// we received, i.e. the transcripts diverged.
+	ErrCheckpointMismatch = errors.New("checkpoint does not match transcript")
+	// ErrCheckpointsDisabled is returned by checkpoint APIs on sessions created
+	// without SessionConfig.Checkpoints.
+	ErrCheckpointsDisabled = errors.New("checkpoints not enabled on session")
+)
+
+// CheckpointConfig controls when MaybeCheckpoint emits a checkpoint. A zero
+// value tracks transcripts and verifies peer checkpoints but only emits when
+// EncodeCheckpoint is called explicitly.
+type CheckpointConfig struct {
+	// Interval emits a checkpoint once this much time has passed since the
+	// previous one. Transports check it on every send and on a ticker of
+	// this period, so an idle link still checkpoints its last records.
+	// 0 disables the timer trigger.
+	Interval time.Duration
+	// Records emits a checkpoint after this many records. 0 disables it.
+	Records int
+}
+
+// Checkpoint is one signed BSC3 checkpoint as stored in an audit trail.
+type Checkpoint struct {
+	LastSeq    uint64 `json:"last_seq"`
+	Transcript string `json:"transcript"` // hex T after the frame with LastSeq
+	Sig        string `json:"sig"`        // hex BRC-77 signature
+}
+
+// AuditTrail is the checkpoint history of one direction.
+type AuditTrail struct {
+	Signer      string       `json:"signer"` // compressed public key hex of the sender
+	Salt        string       `json:"salt"`   // sender's 4-byte salt hex
+	Checkpoints []Checkpoint `json:"checkpoints"`
+}
+
+// AuditBundle is what a session exports for offline audit: checkpoints we
+// signed (Local) and checkpoints the peer signed and we verified (Remote).
+type AuditBundle struct {
+	Proto  string     `json:"proto"`
+	Local  AuditTrail `json:"local"`
+	Remote AuditTrail `json:"remote"`
+}
+
+type checkpointState struct {
+	cfg CheckpointConfig
+
+	sendHash    []byte
+	sendLastSeq uint64
+	sendSince   int // records since the last checkpoint
+	lastAt      time.Time
+
+	recvHash    []byte
+	recvLastSeq uint64
+
+	local  AuditTrail
+	remote AuditTrail
+}
+
+func newCheckpointState(cfg CheckpointConfig, selfPub *ec.PublicKey, selfSalt []byte, peerPub *ec.PublicKey, peerSalt []byte) *checkpointState {
+	return &checkpointState{
+		cfg:      cfg,
+		sendHash: transcriptInit(selfPub.Compressed(), selfSalt),
+		recvHash: transcriptInit(peerPub.Compressed(), peerSalt),
+		lastAt:   time.Now(),
+		local:    AuditTrail{Signer: hex.EncodeToString(selfPub.Compressed()), Salt: hex.EncodeToString(selfSalt)},
+		remote:   AuditTrail{Signer: hex.EncodeToString(peerPub.Compressed()), Salt: hex.EncodeToString(peerSalt)},
+	}
+}
+
+func transcriptInit(pub, salt []byte) []byte {
+	data := make([]byte, 0, len(bsc3Label)+len(pub)+len(salt))
+	data = append(data, bsc3Label...)
+	data = append(data, pub...)
+	data = append(data, salt...)
+	return sha256Sum(data)
+}
+
+func transcriptNext(prev, frame []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(frame)
+	return h.Sum(nil)
+}
+
+func (c *checkpointState) sent(frame []byte) {
+	c.sendHash = transcriptNext(c.sendHash, frame)
+	c.sendLastSeq = binary.BigEndian.Uint64(frame[5:13])
+	c.sendSince++
+}
+
+func (c *checkpointState) received(frame []byte) {
+	c.recvHash = transcriptNext(c.recvHash, frame)
+	c.recvLastSeq = binary.BigEndian.Uint64(frame[5:13])
+}
+
+func (c *checkpointState) due(now time.Time) bool {
+	if c.sendSince == 0 {
+		return false
+	}
+	if c.cfg.Records > 0 && c.sendSince >= c.cfg.Records {
+		return true
+	}
+	return c.cfg.Interval > 0 && now.Sub(c.lastAt) >= c.cfg.Interval
+}
+
+func checkpointSigned(lastSeq uint64, transcript []byte) []byte {
+	msg := make([]byte, 0, len(bsc3SigPrefix)+8+len(transcript))
+	msg = append(msg, bsc3SigPrefix...)
+	msg = binary.BigEndian.AppendUint64(msg, lastSeq)
+	return append(msg, transcript...)
+}
+
+// EncodeCheckpoint signs the current send transcript and seals it as a
+// checkpoint record. It fails if nothing was sent since the last checkpoint.
+func (s *Session) EncodeCheckpoint() ([]byte, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.encodeCheckpointLocked()
+}
+
+// MaybeCheckpoint returns a checkpoint record if one is due according to
+// CheckpointConfig, or nil. Transports call it after each send and every
+// CheckpointInterval, and must send the record before any later one.
+func (s *Session) MaybeCheckpoint() ([]byte, error) {
+	if s.cp == nil {
+		return nil, nil
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if !s.cp.due(time.Now()) {
+		return nil, nil
+	}
+	return s.encodeCheckpointLocked()
+}
+
+// CheckpointInterval returns CheckpointConfig.Interval, or 0 when
+// checkpoints are disabled or have no timer trigger.
+func (s *Session) CheckpointInterval() time.Duration {
+	if s.cp == nil {
+		return 0
+	}
+	return s.cp.cfg.Interval
+}
+
+func (s *Session) encodeCheckpointLocked() ([]byte, error) {
+	if s.cp == nil {
+		return nil, ErrCheckpointsDisabled
+	}
+	c := s.cp
+	if c.sendSince == 0 {
+		return nil, errors.New("no records since last checkpoint")
+	}
+	lastSeq, transcript := c.sendLastSeq, c.sendHash
+	sig, err := message.Sign(checkpointSigned(lastSeq, transcript), s.selfPriv, nil)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 0, 8+len(transcript)+len(sig))
+	body = binary.BigEndian.AppendUint64(body, lastSeq)
+	body = append(body, transcript...)
+	body = append(body, sig...)
+
+	frame, err := s.encodeControlLocked(ControlCheckpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	c.local.Checkpoints = append(c.local.Checkpoints, Checkpoint{
+		LastSeq:    lastSeq,
+		Transcript: hex.EncodeToString(transcript),
+		Sig:        hex.EncodeToString(sig),
+	})
+	c.sendSince = 0
+	c.lastAt = time.Now()
+	return frame, nil
+}
+
+// verifyCheckpointLocked checks a peer checkpoint body against the receive
+// transcript; the caller holds recvMu.
+func (s *Session) verifyCheckpointLocked(body []byte) error {
+	c := s.cp
+	if len(body) < 8+sha256.Size+minBRC77SigLen {
+		return errors.New("checkpoint too short")
+	}
+	lastSeq := binary.BigEndian.Uint64(body[:8])
+	transcript := body[8 : 8+sha256.Size]
+	sig := body[8+sha256.Size:]
+	if err := verifyAnyoneSig(checkpointSigned(lastSeq, transcript), sig, s.peerPub); err != nil {
+		return err
+	}
+	if lastSeq != c.recvLastSeq || !bytes.Equal(transcript, c.recvHash) {
+		return ErrCheckpointMismatch
+	}
+	c.remote.Checkpoints = append(c.remote.Checkpoints, Checkpoint{
+		LastSeq:    lastSeq,
+		Transcript: hex.EncodeToString(transcript),
+		Sig:        hex.EncodeToString(sig),
+	})
+	return nil
+}
+
+// verifyAnyoneSig verifies a BRC-77 "anyone" signature and that it was made
+// by signer.
+func verifyAnyoneSig(msg, sig []byte, signer *ec.PublicKey) error {
+	if len(sig) < minBRC77SigLen {
+		return errors.New("signature too short")
+	}
+	if !bytes.Equal(sig[4:37], signer.Compressed()) {
+		return errors.New("checkpoint signed by unexpected key")
+	}
+	ok, err := message.Verify(msg, sig, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("checkpoint signature invalid")
+	}
+	return nil
+}
+
+// ExportAudit returns a snapshot of both checkpoint trails.
+func (s *Session) ExportAudit() (*AuditBundle, error) {
+	if s.cp == nil {
+		return nil, ErrCheckpointsDisabled
+	}
+	s.sendMu.Lock()
+	local := s.cp.local
+	local.Checkpoints = append([]Checkpoint(nil), local.Checkpoints...)
+	s.sendMu.Unlock()
+	s.recvMu.Lock()
+	remote := s.cp.remote
+	remote.Checkpoints = append([]Checkpoint(nil), remote.Checkpoints...)
+	s.recvMu.Unlock()
+	return &AuditBundle{Proto: auditProto, Local: local, Remote: remote}, nil
+}
+
+// VerifyAuditTrail checks an audit trail against the frames captured for that
+// direction, in wire order, starting from the first frame of the session. It
+// needs no session keys. Every checkpoint must be correctly signed and match
+// the transcript recomputed from frames; frames after the last checkpoint are
+// not covered.
+func VerifyAuditTrail(trail *AuditTrail, frames [][]byte) error {
+	pubBytes, err := hex.DecodeString(trail.Signer)
+	if err != nil {
+		return fmt.Errorf("signer: %w", err)
+	}
+	signer, err := ec.ParsePubKey(pubBytes)
+	if err != nil {
+		return fmt.Errorf("signer: %w", err)
+	}
+	salt, err := hex.DecodeString(trail.Salt)
+	if err != nil {
+		return fmt.Errorf("salt: %w", err)
+	}
+	cps := trail.Checkpoints
+	for i, cp := range cps {
+		transcript, err := hex.DecodeString(cp.Transcript)
+		if err != nil {
+			return fmt.Errorf("checkpoint %d: %w", i, err)
+		}
+		sig, err := hex.DecodeString(cp.Sig)
+		if err != nil {
+			return fmt.Errorf("checkpoint %d: %w", i, err)
+		}
+		if err := verifyAnyoneSig(checkpointSigned(cp.LastSeq, transcript), sig, signer); err != nil {
+			return fmt.Errorf("checkpoint %d: %w", i, err)
+		}
+	}
+
+	h := transcriptInit(signer.Compressed(), salt)
+	next := 0
+	for i, f := range frames {
+		if next == len(cps) {
+			break
+		}
+		if len(f) < 4+1+8 {
+			return fmt.Errorf("frame %d too short", i)
+		}
+		h = transcriptNext(h, f)
+		if binary.BigEndian.Uint64(f[5:13]) != cps[next].LastSeq {
+			continue
+		}
+		if hex.EncodeToString(h) != cps[next].Transcript {
+			return fmt.Errorf("checkpoint %d: %w", next, ErrCheckpointMismatch)
+		}
+		next++
+	}
+	if next < len(cps) {
+		return fmt.Errorf("checkpoint %d (seq %d) not covered by frame log", next, cps[next].LastSeq)
+	}
+	return nil
+}
+
+// ReadFrameLog reads a capture of consecutive BST2 frames. Frames carry their
+// own 4-byte length, so a log is simply the frames written back to back.
+// A length larger than any valid record is rejected before allocating.
+func ReadFrameLog(r io.Reader) ([][]byte, error) {
+	var frames [][]byte
+	var lenBuf [4]byte
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return frames, nil
+			}
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		if int64(n) > maxRecordLen {
+			return nil, fmt.Errorf("frame %d: length %d exceeds %d", len(frames), n, maxRecordLen)
+		}
+		frame := make([]byte, 4+int(n))
+		copy(frame, lenBuf[:])
+		if _, err := io.ReadFull(r, frame[4:]); err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+}
@@ -0,0 +1,146 @@
+package rtc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestCheckpointAudit sends records with periodic checkpoints, then verifies
+// the receiver's audit bundle against the captured frame log.
+func TestCheckpointAudit(t *testing.T) {
+	sessA, sessB := sessionPair(t, SessionConfig{Checkpoints: &CheckpointConfig{Records: 3}}, SessionConfig{Checkpoints: &CheckpointConfig{}})
+
+	var wire [][]byte
+	send := func(frame []byte) {
+		wire = append(wire, frame)
+		plain, flags, err := sessB.DecodeRecordFlags(frame)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if flags&FlagControl != 0 {
+			if typ, _, _ := ParseControl(plain); typ != ControlCheckpoint {
+				t.Fatalf("unexpected control type %d", typ)
+			}
+		}
+	}
+	for i := 0; i < 10; i++ {
+		frame, err := sessA.EncodeRecord([]byte{byte(i)}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		send(frame)
+		cp, err := sessA.MaybeCheckpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp != nil {
+			send(cp)
+		}
+	}
+
+	bundle, err := sessB.ExportAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Remote.Checkpoints) != 3 {
+		t.Fatalf("expected 3 verified checkpoints, got %d", len(bundle.Remote.Checkpoints))
+	}
+	local, _ := sessA.ExportAudit()
+	if len(local.Local.Checkpoints) != 3 {
+		t.Fatalf("sender recorded %d checkpoints", len(local.Local.Checkpoints))
+	}
+
+	var log bytes.Buffer
+	for _, f := range wire {
+		log.Write(f)
+	}
+	frames, err := ReadFrameLog(&log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyAuditTrail(&bundle.Remote, frames); err != nil {
+		t.Fatalf("audit verify: %v", err)
+	}
+
+	// Flip one ciphertext byte inside the checkpointed range.
+	frames[1] = append([]byte(nil), frames[1]...)
+	frames[1][len(frames[1])-1] ^= 0xFF
+	if err := VerifyAuditTrail(&bundle.Remote, frames); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+}
+
+// TestCheckpointDivergence rejects a checkpoint after a frame was dropped.
+func TestCheckpointDivergence(t *testing.T) {
+	sessA, sessB := sessionPair(t, SessionConfig{Checkpoints: &CheckpointConfig{}}, SessionConfig{Checkpoints: &CheckpointConfig{}})
+
+	for i := 0; i < 3; i++ {
+		frame, _ := sessA.EncodeRecord([]byte{byte(i)}, 0)
+		if i == 1 {
+			continue // lost in transit
+		}
+		if _, err := sessB.DecodeRecord(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cp, err := sessA.EncodeCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessB.DecodeRecord(cp); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+}
+
+func TestReadFrameLogLimit(t *testing.T) {
+	if _, err := ReadFrameLog(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF})); err == nil {
+		t.Fatal("accepted a 4 GiB frame length")
+	}
+}
+
+// TestReassemblerSkipsCheckpoints interleaves checkpoints with fragmented
+// messages: the reassembler must leave them to the session, not parse them as
+// fragments.
+func TestReassemblerSkipsCheckpoints(t *testing.T) {
+	sessA, sessB := sessionPair(t, SessionConfig{Checkpoints: &CheckpointConfig{Records: 1}}, SessionConfig{Checkpoints: &CheckpointConfig{}})
+	frag, err := NewFragmenterWithOptions(sessA, FragOptions{FragSize: MinFragSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasm, err := NewReassemblerWithConfig(sessB, ReassemblerConfig{Frag: FragOptions{FragSize: MinFragSize}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		msg := bytes.Repeat([]byte{byte('a' + i)}, 3*MinFragSize)
+		frames, err := frag.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp, err := sessA.MaybeCheckpoint()
+		if err != nil || cp == nil {
+			t.Fatalf("checkpoint: %v", err)
+		}
+		var got []byte
+		for _, f := range append(frames, cp) {
+			plain, ok, err := reasm.Push(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				got = plain
+			}
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("message %d: reassembled %d bytes, want %d", i, len(got), len(msg))
+		}
+	}
+	if n, _ := reasm.Pending(); n != 0 {
+		t.Fatalf("%d partial messages left", n)
+	}
+	bundle, _ := sessB.ExportAudit()
+	if len(bundle.Remote.Checkpoints) != 3 {
+		t.Fatalf("verified %d checkpoints, want 3", len(bundle.Remote.Checkpoints))
+	}
+}
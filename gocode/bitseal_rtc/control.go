@@ -0,0 +1,48 @@
+package rtc
+
+import "errors"
+
+// ControlType identifies a control message carried in a FlagControl record.
+// The first plaintext byte of such a record is the type, the rest its body.
+// Control records are sealed like any other record, so they are authenticated
+// and replay-protected.
+type ControlType byte
+
+const (
+	// ControlCheckpoint carries a BSC3 signed checkpoint (see checkpoint.go).
+	ControlCheckpoint ControlType = 0x01
+	// ControlCloseNotify announces that the sender will send no more data on
+	// a stream transport (see Conn.CloseWrite). It has no body.
+	ControlCloseNotify ControlType = 0x02
+	// ControlPing asks the peer to echo its body back in a ControlPong. The
+	// body is opaque to the receiver; senders typically put a timestamp in it
+	// to measure round-trip time.
+	ControlPing ControlType = 0x03
+	// ControlPong answers a ControlPing with the same body.
+	ControlPong ControlType = 0x04
+	// ControlGoAway announces that the sender is shutting down and will close
+	// the connection shortly. The body is an optional UTF-8 reason.
+	ControlGoAway ControlType = 0x05
+)
+
+// EncodeControl seals a control message into a FlagControl record.
+func (s *Session) EncodeControl(typ ControlType, body []byte) ([]byte, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.encodeControlLocked(typ, body)
+}
+
+func (s *Session) encodeControlLocked(typ ControlType, body []byte) ([]byte, error) {
+	plain := make([]byte, 0, 1+len(body))
+	plain = append(plain, byte(typ))
+	plain = append(plain, body...)
+	return s.encodeRecordLocked(plain, FlagControl)
+}
+
+// ParseControl splits the plaintext of a FlagControl record into type and body.
+func ParseControl(plain []byte) (ControlType, []byte, error) {
+	if len(plain) < 1 {
+		return 0, nil, errors.New("empty control message")
+	}
+	return ControlType(plain[0]), plain[1:], nil
+}
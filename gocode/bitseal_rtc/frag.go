@@ -1,21 +1,27 @@
 package rtc
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
+	"time"
 )
 
 // Application-layer fragmentation (L profile) on top of BST2 session.
 // ‑ FRAG_SIZE  = 16 KiB
 // ‑ MAX_FRAGS  = 4096  (=> 64 MiB max message)
+// Both are defaults; peers may agree on other values (see FragOptions).
 // Each fragment plaintext = 8-byte header || slice(payload).
 // Header Layout (big endian):
-//   0       : flags (bit0 = 1 → last fragment)
+//   0       : flags (bit0 = 1 → last fragment, bit1 = 1 → L+ profile,
+//             bit2 = 1 → stream fragment, see stream.go)
 //   1..3    : msgID (24-bit)
 //   4..5    : fragID (uint16, starting 0)
 //   6..7    : totalFrags (uint16)
 // The fragment header is encrypted together with payload by Session.EncodeRecord().
-// Caller is responsible for mapping flags field at BST2 level (we always pass 0).
+// BST2 record flags default to 0; see Fragmenter.RecordFlags.
 
 const (
 	FRAG_SIZE = 16 * 1024
@@ -23,38 +29,148 @@ const (
 	hdrLen    = 8
 )
 
+// Bounds for FragOptions. fragID/total are 16-bit, so MaxFrags stops at
+// 65535; with 16 KiB fragments that is just under 1 GiB per message.
+const (
+	MinFragSize   = 256
+	MaxFragSize   = 1 << 20
+	MaxFragsLimit = 0xFFFF
+)
+
+// FragOptions carries the fragment size and per-message fragment limit of a
+// link. Zero fields mean FRAG_SIZE and MAX_FRAGS. The sender must not exceed
+// the receiver's values, so peers advertise theirs in the handshake and both
+// sides use NegotiateFrag.
+type FragOptions struct {
+	FragSize int `json:"frag_size,omitempty"` // plaintext bytes per fragment
+	MaxFrags int `json:"max_frags,omitempty"` // fragments per message
+}
+
+// WithDefaults fills zero fields with FRAG_SIZE / MAX_FRAGS and validates the
+// result.
+func (o FragOptions) WithDefaults() (FragOptions, error) {
+	if o.FragSize == 0 {
+		o.FragSize = FRAG_SIZE
+	}
+	if o.MaxFrags == 0 {
+		o.MaxFrags = MAX_FRAGS
+	}
+	if o.FragSize < MinFragSize || o.FragSize > MaxFragSize {
+		return o, fmt.Errorf("fragment size %d: must be in [%d, %d]", o.FragSize, MinFragSize, MaxFragSize)
+	}
+	if o.MaxFrags < 1 || o.MaxFrags > MaxFragsLimit {
+		return o, fmt.Errorf("max fragments %d: must be in [1, %d]", o.MaxFrags, MaxFragsLimit)
+	}
+	return o, nil
+}
+
+// MaxMessageSize returns FragSize × MaxFrags with defaults applied.
+func (o FragOptions) MaxMessageSize() int {
+	o, _ = o.WithDefaults()
+	return o.FragSize * o.MaxFrags
+}
+
+// NegotiateFrag combines the local options with those advertised by the peer
+// by taking the smaller value of each field, so both sides arrive at the same
+// result. A peer that advertised nothing (zero value) gets the defaults.
+func NegotiateFrag(local, peer FragOptions) (FragOptions, error) {
+	l, err := local.WithDefaults()
+	if err != nil {
+		return FragOptions{}, err
+	}
+	p, err := peer.WithDefaults()
+	if err != nil {
+		return FragOptions{}, fmt.Errorf("peer: %w", err)
+	}
+	return FragOptions{FragSize: min(l.FragSize, p.FragSize), MaxFrags: min(l.MaxFrags, p.MaxFrags)}, nil
+}
+
+// Fragment header flags.
+const (
+	fragFlagLast  = 0x01
+	fragFlagLPlus = 0x02
+)
+
+// Profile selects how a message is protected across its fragments. The
+// receiver learns it per message from the fragment header flags, so one
+// Reassembler handles both.
+type Profile uint8
+
+const (
+	// ProfileL seals every fragment as an independent BST2 record (default).
+	ProfileL Profile = iota
+	// ProfileLPlus carries a single tag on the last fragment (see fragplus.go).
+	ProfileLPlus
+)
+
 type Fragmenter struct {
 	sess      *Session
 	nextMsgID uint32 // 24-bit rolling counter
+	opts      FragOptions
+	maxIndex  uint32 // last stream fragment index, see EncodeStream
+
+	// Profile is used by Encode; the zero value is ProfileL.
+	Profile Profile
+
+	// RecordFlags are OR-ed into the BST2 flags of every fragment record.
+	// Transports that mix whole messages and fragments on one session set
+	// FlagFragment so the receiver knows which path a record takes.
+	RecordFlags byte
 }
 
 func NewFragmenter(sess *Session) *Fragmenter {
-	return &Fragmenter{sess: sess, nextMsgID: 0}
+	return &Fragmenter{sess: sess, nextMsgID: 0, opts: FragOptions{FragSize: FRAG_SIZE, MaxFrags: MAX_FRAGS}, maxIndex: maxStreamIndex}
+}
+
+// NewFragmenterWithOptions creates a Fragmenter that cuts messages into
+// opts.FragSize pieces and refuses messages above opts.MaxFrags fragments.
+// Use the options negotiated with the peer.
+func NewFragmenterWithOptions(sess *Session, opts FragOptions) (*Fragmenter, error) {
+	opts, err := opts.WithDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &Fragmenter{sess: sess, opts: opts, maxIndex: maxStreamIndex}, nil
 }
 
 // Encode splits plaintext into fragments, returns list of BST2 frames ready to send.
 func (f *Fragmenter) Encode(plaintext []byte) ([][]byte, error) {
-	total := (len(plaintext) + FRAG_SIZE - 1) / FRAG_SIZE
+	return f.EncodeProfile(plaintext, f.Profile)
+}
+
+// EncodeProfile is Encode with an explicit profile for this message.
+func (f *Fragmenter) EncodeProfile(plaintext []byte, profile Profile) ([][]byte, error) {
+	fragSize := f.opts.FragSize
+	total := (len(plaintext) + fragSize - 1) / fragSize
 	if total == 0 {
 		return nil, nil
 	}
-	if total > MAX_FRAGS {
-		return nil, errors.New("message too large for L profile")
+	if total > f.opts.MaxFrags {
+		return nil, fmt.Errorf("message too large: %d bytes exceeds %d", len(plaintext), f.opts.FragSize*f.opts.MaxFrags)
 	}
 	// rotate msgID 24-bit
 	f.nextMsgID = (f.nextMsgID + 1) & 0xFFFFFF
 	msgID := f.nextMsgID
+	lplus := profile == ProfileLPlus
+	var mac hash.Hash
+	if lplus {
+		mac = f.sess.newMergedMAC()
+	}
 	frames := make([][]byte, 0, total)
 	for i := 0; i < total; i++ {
-		start := i * FRAG_SIZE
-		end := start + FRAG_SIZE
+		start := i * fragSize
+		end := start + fragSize
 		if end > len(plaintext) {
 			end = len(plaintext)
 		}
 		frag := plaintext[start:end]
+		last := i == total-1
 		flags := byte(0)
-		if i == total-1 {
-			flags = 0x01 // last fragment flag
+		if last {
+			flags = fragFlagLast // last fragment flag
+		}
+		if lplus {
+			flags |= fragFlagLPlus
 		}
 		hdr := make([]byte, hdrLen)
 		hdr[0] = flags
@@ -63,7 +179,13 @@ func (f *Fragmenter) Encode(plaintext []byte) ([][]byte, error) {
 		binary.BigEndian.PutUint16(hdr[6:8], uint16(total))
 
 		plain := append(hdr, frag...)
-		frame, err := f.sess.EncodeRecord(plain, 0)
+		var frame []byte
+		var err error
+		if lplus {
+			frame, err = f.sess.sealMerged(plain, f.RecordFlags, mac, last)
+		} else {
+			frame, err = f.sess.EncodeRecord(plain, f.RecordFlags)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -72,61 +194,342 @@ func (f *Fragmenter) Encode(plaintext []byte) ([][]byte, error) {
 	return frames, nil
 }
 
+// Reassembler limits used when the ReassemblerConfig fields are zero.
+const (
+	DefaultMaxMessages      = 64
+	DefaultMaxBufferedBytes = 2 * FRAG_SIZE * MAX_FRAGS // two maximum-size messages at the default FragOptions
+	DefaultMessageTimeout   = time.Minute
+)
+
+// Reasons passed to ReassemblerConfig.OnEvict.
+var (
+	ErrReassemblyTimeout = errors.New("partial message timed out")
+	ErrTooManyMessages   = errors.New("too many partial messages")
+	ErrBufferLimit       = errors.New("reassembly buffer limit exceeded")
+	ErrFragmentConflict  = errors.New("too many conflicting L+ fragments")
+)
+
+// ReassemblerConfig bounds how much memory a peer can make a Reassembler
+// hold with partial messages.
+type ReassemblerConfig struct {
+	// MaxMessages caps concurrent partial messages. When a new message would
+	// exceed it, the oldest partial message is evicted.
+	MaxMessages int
+	// MaxBufferedBytes caps fragment payload bytes held across all partial
+	// messages. Older messages are evicted first; a message that cannot fit
+	// on its own is dropped.
+	// Zero means two maximum-size messages under Frag.
+	MaxBufferedBytes int
+	// MessageTimeout is the deadline for a message, counted from its first
+	// fragment. Stale messages are evicted on Push and by ExpireStale.
+	MessageTimeout time.Duration
+	// OnEvict, if set, is called for every partial message dropped before
+	// completion, with one of the Err* reasons above.
+	OnEvict func(msgID uint32, reason error)
+	// Frag is the fragment size and count accepted from the peer; zero
+	// fields take the defaults. Use the options negotiated with the peer.
+	Frag FragOptions
+}
+
 // Reassembler holds state for incoming fragments of one or multiple messages.
 // Call Push(frame) for every incoming BST2 frame; when a complete message is
 // assembled, it returns (msg, true). Otherwise returns (nil, false).
+// A Reassembler is not safe for concurrent use.
 
 type Reassembler struct {
-	sess *Session
-	msgs map[uint32]*msgBuf
+	sess     *Session
+	cfg      ReassemblerConfig
+	msgs     map[uint32]*msgBuf
+	buffered int // payload bytes across msgs
+	now      func() time.Time
 }
 
 type msgBuf struct {
 	total    uint16
-	frags    [][]byte
+	frags    map[uint16][]byte
 	received uint16
+	bytes    int
+	deadline time.Time
+
+	lplus     bool                       // message uses ProfileLPlus
+	merged    map[uint16][]*mergedRecord // L+ only: candidate ciphertext records by fragID
+	conflicts int                        // L+ only: candidates beyond the first per fragID
 }
 
+// NewReassembler creates a Reassembler with the default limits.
 func NewReassembler(sess *Session) *Reassembler {
-	return &Reassembler{sess: sess, msgs: make(map[uint32]*msgBuf)}
+	r, _ := NewReassemblerWithConfig(sess, ReassemblerConfig{})
+	return r
 }
 
+// NewReassemblerWithConfig creates a Reassembler with explicit limits; zero
+// fields take the Default* values.
+func NewReassemblerWithConfig(sess *Session, cfg ReassemblerConfig) (*Reassembler, error) {
+	frag, err := cfg.Frag.WithDefaults()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Frag = frag
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = DefaultMaxMessages
+	}
+	if cfg.MaxBufferedBytes <= 0 {
+		cfg.MaxBufferedBytes = 2 * frag.FragSize * frag.MaxFrags
+	}
+	if cfg.MessageTimeout <= 0 {
+		cfg.MessageTimeout = DefaultMessageTimeout
+	}
+	return &Reassembler{sess: sess, cfg: cfg, msgs: make(map[uint32]*msgBuf), now: time.Now}, nil
+}
+
+// Pending reports the number of partial messages and their buffered bytes.
+func (r *Reassembler) Pending() (messages, bytes int) {
+	return len(r.msgs), r.buffered
+}
+
+// ExpireStale evicts partial messages whose deadline has passed. Push does
+// this too; call it from a timer if frames may stop arriving.
+func (r *Reassembler) ExpireStale() {
+	now := r.now()
+	for id, mb := range r.msgs {
+		if now.After(mb.deadline) {
+			r.evict(id, ErrReassemblyTimeout)
+		}
+	}
+}
+
+// Push decodes one record and returns the message it completes, if any.
+// Control records (e.g. BSC3 checkpoints, which the session verifies) are
+// consumed and yield (nil, false, nil).
 func (r *Reassembler) Push(frame []byte) ([]byte, bool, error) {
-	plain, err := r.sess.DecodeRecord(frame)
+	r.ExpireStale()
+	if len(frame) > 4 && frame[4]&FlagTagMerged != 0 {
+		return r.pushMerged(frame)
+	}
+	plain, recFlags, err := r.sess.DecodeRecordFlags(frame)
 	if err != nil {
 		return nil, false, err
 	}
+	if recFlags&FlagControl != 0 {
+		return nil, false, nil
+	}
 	if len(plain) < hdrLen {
 		return nil, false, errors.New("fragment too small")
 	}
 	flags := plain[0]
-	_ = flags
 	msgID := get24(plain[1:4])
 	fragID := binary.BigEndian.Uint16(plain[4:6])
 	total := binary.BigEndian.Uint16(plain[6:8])
 	data := plain[hdrLen:]
+	if flags&fragFlagLPlus != 0 {
+		return nil, false, errors.New("L+ fragment header in sealed record")
+	}
+	if flags&fragFlagStream != 0 {
+		return nil, false, errors.New("stream fragment; use StreamReassembler")
+	}
+	if err := r.checkFragHeader(fragID, total, len(data)); err != nil {
+		return nil, false, err
+	}
+	if total == 1 {
+		return data, true, nil
+	}
+
+	mb, err := r.slot(msgID, total, false)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, dup := mb.frags[fragID]; dup {
+		return nil, false, nil
+	}
+	if err := r.reserve(msgID, mb, len(data)); err != nil {
+		return nil, false, err
+	}
+	mb.frags[fragID] = data
+	mb.received++
+	if mb.received < mb.total {
+		return nil, false, nil
+	}
+
+	r.remove(msgID)
+	full := make([]byte, 0, mb.bytes)
+	for i := uint16(0); i < mb.total; i++ {
+		full = append(full, mb.frags[i]...)
+	}
+	return full, true, nil
+}
 
-	mb, ok := r.msgs[msgID]
-	if !ok {
-		mb = &msgBuf{total: total, frags: make([][]byte, total)}
-		r.msgs[msgID] = mb
+// pushMerged buffers an L+ fragment; the message is authenticated and
+// decrypted as a whole once every fragment is in.
+func (r *Reassembler) pushMerged(frame []byte) ([]byte, bool, error) {
+	rec, hdr, err := r.sess.openMerged(frame)
+	if err != nil {
+		return nil, false, err
+	}
+	if hdr[0]&fragFlagLPlus == 0 {
+		return nil, false, errors.New("L+ record without L+ fragment header")
 	}
-	if int(fragID) >= len(mb.frags) {
-		return nil, false, errors.New("fragID overflow")
+	msgID := get24(hdr[1:4])
+	fragID := binary.BigEndian.Uint16(hdr[4:6])
+	total := binary.BigEndian.Uint16(hdr[6:8])
+	if err := r.checkFragHeader(fragID, total, len(rec.ct)-hdrLen); err != nil {
+		return nil, false, err
 	}
-	if mb.frags[fragID] == nil {
-		mb.frags[fragID] = data
-		mb.received++
+	if (hdr[0]&fragFlagLast != 0) != (fragID == total-1) {
+		return nil, false, errors.New("L+ last flag on wrong fragment")
 	}
-	if mb.received == mb.total {
-		full := make([]byte, 0)
-		for i := 0; i < int(mb.total); i++ {
-			full = append(full, mb.frags[i]...)
+
+	var recs []*mergedRecord
+	if total == 1 {
+		recs = []*mergedRecord{rec}
+	} else {
+		mb, err := r.slot(msgID, total, true)
+		if err != nil {
+			return nil, false, err
+		}
+		// The header is not authenticated yet, so a record claiming an
+		// occupied fragID may be the genuine one behind an injected copy:
+		// keep every distinct candidate and let the tag decide.
+		cands := mb.merged[fragID]
+		for _, c := range cands {
+			if bytes.Equal(c.frame, rec.frame) {
+				return nil, false, nil
+			}
+		}
+		if len(cands) > 0 {
+			if mb.conflicts >= maxMergedConflicts {
+				r.evict(msgID, ErrFragmentConflict)
+				return nil, false, ErrFragmentConflict
+			}
+			mb.conflicts++
+		}
+		if err := r.reserve(msgID, mb, len(rec.ct)); err != nil {
+			return nil, false, err
+		}
+		mb.merged[fragID] = append(cands, rec)
+		if len(cands) == 0 {
+			mb.received++
+		}
+		if mb.received < mb.total {
+			return nil, false, nil
 		}
+		plains, err := r.sess.finishCandidates(mb.merged, mb.total)
+		if err != nil {
+			// Keep the message: the genuine copy of a fragment may still be
+			// on its way. MessageTimeout or the conflict limit drops it
+			// otherwise.
+			return nil, false, err
+		}
+		r.remove(msgID)
+		return joinMerged(plains), true, nil
+	}
+
+	plains, err := r.sess.finishMerged(recs)
+	if err != nil {
+		return nil, false, err
+	}
+	return joinMerged(plains), true, nil
+}
+
+// joinMerged strips the fragment headers from decrypted L+ fragments.
+func joinMerged(plains [][]byte) []byte {
+	size := 0
+	for _, p := range plains {
+		size += len(p) - hdrLen
+	}
+	full := make([]byte, 0, size)
+	for _, p := range plains {
+		full = append(full, p[hdrLen:]...)
+	}
+	return full
+}
+
+// checkFragHeader validates header fields before anything is buffered.
+func (r *Reassembler) checkFragHeader(fragID, total uint16, dataLen int) error {
+	if total == 0 || int(total) > r.cfg.Frag.MaxFrags {
+		return fmt.Errorf("invalid fragment total %d", total)
+	}
+	if fragID >= total {
+		return errors.New("fragID overflow")
+	}
+	if dataLen > r.cfg.Frag.FragSize {
+		return fmt.Errorf("fragment larger than %d bytes", r.cfg.Frag.FragSize)
+	}
+	return nil
+}
+
+// slot returns the buffer for msgID, creating it (and evicting the oldest
+// message if MaxMessages is reached) when needed. Later fragments must agree
+// with the first one on total and profile.
+func (r *Reassembler) slot(msgID uint32, total uint16, lplus bool) (*msgBuf, error) {
+	if mb, ok := r.msgs[msgID]; ok {
+		if mb.lplus != lplus {
+			return nil, errors.New("profile mismatch within message")
+		}
+		if mb.total != total {
+			return nil, errors.New("inconsistent fragment total")
+		}
+		return mb, nil
+	}
+	for len(r.msgs) >= r.cfg.MaxMessages {
+		r.evictOldest(msgID, ErrTooManyMessages)
+	}
+	mb := &msgBuf{total: total, lplus: lplus, deadline: r.now().Add(r.cfg.MessageTimeout)}
+	if lplus {
+		mb.merged = make(map[uint16][]*mergedRecord)
+	} else {
+		mb.frags = make(map[uint16][]byte)
+	}
+	r.msgs[msgID] = mb
+	return mb, nil
+}
+
+// reserve accounts n more bytes for msgID, evicting older messages first. If
+// the message cannot fit even alone it is dropped.
+func (r *Reassembler) reserve(msgID uint32, mb *msgBuf, n int) error {
+	for r.buffered+n > r.cfg.MaxBufferedBytes && len(r.msgs) > 1 {
+		r.evictOldest(msgID, ErrBufferLimit)
+	}
+	if r.buffered+n > r.cfg.MaxBufferedBytes {
+		r.evict(msgID, ErrBufferLimit)
+		return ErrBufferLimit
+	}
+	mb.bytes += n
+	r.buffered += n
+	return nil
+}
+
+// evictOldest evicts the message with the earliest deadline other than keep.
+func (r *Reassembler) evictOldest(keep uint32, reason error) {
+	var oldestID uint32
+	var oldest *msgBuf
+	for id, mb := range r.msgs {
+		if id == keep {
+			continue
+		}
+		if oldest == nil || mb.deadline.Before(oldest.deadline) {
+			oldestID, oldest = id, mb
+		}
+	}
+	if oldest != nil {
+		r.evict(oldestID, reason)
+	}
+}
+
+func (r *Reassembler) evict(msgID uint32, reason error) {
+	if _, ok := r.msgs[msgID]; !ok {
+		return
+	}
+	r.remove(msgID)
+	if r.cfg.OnEvict != nil {
+		r.cfg.OnEvict(msgID, reason)
+	}
+}
+
+func (r *Reassembler) remove(msgID uint32) {
+	if mb, ok := r.msgs[msgID]; ok {
+		r.buffered -= mb.bytes
 		delete(r.msgs, msgID)
-		return full, true, nil
 	}
-	return nil, false, nil
 }
 
 // helper: put/get 24-bit big-endian
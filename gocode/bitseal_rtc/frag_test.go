@@ -3,7 +3,10 @@ package rtc
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"testing"
+	"time"
 
 	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
 	"go.uber.org/zap/zaptest"
@@ -58,3 +61,317 @@ func TestFragmentRoundtrip(t *testing.T) {
 	}
 	t.Fatal("message not reassembled")
 }
+
+func lplusPair(t *testing.T) (*Fragmenter, *Reassembler) {
+	t.Helper()
+	sessA, sessB := sessionPair(t, SessionConfig{}, SessionConfig{})
+	frag := NewFragmenter(sessA)
+	frag.Profile = ProfileLPlus
+	return frag, NewReassembler(sessB)
+}
+
+func TestLPlusRoundtrip(t *testing.T) {
+	fragA, recvB := lplusPair(t)
+
+	msg := make([]byte, 1<<20+123)
+	_, _ = rand.Read(msg)
+	frames, err := fragA.Encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainFrames, _ := NewFragmenter(fragA.sess).EncodeProfile(msg, ProfileL)
+	lplusBytes, lBytes := 0, 0
+	for i := range frames {
+		lplusBytes += len(frames[i])
+		lBytes += len(plainFrames[i])
+	}
+	if lBytes-lplusBytes != (len(frames)-1)*tagSize {
+		t.Fatalf("unexpected overhead: L=%d L+=%d", lBytes, lplusBytes)
+	}
+
+	// deliver the last fragment first to exercise buffering
+	frames = append(frames[len(frames)-1:], frames[:len(frames)-1]...)
+	for i, f := range frames {
+		plain, ok, err := recvB.Push(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			if i != len(frames)-1 {
+				t.Fatal("completed early")
+			}
+			if !bytes.Equal(plain, msg) {
+				t.Fatal("mismatch after L+ roundtrip")
+			}
+			return
+		}
+	}
+	t.Fatal("message not reassembled")
+}
+
+func TestLPlusTagMismatch(t *testing.T) {
+	for _, target := range []string{"middle", "tag"} {
+		fragA, recvB := lplusPair(t)
+		msg := make([]byte, 5*FRAG_SIZE)
+		_, _ = rand.Read(msg)
+		frames, err := fragA.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch target {
+		case "middle":
+			frames[2][40] ^= 0x01
+		case "tag":
+			last := frames[len(frames)-1]
+			last[len(last)-1] ^= 0x01
+		}
+		var lastErr error
+		for _, f := range frames {
+			_, ok, err := recvB.Push(f)
+			if ok {
+				t.Fatalf("%s: tampered message accepted", target)
+			}
+			lastErr = err
+		}
+		if !errors.Is(lastErr, ErrTagMismatch) {
+			t.Fatalf("%s: expected ErrTagMismatch, got %v", target, lastErr)
+		}
+		// the message waits for a genuine copy until its deadline
+		if msgs, _ := recvB.Pending(); msgs != 1 {
+			t.Fatalf("%s: %d messages pending after tag mismatch", target, msgs)
+		}
+		recvB.now = func() time.Time { return time.Now().Add(2 * DefaultMessageTimeout) }
+		recvB.ExpireStale()
+		if msgs, _ := recvB.Pending(); msgs != 0 {
+			t.Fatalf("%s: failed message still buffered after expiry", target)
+		}
+	}
+}
+
+// TestLPlusInjectedCopy delivers a bit-flipped copy of a fragment ahead of the
+// genuine one: L+ headers are unauthenticated until the tag check, so the copy
+// must not take the genuine fragment's place.
+func TestLPlusInjectedCopy(t *testing.T) {
+	for _, target := range []int{2, 4} {
+		fragA, recvB := lplusPair(t)
+		msg := make([]byte, 5*FRAG_SIZE)
+		_, _ = rand.Read(msg)
+		frames, err := fragA.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bogus := bytes.Clone(frames[target])
+		bogus[len(bogus)-20] ^= 0x01
+		order := append(append(append([][]byte{}, frames[:target]...), bogus), frames[target:]...)
+
+		var got []byte
+		for i, f := range order {
+			plain, ok, err := recvB.Push(f)
+			if err != nil && !(errors.Is(err, ErrTagMismatch) && i == len(order)-2) {
+				t.Fatalf("fragment %d: push %d: %v", target, i, err)
+			}
+			if ok {
+				got = plain
+			}
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("fragment %d: genuine message not recovered", target)
+		}
+		if msgs, _ := recvB.Pending(); msgs != 0 {
+			t.Fatalf("fragment %d: %d messages left pending", target, msgs)
+		}
+	}
+}
+
+func TestLPlusConflictLimit(t *testing.T) {
+	fragA, recvB := lplusPair(t)
+	var evicted error
+	recvB.cfg.OnEvict = func(_ uint32, reason error) { evicted = reason }
+	frames, err := fragA.Encode(make([]byte, 3*FRAG_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := recvB.Push(frames[1]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		bogus := bytes.Clone(frames[1])
+		bogus[len(bogus)-1-i] ^= 0x01
+		_, _, err := recvB.Push(bogus)
+		if i < maxMergedConflicts {
+			if err != nil {
+				t.Fatalf("copy %d: %v", i, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrFragmentConflict) || !errors.Is(evicted, ErrFragmentConflict) {
+			t.Fatalf("expected ErrFragmentConflict, got %v (evicted %v)", err, evicted)
+		}
+		break
+	}
+	if msgs, bytes := recvB.Pending(); msgs != 0 || bytes != 0 {
+		t.Fatalf("pending %d msgs / %d bytes after conflict", msgs, bytes)
+	}
+}
+
+// rawFragment seals a hand-made Profile L fragment.
+func rawFragment(t *testing.T, sess *Session, msgID uint32, fragID, total uint16, data []byte) []byte {
+	t.Helper()
+	hdr := make([]byte, hdrLen)
+	if fragID == total-1 {
+		hdr[0] = fragFlagLast
+	}
+	put24(hdr[1:4], msgID)
+	binary.BigEndian.PutUint16(hdr[4:6], fragID)
+	binary.BigEndian.PutUint16(hdr[6:8], total)
+	frame, err := sess.EncodeRecord(append(hdr, data...), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	sessA, sessB := sessionPair(t, SessionConfig{}, SessionConfig{})
+
+	type eviction struct {
+		msgID  uint32
+		reason error
+	}
+	var evicted []eviction
+	now := time.Unix(1000, 0)
+	r, err := NewReassemblerWithConfig(sessB, ReassemblerConfig{
+		MaxMessages:      2,
+		MaxBufferedBytes: 3 * FRAG_SIZE,
+		MessageTimeout:   time.Second,
+		OnEvict:          func(id uint32, reason error) { evicted = append(evicted, eviction{id, reason}) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.now = func() time.Time { return now }
+	chunk := make([]byte, FRAG_SIZE)
+
+	push := func(frame []byte) error {
+		_, _, err := r.Push(frame)
+		return err
+	}
+
+	// the header claims 65535 fragments: rejected before anything is buffered
+	if err := push(rawFragment(t, sessA, 1, 0, 0xFFFF, chunk)); err == nil {
+		t.Fatal("oversized total accepted")
+	}
+
+	// consistent-total validation
+	if err := push(rawFragment(t, sessA, 2, 0, 4, chunk)); err != nil {
+		t.Fatal(err)
+	}
+	if err := push(rawFragment(t, sessA, 2, 1, 5, chunk)); err == nil {
+		t.Fatal("inconsistent total accepted")
+	}
+
+	// a third concurrent message evicts the oldest one
+	now = now.Add(10 * time.Millisecond)
+	_ = push(rawFragment(t, sessA, 3, 0, 4, chunk))
+	now = now.Add(10 * time.Millisecond)
+	_ = push(rawFragment(t, sessA, 4, 0, 4, chunk))
+	if len(evicted) != 1 || evicted[0].msgID != 2 || !errors.Is(evicted[0].reason, ErrTooManyMessages) {
+		t.Fatalf("unexpected evictions %+v", evicted)
+	}
+
+	// byte limit: 3 fragments fit, the fourth evicts message 3
+	_ = push(rawFragment(t, sessA, 4, 1, 4, chunk))
+	_ = push(rawFragment(t, sessA, 4, 2, 4, chunk))
+	if len(evicted) != 2 || evicted[1].msgID != 3 || !errors.Is(evicted[1].reason, ErrBufferLimit) {
+		t.Fatalf("unexpected evictions %+v", evicted)
+	}
+	if msgs, bytes := r.Pending(); msgs != 1 || bytes != 3*FRAG_SIZE {
+		t.Fatalf("pending %d msgs / %d bytes", msgs, bytes)
+	}
+
+	// message 4 times out
+	now = now.Add(2 * time.Second)
+	r.ExpireStale()
+	if len(evicted) != 3 || evicted[2].msgID != 4 || !errors.Is(evicted[2].reason, ErrReassemblyTimeout) {
+		t.Fatalf("unexpected evictions %+v", evicted)
+	}
+	if msgs, bytes := r.Pending(); msgs != 0 || bytes != 0 {
+		t.Fatalf("pending %d msgs / %d bytes after expiry", msgs, bytes)
+	}
+}
+
+// TestFragOptions negotiates a small fragment size through the handshake and
+// checks both ends honour it.
+func TestFragOptions(t *testing.T) {
+	privA := mustPriv(0x01)
+	privB := mustPriv(0x02)
+
+	raw, sig, _, err := BuildHandshakeWithFrag(privA, privB.PubKey(), FragOptions{FragSize: 1024, MaxFrags: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _, _, err := VerifyHandshakeMsg(raw, sig, privB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := NegotiateFrag(FragOptions{FragSize: 4096}, msg.Frag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts != (FragOptions{FragSize: 1024, MaxFrags: 8}) {
+		t.Fatalf("negotiated %+v", opts)
+	}
+	if got, _ := NegotiateFrag(FragOptions{}, FragOptions{}); got != (FragOptions{FragSize: FRAG_SIZE, MaxFrags: MAX_FRAGS}) {
+		t.Fatalf("defaults negotiated to %+v", got)
+	}
+
+	// an unadvertised handshake keeps its original canonical form
+	raw, _, _, _ = BuildHandshake(privA, privB.PubKey())
+	if bytes.Contains(raw, []byte("frag_size")) {
+		t.Fatalf("default handshake advertises fragments: %s", raw)
+	}
+
+	sessA, sessB := sessionPair(t, SessionConfig{}, SessionConfig{})
+	fragA, err := NewFragmenterWithOptions(sessA, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvB, err := NewReassemblerWithConfig(sessB, ReassemblerConfig{Frag: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 8*1024)
+	_, _ = rand.Read(payload)
+	frames, err := fragA.Encode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 8 {
+		t.Fatalf("expected 8 fragments, got %d", len(frames))
+	}
+	var got []byte
+	for _, f := range frames {
+		if got, _, err = recvB.Push(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("mismatch after roundtrip")
+	}
+	if _, err := fragA.Encode(append(payload, 0)); err == nil {
+		t.Fatal("message above MaxFrags accepted")
+	}
+
+	// fragments from a sender using the defaults exceed the agreed size
+	big, _ := NewFragmenter(sessA).Encode(make([]byte, 2048))
+	if _, _, err := recvB.Push(big[0]); err == nil {
+		t.Fatal("oversized fragment accepted")
+	}
+
+	for _, bad := range []FragOptions{{FragSize: 16}, {FragSize: MaxFragSize + 1}, {MaxFrags: MaxFragsLimit + 1}} {
+		if _, err := NewFragmenterWithOptions(sessA, bad); err == nil {
+			t.Fatalf("%+v accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package rtc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+)
+
+// Tag-merged high profile (L+), Future §6.
+//
+// Every fragment of an L+ message travels in its own BST2 record with
+// FlagTagMerged set and no per-record tag:
+//   len || flags || seq || ciphertext            (fragments 0 .. total-2)
+//   len || flags || seq || ciphertext || tag     (last fragment)
+// ciphertext is the 8-byte fragment header plus payload, encrypted with
+// AES-CTR under the direction key and the usual nonce salt||seq (the same
+// keystream GCM would use for that nonce, which is never reused because seq is
+// unique). A single HMAC-SHA256 runs across the fragments in fragID order,
+//   tag = HMAC(mac_key, Σ flags || seq || len(ct) || ct)[:16]
+//   mac_key = HMAC-SHA256(direction key, "BitSeal L+ mac")
+// i.e. encrypt-then-MAC over the whole message. Receivers buffer ciphertext
+// (bounded by the fragment limits), verify the tag when the last fragment is
+// in, and only then decrypt and commit the seqs to the replay window.
+
+// FlagTagMerged marks a BST2 record that carries an L+ fragment.
+const FlagTagMerged byte = 0x04
+
+const mergedMacLabel = "BitSeal L+ mac"
+
+// ErrTagMismatch is returned when an L+ message fails its final tag check.
+// Nothing of the message is released or committed.
+var ErrTagMismatch = errors.New("L+ message tag mismatch")
+
+// maxMergedConflicts caps the extra candidates a Reassembler keeps per L+
+// message for fragIDs that arrived more than once with different bytes, so
+// at most 2^maxMergedConflicts combinations are ever tag-checked.
+const maxMergedConflicts = 4
+
+// mergedRecord is one buffered L+ fragment on the receive side.
+type mergedRecord struct {
+	flags byte
+	seq   uint64
+	frame []byte
+	ct    []byte // header || payload, still encrypted
+	tag   []byte // last fragment only
+}
+
+func mergedMacKey(dirKey []byte) []byte {
+	m := hmac.New(sha256.New, dirKey)
+	m.Write([]byte(mergedMacLabel))
+	return m.Sum(nil)
+}
+
+func macRecord(mac hash.Hash, flags byte, seq uint64, ct []byte) {
+	var hdr [13]byte
+	hdr[0] = flags
+	binary.BigEndian.PutUint64(hdr[1:9], seq)
+	binary.BigEndian.PutUint32(hdr[9:13], uint32(len(ct)))
+	mac.Write(hdr[:])
+	mac.Write(ct)
+}
+
+// ctrXOR applies the AES-CTR keystream of nonce salt||seq to src. The counter
+// starts at 2 like GCM's payload counter.
+func ctrXOR(key, salt []byte, seq uint64, dst, src []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	binary.BigEndian.PutUint64(iv[4:12], seq)
+	binary.BigEndian.PutUint32(iv[12:], 2)
+	cipher.NewCTR(block, iv).XORKeyStream(dst, src)
+	return nil
+}
+
+// newMergedMAC starts the running tag for an outbound L+ message.
+func (s *Session) newMergedMAC() hash.Hash {
+	return hmac.New(sha256.New, mergedMacKey(s.sendKey))
+}
+
+// sealMerged encrypts one L+ fragment and feeds it into mac. The last
+// fragment carries the message tag.
+func (s *Session) sealMerged(plain []byte, flags byte, mac hash.Hash, last bool) ([]byte, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.seq == math.MaxUint64 {
+		return nil, ErrSeqExhausted
+	}
+	s.seq++
+	flags |= FlagTagMerged
+
+	n := 1 + 8 + len(plain)
+	if last {
+		n += tagSize
+	}
+	buf := make([]byte, 4+n)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(n))
+	buf[4] = flags
+	binary.BigEndian.PutUint64(buf[5:13], s.seq)
+	ct := buf[13 : 13+len(plain)]
+	if err := ctrXOR(s.sendKey, s.saltSend, s.seq, ct, plain); err != nil {
+		return nil, err
+	}
+	macRecord(mac, flags, s.seq, ct)
+	if last {
+		copy(buf[13+len(plain):], mac.Sum(nil)[:tagSize])
+	}
+	if s.cp != nil {
+		s.cp.sent(buf)
+	}
+	return buf, nil
+}
+
+// openMerged parses an L+ record and decrypts its fragment header. Nothing
+// is authenticated yet and the replay window is only checked, not updated.
+func (s *Session) openMerged(frame []byte) (*mergedRecord, []byte, error) {
+	if len(frame) < 4+1+8+hdrLen {
+		return nil, nil, errors.New("frame too short")
+	}
+	length := binary.BigEndian.Uint32(frame[:4])
+	if int(length) != len(frame[4:]) {
+		return nil, nil, fmt.Errorf("length mismatch: %d vs %d", length, len(frame[4:]))
+	}
+	rec := &mergedRecord{
+		flags: frame[4],
+		seq:   binary.BigEndian.Uint64(frame[5:13]),
+		frame: frame,
+		ct:    frame[13:],
+	}
+	if rec.flags&FlagTagMerged == 0 {
+		return nil, nil, errors.New("not an L+ record")
+	}
+
+	s.recvMu.Lock()
+	fresh := s.recvWindow.check(rec.seq)
+	s.recvMu.Unlock()
+	if !fresh {
+		return nil, nil, errors.New("replay or old packet")
+	}
+
+	hdr := make([]byte, hdrLen)
+	if err := ctrXOR(s.recvKey, s.saltRecv, rec.seq, hdr, rec.ct[:hdrLen]); err != nil {
+		return nil, nil, err
+	}
+	if hdr[0]&fragFlagLast != 0 {
+		if len(rec.ct) < hdrLen+tagSize {
+			return nil, nil, errors.New("last L+ fragment without tag")
+		}
+		rec.tag = rec.ct[len(rec.ct)-tagSize:]
+		rec.ct = rec.ct[:len(rec.ct)-tagSize]
+	}
+	return rec, hdr, nil
+}
+
+// finishCandidates tries each choice of one candidate per fragID, in fragID
+// order with increasing seqs (the order the sender sealed them), until one
+// passes the tag check. An injected copy of a fragment therefore cannot
+// displace the genuine record.
+func (s *Session) finishCandidates(cands map[uint16][]*mergedRecord, total uint16) ([][]byte, error) {
+	recs := make([]*mergedRecord, total)
+	var try func(i int) ([][]byte, error)
+	try = func(i int) ([][]byte, error) {
+		if i == len(recs) {
+			return s.finishMerged(recs)
+		}
+		err := ErrTagMismatch
+		for _, rec := range cands[uint16(i)] {
+			if i > 0 && rec.seq <= recs[i-1].seq {
+				continue
+			}
+			recs[i] = rec
+			plains, e := try(i + 1)
+			if e == nil {
+				return plains, nil
+			}
+			err = e
+		}
+		return nil, err
+	}
+	return try(0)
+}
+
+// finishMerged verifies the message tag over recs (in fragID order, last
+// record carrying the tag), commits their seqs and returns the decrypted
+// fragment plaintexts (header included).
+func (s *Session) finishMerged(recs []*mergedRecord) ([][]byte, error) {
+	mac := hmac.New(sha256.New, mergedMacKey(s.recvKey))
+	for _, r := range recs {
+		macRecord(mac, r.flags, r.seq, r.ct)
+	}
+	last := recs[len(recs)-1]
+	if last.tag == nil || !hmac.Equal(mac.Sum(nil)[:tagSize], last.tag) {
+		return nil, ErrTagMismatch
+	}
+
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	for _, r := range recs {
+		if !s.recvWindow.check(r.seq) {
+			return nil, errors.New("replay or old packet")
+		}
+	}
+	plains := make([][]byte, len(recs))
+	for i, r := range recs {
+		s.recvWindow.commit(r.seq)
+		if s.cp != nil {
+			s.cp.received(r.frame)
+		}
+		plains[i] = make([]byte, len(r.ct))
+		if err := ctrXOR(s.recvKey, s.saltRecv, r.seq, plains[i], r.ct); err != nil {
+			return nil, err
+		}
+	}
+	return plains, nil
+}
@@ -0,0 +1,253 @@
+package rtc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	"go.uber.org/zap"
+)
+
+// Handshaker runs a complete BSH1 exchange (RTC spec §2) for one side:
+//
+//	initiator                              responder
+//	  Start()      ── msg_i, sig_i ──▶
+//	                                       Respond(msg_i, sig_i)
+//	               ◀── msg_r, sig_r ──
+//	  Finish(msg_r, sig_r)
+//
+// On top of BuildHandshake / VerifyHandshake it checks the peer's ts against
+// the local clock, checks the signed pk against the expected peer, and binds
+// both messages together: msg_r carries bind = SHA256(msg_i), and
+//
+//	transcript = SHA256("BitSeal-BSH1 transcript" || len(msg_i) || msg_i || len(msg_r) || msg_r)
+//
+// is mixed into the HKDF key schedule, so a session only comes up if both
+// sides saw exactly the same two messages. Both peers must use a Handshaker;
+// the key schedule is always KeyScheduleHKDF.
+//
+// A Handshaker is single-use and not safe for concurrent use. Any error is
+// final.
+type Handshaker struct {
+	role     Role
+	selfPriv *ec.PrivateKey
+	peerPub  *ec.PublicKey
+	cfg      HandshakeConfig
+	now      func() time.Time
+
+	state    hsState
+	initRaw  []byte // initiator only: our first message
+	selfSalt []byte
+	peerMsg  *HandshakeMsg
+	frag     FragOptions
+}
+
+// Role selects which side of the exchange a Handshaker plays.
+type Role uint8
+
+const (
+	RoleInitiator Role = iota + 1
+	RoleResponder
+)
+
+type hsState uint8
+
+const (
+	hsNew hsState = iota
+	hsSent
+	hsDone
+	hsFailed
+)
+
+// DefaultMaxClockSkew is the accepted difference between a handshake ts and
+// the local clock (RTC spec §6).
+const DefaultMaxClockSkew = 300 * time.Second
+
+const transcriptLabel = "BitSeal-BSH1 transcript"
+
+// Handshake errors.
+var (
+	ErrHandshakeState   = errors.New("handshake step out of order")
+	ErrClockSkew        = errors.New("handshake timestamp outside allowed skew")
+	ErrUnexpectedPeer   = errors.New("handshake signed by unexpected peer")
+	ErrHandshakeUnbound = errors.New("handshake response not bound to our message")
+)
+
+// HandshakeConfig tunes a Handshaker.
+type HandshakeConfig struct {
+	// Session configures the resulting session. KeySchedule must be zero or
+	// KeyScheduleHKDF.
+	Session SessionConfig
+	// Frag is advertised to the peer; Frag() returns the negotiated result.
+	Frag FragOptions
+	// MaxClockSkew; zero means DefaultMaxClockSkew.
+	MaxClockSkew time.Duration
+	// Logger is optional; nil stays silent.
+	Logger *zap.Logger
+}
+
+// NewHandshaker prepares one side of a handshake. peerPub is the expected
+// peer identity; a responder may pass nil to accept any initiator and learn
+// its key from the first message (see PeerPub).
+func NewHandshaker(role Role, selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, cfg HandshakeConfig) (*Handshaker, error) {
+	if role != RoleInitiator && role != RoleResponder {
+		return nil, fmt.Errorf("invalid handshake role %d", role)
+	}
+	if peerPub == nil && role == RoleInitiator {
+		return nil, errors.New("initiator needs the peer public key")
+	}
+	if cfg.Session.KeySchedule == 0 {
+		cfg.Session.KeySchedule = KeyScheduleHKDF
+	}
+	if cfg.Session.KeySchedule != KeyScheduleHKDF {
+		return nil, errors.New("handshaker requires KeyScheduleHKDF")
+	}
+	if cfg.MaxClockSkew <= 0 {
+		cfg.MaxClockSkew = DefaultMaxClockSkew
+	}
+	if _, err := cfg.Frag.WithDefaults(); err != nil {
+		return nil, err
+	}
+	return &Handshaker{role: role, selfPriv: selfPriv, peerPub: peerPub, cfg: cfg, now: time.Now}, nil
+}
+
+// Start builds the initiator's signed message.
+func (h *Handshaker) Start() (raw, sig []byte, err error) {
+	if h.role != RoleInitiator || h.state != hsNew {
+		return nil, nil, ErrHandshakeState
+	}
+	defer h.failOn(&err)
+	raw, sig, h.selfSalt, err = h.build("")
+	if err != nil {
+		return nil, nil, err
+	}
+	h.initRaw = raw
+	h.state = hsSent
+	return raw, sig, nil
+}
+
+// Respond verifies the initiator's message and returns the signed reply
+// together with the established session.
+func (h *Handshaker) Respond(raw, sig []byte) (reply, replySig []byte, sess *Session, err error) {
+	if h.role != RoleResponder || h.state != hsNew {
+		return nil, nil, nil, ErrHandshakeState
+	}
+	defer h.failOn(&err)
+	if err := h.verifyPeer(raw, sig); err != nil {
+		return nil, nil, nil, err
+	}
+	bind := sha256.Sum256(raw)
+	reply, replySig, h.selfSalt, err = h.build(hex.EncodeToString(bind[:]))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sess, err = h.session(raw, reply)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return reply, replySig, sess, nil
+}
+
+// Finish verifies the responder's reply and returns the established session.
+func (h *Handshaker) Finish(raw, sig []byte) (sess *Session, err error) {
+	if h.role != RoleInitiator || h.state != hsSent {
+		return nil, ErrHandshakeState
+	}
+	defer h.failOn(&err)
+	if err := h.verifyPeer(raw, sig); err != nil {
+		return nil, err
+	}
+	want := sha256.Sum256(h.initRaw)
+	if h.peerMsg.Bind != hex.EncodeToString(want[:]) {
+		return nil, ErrHandshakeUnbound
+	}
+	return h.session(h.initRaw, raw)
+}
+
+// PeerPub returns the verified peer key once the peer's message is accepted.
+func (h *Handshaker) PeerPub() *ec.PublicKey {
+	if h.peerMsg == nil {
+		return nil
+	}
+	return h.peerPub
+}
+
+// Frag returns the fragment options negotiated with the peer; it is valid
+// once the session is established.
+func (h *Handshaker) Frag() FragOptions {
+	return h.frag
+}
+
+func (h *Handshaker) failOn(err *error) {
+	if *err != nil {
+		h.state = hsFailed
+	}
+}
+
+func (h *Handshaker) build(bind string) (raw, sig, salt []byte, err error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	return buildHandshake(h.selfPriv, h.peerPub, h.cfg.Frag, hex.EncodeToString(nonce), bind)
+}
+
+// verifyPeer checks signature, identity and timestamp of the peer's message.
+func (h *Handshaker) verifyPeer(raw, sig []byte) error {
+	msg, pub, _, err := VerifyHandshakeMsg(raw, sig, h.selfPriv)
+	if err != nil {
+		return err
+	}
+	if h.peerPub != nil && !bytes.Equal(pub.Compressed(), h.peerPub.Compressed()) {
+		return ErrUnexpectedPeer
+	}
+	skew := h.now().Sub(time.UnixMilli(msg.Ts))
+	if skew < -h.cfg.MaxClockSkew || skew > h.cfg.MaxClockSkew {
+		return fmt.Errorf("%w: %s", ErrClockSkew, skew)
+	}
+	if msg.Nonce == "" {
+		return errors.New("handshake message without nonce")
+	}
+	if h.role == RoleResponder && msg.Bind != "" {
+		return errors.New("initiator message must not carry bind")
+	}
+	h.peerPub, h.peerMsg = pub, msg
+	return nil
+}
+
+func (h *Handshaker) session(initRaw, respRaw []byte) (*Session, error) {
+	peerSalt, err := hex.DecodeString(h.peerMsg.Salt)
+	if err != nil {
+		return nil, err
+	}
+	frag, err := NegotiateFrag(h.cfg.Frag, h.peerMsg.Frag())
+	if err != nil {
+		return nil, err
+	}
+	sess, err := newSession(h.selfPriv, h.peerPub, h.selfSalt, peerSalt, transcriptHash(initRaw, respRaw), h.cfg.Session, h.cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+	h.frag = frag
+	h.state = hsDone
+	return sess, nil
+}
+
+func transcriptHash(initRaw, respRaw []byte) []byte {
+	t := sha256.New()
+	t.Write([]byte(transcriptLabel))
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(initRaw)))
+	t.Write(n[:])
+	t.Write(initRaw)
+	binary.BigEndian.PutUint32(n[:], uint32(len(respRaw)))
+	t.Write(n[:])
+	t.Write(respRaw)
+	return t.Sum(nil)
+}
@@ -0,0 +1,108 @@
+package rtc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func runHandshake(t *testing.T, init, resp *Handshaker) (*Session, *Session) {
+	t.Helper()
+	raw, sig, err := init.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, replySig, sessB, err := resp.Respond(raw, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessA, err := init.Finish(reply, replySig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessA, sessB
+}
+
+func TestHandshaker(t *testing.T) {
+	privA, privB := mustPriv(0x01), mustPriv(0x02)
+	init, _ := NewHandshaker(RoleInitiator, privA, privB.PubKey(), HandshakeConfig{Frag: FragOptions{FragSize: 4096}})
+	// the responder learns the initiator's identity from its message
+	resp, _ := NewHandshaker(RoleResponder, privB, nil, HandshakeConfig{})
+	sessA, sessB := runHandshake(t, init, resp)
+
+	if !resp.PeerPub().IsEqual(privA.PubKey()) {
+		t.Fatal("responder learned the wrong peer")
+	}
+	if init.Frag() != resp.Frag() || init.Frag().FragSize != 4096 {
+		t.Fatalf("frag options disagree: %+v vs %+v", init.Frag(), resp.Frag())
+	}
+	if sessA.KeySchedule() != KeyScheduleHKDF {
+		t.Fatalf("unexpected key schedule %v", sessA.KeySchedule())
+	}
+	for _, dir := range []struct{ from, to *Session }{{sessA, sessB}, {sessB, sessA}} {
+		frame, _ := dir.from.EncodeRecord([]byte("hi"), 0)
+		if plain, err := dir.to.DecodeRecord(frame); err != nil || string(plain) != "hi" {
+			t.Fatalf("roundtrip: %q %v", plain, err)
+		}
+	}
+
+	// the transcript feeds the keys: the same identities and salts without
+	// it give different keys
+	plain, _ := NewSessionWithConfig(privA, privB.PubKey(), sessA.saltSend, sessA.saltRecv, SessionConfig{KeySchedule: KeyScheduleHKDF}, nil)
+	if bytes.Equal(plain.sendKey, sessA.sendKey) {
+		t.Fatal("transcript not mixed into the keys")
+	}
+	if _, _, err := init.Start(); !errors.Is(err, ErrHandshakeState) {
+		t.Fatalf("restart allowed: %v", err)
+	}
+}
+
+func TestHandshakerRejects(t *testing.T) {
+	privA, privB, privC := mustPriv(0x01), mustPriv(0x02), mustPriv(0x03)
+
+	t.Run("unexpected peer", func(t *testing.T) {
+		init, _ := NewHandshaker(RoleInitiator, privC, privB.PubKey(), HandshakeConfig{})
+		resp, _ := NewHandshaker(RoleResponder, privB, privA.PubKey(), HandshakeConfig{})
+		raw, sig, _ := init.Start()
+		if _, _, _, err := resp.Respond(raw, sig); !errors.Is(err, ErrUnexpectedPeer) {
+			t.Fatalf("got %v", err)
+		}
+		if _, _, _, err := resp.Respond(raw, sig); !errors.Is(err, ErrHandshakeState) {
+			t.Fatalf("failed handshaker reused: %v", err)
+		}
+	})
+
+	t.Run("clock skew", func(t *testing.T) {
+		init, _ := NewHandshaker(RoleInitiator, privA, privB.PubKey(), HandshakeConfig{})
+		resp, _ := NewHandshaker(RoleResponder, privB, privA.PubKey(), HandshakeConfig{})
+		resp.now = func() time.Time { return time.Now().Add(301 * time.Second) }
+		raw, sig, _ := init.Start()
+		if _, _, _, err := resp.Respond(raw, sig); !errors.Is(err, ErrClockSkew) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("replayed reply", func(t *testing.T) {
+		// a reply captured from one handshake must not complete another
+		init1, _ := NewHandshaker(RoleInitiator, privA, privB.PubKey(), HandshakeConfig{})
+		resp1, _ := NewHandshaker(RoleResponder, privB, privA.PubKey(), HandshakeConfig{})
+		raw, sig, _ := init1.Start()
+		reply, replySig, _, err := resp1.Respond(raw, sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		init2, _ := NewHandshaker(RoleInitiator, privA, privB.PubKey(), HandshakeConfig{})
+		_, _, _ = init2.Start()
+		if _, err := init2.Finish(reply, replySig); !errors.Is(err, ErrHandshakeUnbound) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("legacy schedule", func(t *testing.T) {
+		cfg := HandshakeConfig{Session: SessionConfig{KeySchedule: KeyScheduleLegacy}}
+		if _, err := NewHandshaker(RoleInitiator, privA, privB.PubKey(), cfg); err == nil {
+			t.Fatal("legacy key schedule accepted")
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package rtc
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+)
+
+// KeySchedule selects how BST2 keys are derived from the ECDH shared secret.
+//
+// Versions are never renumbered: peers that exchange a version number must
+// agree on the meaning of every value below.
+type KeySchedule uint8
+
+const (
+	// KeyScheduleLegacy is the original derivation
+	//   key = SHA256(shared || salt_lo || salt_hi)
+	// One key is shared by both directions, which are separated only by the
+	// 4-byte salt in the nonce. Kept for compatibility with existing peers.
+	KeyScheduleLegacy KeySchedule = 1
+
+	// KeyScheduleHKDF derives independent send / receive keys plus an exporter
+	// secret with HKDF-SHA256. The info string binds the protocol label, both
+	// public keys and both salts, so two sessions only share keys if they share
+	// every one of those inputs.
+	KeyScheduleHKDF KeySchedule = 2
+)
+
+// keyScheduleLabel is the HKDF label for KeyScheduleHKDF.
+const keyScheduleLabel = "BitSeal-RTC/2 key schedule"
+
+// ErrNoExporter is returned by ExportKeyingMaterial on sessions whose key
+// schedule does not provide an exporter secret.
+var ErrNoExporter = errors.New("key schedule has no exporter secret")
+
+func (ks KeySchedule) String() string {
+	switch ks {
+	case KeyScheduleLegacy:
+		return "legacy"
+	case KeyScheduleHKDF:
+		return "hkdf"
+	default:
+		return fmt.Sprintf("KeySchedule(%d)", uint8(ks))
+	}
+}
+
+// sessionKeys holds the per-direction material of an established session.
+type sessionKeys struct {
+	send     []byte // 32-byte AES key for outbound records
+	recv     []byte // 32-byte AES key for inbound records
+	exporter []byte // nil for KeyScheduleLegacy
+}
+
+// deriveKey derives 32-byte session key from shared secret + salts.
+// This is KeyScheduleLegacy; both directions use the returned key.
+func deriveKey(shared, saltA, saltB []byte) []byte {
+	// 为保证两端顺序一致，按字典序拼接 saltA、saltB。
+	if bytes.Compare(saltA, saltB) > 0 {
+		saltA, saltB = saltB, saltA
+	}
+	data := make([]byte, 0, len(shared)+len(saltA)+len(saltB))
+	data = append(data, shared...)
+	data = append(data, saltA...)
+	data = append(data, saltB...)
+	return sha256Sum(data)
+}
+
+// deriveSessionKeys runs the selected key schedule. transcript, if not nil,
+// is the handshake transcript hash (see Handshaker) and requires
+// KeyScheduleHKDF.
+func deriveSessionKeys(ks KeySchedule, shared []byte, selfPub, peerPub *ec.PublicKey, selfSalt, peerSalt, transcript []byte) (*sessionKeys, error) {
+	switch ks {
+	case KeyScheduleLegacy:
+		if transcript != nil {
+			return nil, errors.New("transcript binding requires KeyScheduleHKDF")
+		}
+		key := deriveKey(shared, selfSalt, peerSalt)
+		return &sessionKeys{send: key, recv: key}, nil
+	case KeyScheduleHKDF:
+		return deriveHKDFKeys(shared, selfPub, peerPub, selfSalt, peerSalt, transcript)
+	default:
+		return nil, fmt.Errorf("unsupported key schedule %d", uint8(ks))
+	}
+}
+
+// deriveHKDFKeys implements KeyScheduleHKDF:
+//
+//	prk      = HKDF-Extract(salt = label, ikm = shared)
+//	ctx      = pk_a || salt_a || pk_b || salt_b [|| transcript]
+//	key_a→b  = HKDF-Expand(prk, label || " a->b" || ctx, 32)
+//	key_b→a  = HKDF-Expand(prk, label || " b->a" || ctx, 32)
+//	exporter = HKDF-Expand(prk, label || " exporter" || ctx, 32)
+//
+// Party "a" is the side whose pk || salt sorts lower, so both peers build the
+// same ctx without any extra negotiation. A loopback session (identical
+// identities) uses key_a→b in both directions. The transcript hash is only
+// present for sessions set up by a Handshaker.
+func deriveHKDFKeys(shared []byte, selfPub, peerPub *ec.PublicKey, selfSalt, peerSalt, transcript []byte) (*sessionKeys, error) {
+	selfID := append(append([]byte{}, selfPub.Compressed()...), selfSalt...)
+	peerID := append(append([]byte{}, peerPub.Compressed()...), peerSalt...)
+	order := bytes.Compare(selfID, peerID)
+	lo, hi := selfID, peerID
+	if order > 0 {
+		lo, hi = peerID, selfID
+	}
+	ctx := make([]byte, 0, len(lo)+len(hi)+len(transcript))
+	ctx = append(ctx, lo...)
+	ctx = append(ctx, hi...)
+	ctx = append(ctx, transcript...)
+
+	prk, err := hkdf.Extract(sha256.New, shared, []byte(keyScheduleLabel))
+	if err != nil {
+		return nil, err
+	}
+	expand := func(purpose string) ([]byte, error) {
+		return hkdf.Expand(sha256.New, prk, keyScheduleLabel+" "+purpose+string(ctx), 32)
+	}
+	kAB, err := expand("a->b")
+	if err != nil {
+		return nil, err
+	}
+	kBA, err := expand("b->a")
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := expand("exporter")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &sessionKeys{exporter: exporter}
+	switch {
+	case order < 0:
+		keys.send, keys.recv = kAB, kBA
+	case order > 0:
+		keys.send, keys.recv = kBA, kAB
+	default:
+		keys.send, keys.recv = kAB, kAB
+	}
+	return keys, nil
+}
+
+// exportKeyingMaterial expands the exporter secret for an application label,
+// in the spirit of RFC 5705. label and context are length-prefixed so that
+// different (label, context) pairs can never produce the same info string.
+func exportKeyingMaterial(exporter []byte, label string, context []byte, length int) ([]byte, error) {
+	if exporter == nil {
+		return nil, ErrNoExporter
+	}
+	if length <= 0 {
+		return nil, errors.New("invalid exporter length")
+	}
+	info := make([]byte, 0, 2+len(label)+4+len(context))
+	info = binary.BigEndian.AppendUint16(info, uint16(len(label)))
+	info = append(info, label...)
+	info = binary.BigEndian.AppendUint32(info, uint32(len(context)))
+	info = append(info, context...)
+	return hkdf.Expand(sha256.New, exporter, "BitSeal exporter"+string(info), length)
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
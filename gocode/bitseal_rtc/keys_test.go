@@ -0,0 +1,104 @@
+package rtc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// sessionPair returns connected sessions for mustPriv(0x01) (a) and
+// mustPriv(0x02) (b) with fixed salts: records sealed by a open on b and
+// vice versa.
+func sessionPair(t *testing.T, cfgA, cfgB SessionConfig) (a, b *Session) {
+	t.Helper()
+	privA, privB := mustPriv(0x01), mustPriv(0x02)
+	saltA, saltB := []byte{1, 2, 3, 4}, []byte{5, 6, 7, 8}
+	a, err := NewSessionWithConfig(privA, privB.PubKey(), saltA, saltB, cfgA, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = NewSessionWithConfig(privB, privA.PubKey(), saltB, saltA, cfgB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+var hkdfConfig = SessionConfig{KeySchedule: KeyScheduleHKDF}
+
+// TestHKDFKeySchedule checks both directions round-trip with distinct keys.
+func TestHKDFKeySchedule(t *testing.T) {
+	sessA, sessB := sessionPair(t, hkdfConfig, hkdfConfig)
+
+	if bytes.Equal(sessA.sendKey, sessA.recvKey) {
+		t.Fatal("send and receive keys must differ")
+	}
+	if !bytes.Equal(sessA.sendKey, sessB.recvKey) || !bytes.Equal(sessA.recvKey, sessB.sendKey) {
+		t.Fatal("peers disagree on direction keys")
+	}
+
+	for _, dir := range []struct {
+		from, to *Session
+	}{{sessA, sessB}, {sessB, sessA}} {
+		frame, err := dir.from.EncodeRecord([]byte("hello"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := dir.to.DecodeRecord(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plain) != "hello" {
+			t.Fatalf("unexpected plaintext %q", plain)
+		}
+	}
+
+	// A frame must not decrypt in the direction it was not sealed for.
+	frame, _ := sessA.EncodeRecord([]byte("loop"), 0)
+	if _, err := sessA.DecodeRecord(frame); err == nil {
+		t.Fatal("own frame decrypted with receive key")
+	}
+}
+
+// TestLegacyKeySchedule pins the original SHA256(shared || salt_lo || salt_hi).
+func TestLegacyKeySchedule(t *testing.T) {
+	privA := mustPriv(0x01)
+	privB := mustPriv(0x02)
+	saltA := []byte{5, 6, 7, 8}
+	saltB := []byte{1, 2, 3, 4}
+	sess, err := NewSession(privA, privB.PubKey(), saltA, saltB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _ := privA.DeriveSharedSecret(privB.PubKey())
+	want := sha256Sum(append(append(shared.Compressed(), saltB...), saltA...))
+	if !bytes.Equal(sess.sendKey, want) || !bytes.Equal(sess.recvKey, want) {
+		t.Fatal("legacy key derivation changed")
+	}
+	if sess.KeySchedule() != KeyScheduleLegacy {
+		t.Fatalf("unexpected schedule %v", sess.KeySchedule())
+	}
+	if _, err := sess.ExportKeyingMaterial("app", nil, 32); !errors.Is(err, ErrNoExporter) {
+		t.Fatalf("expected ErrNoExporter, got %v", err)
+	}
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	sessA, sessB := sessionPair(t, hkdfConfig, hkdfConfig)
+
+	a, err := sessA.ExportKeyingMaterial("app", []byte("ctx"), 48)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sessB.ExportKeyingMaterial("app", []byte("ctx"), 48)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 48 || !bytes.Equal(a, b) {
+		t.Fatal("exporter output differs between peers")
+	}
+	other, _ := sessA.ExportKeyingMaterial("app2", []byte("ctx"), 48)
+	if bytes.Equal(a, other) {
+		t.Fatal("exporter ignores label")
+	}
+}
@@ -0,0 +1,399 @@
+package rtc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+)
+
+// Stream transport (RTC spec §6, note 3: binary stream mode keeps the len field).
+//
+// Client and Server run a bound BSH1 handshake (Handshaker) over any reliable
+// byte stream and return a net.Conn whose bytes travel as BST2 records:
+//
+//	handshake frame : len(4) || raw_len(2) || raw || sig
+//	data            : BST2 records as produced by Session.EncodeRecord
+//
+// Both kinds start with a 4-byte big-endian length, so the reader always
+// knows how much to read. Writes are cut into records of at most
+// ConnConfig.RecordSize plaintext bytes; reads buffer the rest of a record
+// across calls.
+
+const (
+	// DefaultHandshakeTimeout bounds Client/Server when
+	// ConnConfig.HandshakeTimeout is zero.
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	maxHandshakeFrame = 64 * 1024
+	recordOverhead    = 1 + 8 + tagSize
+	// maxRecordLen bounds the length field of any BST2 record: the largest
+	// fragment plus its header, sealed.
+	maxRecordLen = MaxFragSize + hdrLen + recordOverhead
+)
+
+// ErrWriteClosed is returned by Conn.Write after CloseWrite.
+var ErrWriteClosed = errors.New("bitseal conn: write side closed")
+
+// ConnConfig tunes Client and Server. The zero value is usable.
+type ConnConfig struct {
+	// Handshake configures the handshake and the resulting session.
+	Handshake HandshakeConfig
+	// HandshakeTimeout bounds the handshake using the underlying conn's
+	// deadline; zero means DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// RecordSize is the largest plaintext sent in one record; zero means
+	// FRAG_SIZE. Receivers accept records up to MaxFragSize.
+	RecordSize int
+}
+
+// Conn is a net.Conn carrying BST2 records over another net.Conn. Read and
+// Write may be called concurrently, as net.Conn requires.
+type Conn struct {
+	conn       net.Conn
+	sess       *Session
+	recordSize int
+
+	readMu  sync.Mutex
+	in      []byte // raw bytes of records not yet decoded
+	rbuf    []byte // decrypted bytes not yet returned by Read
+	readErr error  // sticky: a broken record stream cannot recover
+
+	writeMu     sync.Mutex
+	writeClosed bool
+	writeErr    error // sticky: a record may have been partly written
+
+	done      chan struct{} // closed by Close; stops checkpointLoop
+	closeOnce sync.Once
+}
+
+// Client performs the initiator side of the handshake with the peer that
+// owns serverPub over conn.
+func Client(conn net.Conn, selfPriv *ec.PrivateKey, serverPub *ec.PublicKey, cfg *ConnConfig) (*Conn, error) {
+	return handshakeConn(conn, RoleInitiator, selfPriv, serverPub, cfg)
+}
+
+// Server performs the responder side of the handshake over conn. clientPub
+// may be nil to accept any client; Conn.PeerPub reports who connected.
+func Server(conn net.Conn, selfPriv *ec.PrivateKey, clientPub *ec.PublicKey, cfg *ConnConfig) (*Conn, error) {
+	return handshakeConn(conn, RoleResponder, selfPriv, clientPub, cfg)
+}
+
+func handshakeConn(conn net.Conn, role Role, selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, cfg *ConnConfig) (*Conn, error) {
+	if cfg == nil {
+		cfg = &ConnConfig{}
+	}
+	recordSize := cfg.RecordSize
+	if recordSize == 0 {
+		recordSize = FRAG_SIZE
+	}
+	if recordSize < 1 || recordSize > MaxFragSize {
+		return nil, fmt.Errorf("record size %d: must be in [1, %d]", recordSize, MaxFragSize)
+	}
+	timeout := cfg.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	h, err := NewHandshaker(role, selfPriv, peerPub, cfg.Handshake)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var sess *Session
+	if role == RoleInitiator {
+		raw, sig, err := h.Start()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHandshakeFrame(conn, raw, sig); err != nil {
+			return nil, err
+		}
+		reply, replySig, err := readHandshakeFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if sess, err = h.Finish(reply, replySig); err != nil {
+			return nil, err
+		}
+	} else {
+		raw, sig, err := readHandshakeFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		reply, replySig, s, err := h.Respond(raw, sig)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHandshakeFrame(conn, reply, replySig); err != nil {
+			return nil, err
+		}
+		sess = s
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, sess: sess, recordSize: recordSize, done: make(chan struct{})}
+	if interval := sess.CheckpointInterval(); interval > 0 {
+		go c.checkpointLoop(interval)
+	}
+	return c, nil
+}
+
+func writeHandshakeFrame(w io.Writer, raw, sig []byte) error {
+	n := 2 + len(raw) + len(sig)
+	if 4+n > maxHandshakeFrame || len(raw) > 0xFFFF {
+		return errors.New("handshake message too large")
+	}
+	buf := make([]byte, 4+n)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(n))
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(raw)))
+	copy(buf[6:], raw)
+	copy(buf[6+len(raw):], sig)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readHandshakeFrame(r io.Reader) (raw, sig []byte, err error) {
+	body, err := readFrame(r, maxHandshakeFrame)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) < 2 {
+		return nil, nil, errors.New("handshake frame too short")
+	}
+	rawLen := int(binary.BigEndian.Uint16(body[:2]))
+	if 2+rawLen > len(body) {
+		return nil, nil, errors.New("handshake frame truncated")
+	}
+	return body[2 : 2+rawLen], body[2+rawLen:], nil
+}
+
+// readFrame reads one length-prefixed frame and returns its body.
+func readFrame(r io.Reader, max int) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if int64(n) > int64(max) {
+		return nil, fmt.Errorf("frame of %d bytes exceeds %d", n, max)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// Session returns the underlying BST2 session.
+func (c *Conn) Session() *Session {
+	return c.sess
+}
+
+// PeerPub returns the authenticated public key of the peer.
+func (c *Conn) PeerPub() *ec.PublicKey {
+	return c.sess.PeerPub()
+}
+
+// Read reads decrypted bytes, buffering the remainder of a record for the
+// next call. It returns io.EOF once the peer has called CloseWrite or closed
+// the underlying connection at a record boundary.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.rbuf) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		if err := c.readRecord(); err != nil {
+			// Partial input is kept, so a timeout can be retried.
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return 0, err
+			}
+			c.readErr = err
+			return 0, err
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// readRecord reads and decrypts one record into rbuf. Bytes are accumulated
+// in c.in, so an interrupted read resumes where it stopped.
+func (c *Conn) readRecord() error {
+	for {
+		if len(c.in) >= 4 {
+			n := int(binary.BigEndian.Uint32(c.in[:4]))
+			if n > MaxFragSize+recordOverhead {
+				return fmt.Errorf("record of %d bytes exceeds %d", n, MaxFragSize+recordOverhead)
+			}
+			if len(c.in) >= 4+n {
+				err := c.decode(c.in[:4+n])
+				c.in = append(c.in[:0], c.in[4+n:]...)
+				return err
+			}
+		}
+		var buf [16 * 1024]byte
+		n, err := c.conn.Read(buf[:])
+		c.in = append(c.in, buf[:n]...)
+		if err != nil {
+			if err == io.EOF && len(c.in) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+func (c *Conn) decode(frame []byte) error {
+	plain, flags, err := c.sess.DecodeRecordFlags(frame)
+	if err != nil {
+		return err
+	}
+	if flags&FlagControl != 0 {
+		typ, _, err := ParseControl(plain)
+		if err != nil {
+			return err
+		}
+		if typ == ControlCloseNotify {
+			return io.EOF
+		}
+		return nil // checkpoints are verified by the session
+	}
+	c.rbuf = plain
+	return nil
+}
+
+// Write encrypts b into one or more records.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	if c.writeClosed {
+		return 0, ErrWriteClosed
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > c.recordSize {
+			chunk = chunk[:c.recordSize]
+		}
+		frame, err := c.sess.EncodeRecord(chunk, 0)
+		if err != nil {
+			return written, c.failWrite(err)
+		}
+		if err := c.writeFrame(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, c.checkpointLocked()
+}
+
+// checkpointLocked sends a BSC3 checkpoint if one is due; the caller holds
+// writeMu, so it lands in order with the records it covers.
+func (c *Conn) checkpointLocked() error {
+	if c.writeErr != nil || c.writeClosed {
+		return c.writeErr
+	}
+	frame, err := c.sess.MaybeCheckpoint()
+	if err != nil {
+		return c.failWrite(err)
+	}
+	if frame == nil {
+		return nil
+	}
+	return c.writeFrame(frame)
+}
+
+// writeFrame writes one encoded record; the caller holds writeMu. A failed
+// write may leave part of a record on the wire, after which the peer can no
+// longer find record boundaries, so the error is kept for every later write.
+func (c *Conn) writeFrame(frame []byte) error {
+	if _, err := c.conn.Write(frame); err != nil {
+		return c.failWrite(err)
+	}
+	return nil
+}
+
+// failWrite records err as the sticky write error and returns it.
+func (c *Conn) failWrite(err error) error {
+	c.writeErr = err
+	return err
+}
+
+// checkpointLoop checkpoints an idle connection every interval until Close.
+func (c *Conn) checkpointLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.writeMu.Lock()
+			err := c.checkpointLocked()
+			c.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// CloseWrite sends an authenticated close-notify so the peer's Read returns
+// io.EOF, then half-closes the underlying connection if it supports it
+// (e.g. *net.TCPConn). Reading continues to work.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	frame, err := c.sess.EncodeControl(ControlCloseNotify, nil)
+	if err != nil {
+		return c.failWrite(err)
+	}
+	if err := c.writeFrame(frame); err != nil {
+		return err
+	}
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+var _ net.Conn = (*Conn)(nil)
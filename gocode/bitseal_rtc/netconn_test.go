@@ -0,0 +1,178 @@
+package rtc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func connPair(t *testing.T, a, b net.Conn) (*Conn, *Conn) {
+	t.Helper()
+	return connPairWithConfig(t, a, b, &ConnConfig{RecordSize: 1000}, nil)
+}
+
+func connPairWithConfig(t *testing.T, a, b net.Conn, clientCfg, serverCfg *ConnConfig) (*Conn, *Conn) {
+	t.Helper()
+	privC, privS := mustPriv(0x01), mustPriv(0x02)
+	type result struct {
+		c   *Conn
+		err error
+	}
+	srv := make(chan result, 1)
+	go func() {
+		c, err := Server(b, privS, nil, serverCfg)
+		srv <- result{c, err}
+	}()
+	client, err := Client(a, privC, privS.PubKey(), clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-srv
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !r.c.PeerPub().IsEqual(privC.PubKey()) {
+		t.Fatal("server saw the wrong client")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		r.c.Close()
+	})
+	return client, r.c
+}
+
+func TestConnPipe(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := connPair(t, a, b)
+
+	msg := make([]byte, 10_000) // spans several 1000-byte records
+	_, _ = rand.Read(msg)
+	go func() {
+		_, _ = client.Write(msg)
+		_ = client.CloseWrite()
+	}()
+
+	// read in small pieces that do not line up with records
+	var got bytes.Buffer
+	buf := make([]byte, 333)
+	for {
+		n, err := server.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got.Bytes(), msg) {
+		t.Fatal("mismatch")
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, ErrWriteClosed) {
+		t.Fatalf("write after CloseWrite: %v", err)
+	}
+
+	// the other direction still works after the half-close
+	go func() { _, _ = server.Write([]byte("reply")) }()
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("reply: %q %v", reply, err)
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := connPair(t, a, b)
+
+	_ = server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	// the connection survives a read timeout
+	_ = server.SetReadDeadline(time.Time{})
+	go func() { _, _ = client.Write([]byte("late")) }()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "late" {
+		t.Fatalf("after timeout: %q %v", buf, err)
+	}
+}
+
+func TestConnWriteErrorSticky(t *testing.T) {
+	a, b := net.Pipe()
+	client, _ := connPair(t, a, b)
+
+	// Nobody reads, so the record write times out, possibly part-way through.
+	_ = client.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := client.Write([]byte("stalled")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	// Clearing the deadline does not resume a stream that may be desynced.
+	_ = client.SetWriteDeadline(time.Time{})
+	if _, err := client.Write([]byte("again")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("second Write: %v", err)
+	}
+	if err := client.CloseWrite(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+}
+
+// TestConnTCP runs the tunnel over loopback TCP, where CloseWrite also
+// half-closes the socket.
+func TestConnTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback TCP:", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := connPair(t, a, <-accepted)
+
+	go func() {
+		_, _ = client.Write([]byte("over tcp"))
+		_ = client.CloseWrite()
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "over tcp" {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
+
+// TestConnIdleCheckpoint checks that the interval trigger fires on an idle
+// connection, not only on the next Write.
+func TestConnIdleCheckpoint(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := connPairWithConfig(t, a, b,
+		&ConnConfig{Handshake: HandshakeConfig{Session: SessionConfig{Checkpoints: &CheckpointConfig{Interval: 20 * time.Millisecond}}}},
+		&ConnConfig{Handshake: HandshakeConfig{Session: SessionConfig{Checkpoints: &CheckpointConfig{}}}})
+
+	go func() { _, _ = client.Write([]byte("x")) }()
+	go func() { _, _ = io.Copy(io.Discard, server) }() // processes the checkpoint record
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		bundle, err := server.Session().ExportAudit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bundle.Remote.Checkpoints) == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no checkpoint on idle connection: %+v", bundle.Remote.Checkpoints)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,365 @@
+// Package pion runs BitSeal-RTC over a Pion WebRTC DataChannel.
+//
+// Handshake exchanges the BSH1 messages over the channel (as a text message
+// {"handshake_raw": hex, "handshake_sig": hex}) and returns a Conn whose
+// Write/Read carry whole messages, encrypted as BST2 records and fragmented
+// with Profile L like the TypeScript adapter. With Config.Session.Checkpoints
+// set, the Conn also sends BSC3 checkpoints after writes and every
+// CheckpointConfig.Interval.
+package pion
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	"github.com/pion/webrtc/v3"
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	"go.uber.org/zap"
+)
+
+// DefaultHandshakeTimeout bounds Handshake when Config.HandshakeTimeout is zero.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// maxEarlyRecords caps records queued before the session exists. It does not
+// exceed the capacity of Conn.msgs, so replaying the queue never blocks.
+const maxEarlyRecords = 64
+
+// ErrClosed is returned by Read and Write once the channel is closed.
+var ErrClosed = errors.New("bitseal datachannel closed")
+
+// Config tunes Handshake. The zero value uses the defaults of the rtc package.
+type Config struct {
+	// Session is passed to rtc.NewSessionWithConfig; both peers must agree
+	// on Session.KeySchedule.
+	Session rtc.SessionConfig
+	// Frag is advertised in the handshake; each side uses the smaller value
+	// (rtc.NegotiateFrag). Zero fields mean the defaults.
+	Frag rtc.FragOptions
+	// HandshakeTimeout; zero means DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// Logger is optional; nil stays silent.
+	Logger *zap.Logger
+}
+
+type handshakeEnvelope struct {
+	Raw string `json:"handshake_raw"`
+	Sig string `json:"handshake_sig"`
+}
+
+// Conn is a BitSeal-RTC session on a DataChannel. Write may be called
+// concurrently; Read must be used from a single goroutine.
+type Conn struct {
+	dc       *webrtc.DataChannel
+	selfPriv *ec.PrivateKey
+	peerPub  *ec.PublicKey
+	cfg      Config
+	logger   *zap.Logger
+
+	sess  *rtc.Session
+	frag  *rtc.Fragmenter
+	reasm *rtc.Reassembler
+	opts  rtc.FragOptions
+
+	opened    chan struct{}
+	openOnce  sync.Once
+	peerHello chan handshakeEnvelope
+
+	mu sync.Mutex // guards sess, frag, reasm and opts
+
+	// Records may follow the peer's handshake before ours is verified, so
+	// they are queued until the session exists. recvMu serialises onMessage
+	// with the replay of that queue: records reach the reassembler one at a
+	// time and in arrival order.
+	recvMu sync.Mutex
+	early  [][]byte
+	ready  bool
+	failed bool // Handshake failed; records are dropped
+
+	sendMu sync.Mutex
+	msgs   chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Attach takes over dc's OnOpen, OnMessage and OnClose handlers and returns
+// a Conn that still needs Handshake. It does not block, so it can be called
+// from PeerConnection.OnDataChannel, before Pion starts delivering messages.
+func Attach(dc *webrtc.DataChannel, selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, cfg Config) *Conn {
+	c := &Conn{
+		dc:        dc,
+		selfPriv:  selfPriv,
+		peerPub:   peerPub,
+		cfg:       cfg,
+		logger:    cfg.Logger,
+		opened:    make(chan struct{}),
+		peerHello: make(chan handshakeEnvelope, 1),
+		msgs:      make(chan []byte, 64),
+		done:      make(chan struct{}),
+	}
+	dc.OnOpen(c.markOpen)
+	if dc.ReadyState() == webrtc.DataChannelStateOpen {
+		c.markOpen()
+	}
+	dc.OnMessage(c.onMessage)
+	dc.OnClose(c.shutdown)
+	return c
+}
+
+// Handshake is Attach followed by Conn.Handshake.
+func Handshake(dc *webrtc.DataChannel, selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, cfg Config) (*Conn, error) {
+	c := Attach(dc, selfPriv, peerPub, cfg)
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Handshake waits for the channel to open, runs BSH1 with the peer identified
+// by peerPub and sets up the session. It must be called once.
+func (c *Conn) Handshake() (err error) {
+	defer func() {
+		if err != nil {
+			c.recvMu.Lock()
+			c.early, c.failed = nil, true
+			c.recvMu.Unlock()
+		}
+	}()
+	timeout := c.cfg.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.opened:
+	case <-c.done:
+		return ErrClosed
+	case <-timer.C:
+		return errors.New("datachannel did not open before handshake timeout")
+	}
+
+	raw, sig, selfSalt, err := rtc.BuildHandshakeWithFrag(c.selfPriv, c.peerPub, c.cfg.Frag)
+	if err != nil {
+		return err
+	}
+	hello, _ := json.Marshal(handshakeEnvelope{Raw: hex.EncodeToString(raw), Sig: hex.EncodeToString(sig)})
+	if err := c.dc.SendText(string(hello)); err != nil {
+		return err
+	}
+
+	var env handshakeEnvelope
+	select {
+	case env = <-c.peerHello:
+	case <-c.done:
+		return ErrClosed
+	case <-timer.C:
+		return errors.New("no handshake from peer before timeout")
+	}
+	peerRaw, err := hex.DecodeString(env.Raw)
+	if err != nil {
+		return fmt.Errorf("peer handshake: %w", err)
+	}
+	peerSig, err := hex.DecodeString(env.Sig)
+	if err != nil {
+		return fmt.Errorf("peer handshake: %w", err)
+	}
+	msg, gotPub, peerSalt, err := rtc.VerifyHandshakeMsg(peerRaw, peerSig, c.selfPriv)
+	if err != nil {
+		return fmt.Errorf("peer handshake: %w", err)
+	}
+	if !bytes.Equal(gotPub.Compressed(), c.peerPub.Compressed()) {
+		return errors.New("peer handshake: unexpected public key")
+	}
+
+	opts, err := rtc.NegotiateFrag(c.cfg.Frag, msg.Frag())
+	if err != nil {
+		return err
+	}
+	sess, err := rtc.NewSessionWithConfig(c.selfPriv, c.peerPub, selfSalt, peerSalt, c.cfg.Session, c.logger)
+	if err != nil {
+		return err
+	}
+	frag, err := rtc.NewFragmenterWithOptions(sess, opts)
+	if err != nil {
+		return err
+	}
+	reasm, err := rtc.NewReassemblerWithConfig(sess, rtc.ReassemblerConfig{Frag: opts})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.sess, c.frag, c.reasm, c.opts = sess, frag, reasm, opts
+	c.mu.Unlock()
+	c.recvMu.Lock()
+	for _, frame := range c.early {
+		c.handleFrame(frame)
+	}
+	c.early, c.ready = nil, true
+	c.recvMu.Unlock()
+	if interval := sess.CheckpointInterval(); interval > 0 {
+		go c.checkpointLoop(sess, interval)
+	}
+	if c.logger != nil {
+		c.logger.Debug("bitseal datachannel ready", zap.String("label", c.dc.Label()), zap.Int("frag_size", opts.FragSize))
+	}
+	return nil
+}
+
+func (c *Conn) markOpen() {
+	c.openOnce.Do(func() { close(c.opened) })
+}
+
+func (c *Conn) onMessage(msg webrtc.DataChannelMessage) {
+	if msg.IsString {
+		var env handshakeEnvelope
+		if err := json.Unmarshal(msg.Data, &env); err == nil {
+			select {
+			case c.peerHello <- env:
+			default:
+			}
+		}
+		return
+	}
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	switch {
+	case c.ready:
+		c.handleFrame(msg.Data)
+	case c.failed:
+	case len(c.early) < maxEarlyRecords:
+		c.early = append(c.early, msg.Data)
+	default:
+		if c.logger != nil {
+			c.logger.Warn("bitseal datachannel: dropped record before handshake completed")
+		}
+	}
+}
+
+// handleFrame feeds one record to the reassembler and queues complete
+// messages; the caller holds recvMu. It runs on Pion's read goroutine, so a
+// full queue pushes back on the channel.
+func (c *Conn) handleFrame(frame []byte) {
+	plain, ok, err := c.reasm.Push(frame)
+	if err != nil {
+		if c.logger != nil {
+			c.logger.Warn("bitseal datachannel: dropped record", zap.Error(err))
+		}
+		return
+	}
+	if !ok {
+		return
+	}
+	select {
+	case c.msgs <- plain:
+	case <-c.done:
+	}
+}
+
+// Session returns the underlying BST2 session, or nil before Handshake.
+func (c *Conn) Session() *rtc.Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sess
+}
+
+// Frag returns the fragment options negotiated with the peer.
+func (c *Conn) Frag() rtc.FragOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opts
+}
+
+// Write encrypts and sends one message, fragmenting it as needed. Like
+// rtc.Fragmenter, it sends nothing for an empty message.
+func (c *Conn) Write(plain []byte) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	sess, frag := c.sess, c.frag
+	c.mu.Unlock()
+	if frag == nil {
+		return errors.New("bitseal datachannel: handshake not complete")
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	frames, err := frag.Encode(plain)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err := c.dc.Send(frame); err != nil {
+			return err
+		}
+	}
+	return c.checkpointLocked(sess)
+}
+
+// checkpointLocked sends a BSC3 checkpoint if one is due; the caller holds
+// sendMu, so it follows the records it covers.
+func (c *Conn) checkpointLocked(sess *rtc.Session) error {
+	frame, err := sess.MaybeCheckpoint()
+	if err != nil || frame == nil {
+		return err
+	}
+	return c.dc.Send(frame)
+}
+
+// checkpointLoop checkpoints an idle channel every interval until it closes.
+func (c *Conn) checkpointLoop(sess *rtc.Session, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.sendMu.Lock()
+			err := c.checkpointLocked(sess)
+			c.sendMu.Unlock()
+			if err != nil {
+				if c.logger != nil {
+					c.logger.Warn("bitseal datachannel: checkpoint failed", zap.Error(err))
+				}
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Read blocks until the next complete message arrives (waiting for the
+// handshake if needed). It returns io.EOF
+// once the channel has closed and all received messages have been read.
+func (c *Conn) Read() ([]byte, error) {
+	select {
+	case msg := <-c.msgs:
+		return msg, nil
+	case <-c.done:
+		select {
+		case msg := <-c.msgs:
+			return msg, nil
+		default:
+			return nil, io.EOF
+		}
+	}
+}
+
+// Close closes the DataChannel.
+func (c *Conn) Close() error {
+	c.shutdown()
+	return c.dc.Close()
+}
+
+func (c *Conn) shutdown() {
+	c.once.Do(func() { close(c.done) })
+}
@@ -0,0 +1,185 @@
+package pion
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	"github.com/pion/webrtc/v3"
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+)
+
+func mustPriv(b byte) *ec.PrivateKey {
+	buf := make([]byte, 32)
+	buf[31] = b
+	priv, _ := ec.PrivateKeyFromBytes(buf)
+	return priv
+}
+
+// connectedPair creates two in-process PeerConnections that reach each other
+// over loopback host candidates only (no STUN). The offerer's DataChannel is
+// returned as is; the answerer's is attached in OnDataChannel so no message
+// is delivered before the handlers are in place.
+func connectedPair(t *testing.T, attachB func(dc *webrtc.DataChannel) *Conn) (*webrtc.DataChannel, *Conn) {
+	t.Helper()
+	var se webrtc.SettingEngine
+	se.SetIncludeLoopbackCandidate(true)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+
+	offerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = offerer.Close()
+		_ = answerer.Close()
+	})
+
+	dcA, err := offerer.CreateDataChannel("bitseal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotB := make(chan *Conn, 1)
+	answerer.OnDataChannel(func(dc *webrtc.DataChannel) { gotB <- attachB(dc) })
+
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case connB := <-gotB:
+		return dcA, connB
+	case <-time.After(10 * time.Second):
+		t.Fatal("datachannel not announced")
+		return nil, nil
+	}
+}
+
+func TestDataChannelRoundtrip(t *testing.T) {
+	privA, privB := mustPriv(0x01), mustPriv(0x02)
+	dcA, connB := connectedPair(t, func(dc *webrtc.DataChannel) *Conn {
+		return Attach(dc, privB, privA.PubKey(), Config{Frag: rtc.FragOptions{FragSize: 8 * 1024}})
+	})
+	errB := make(chan error, 1)
+	go func() { errB <- connB.Handshake() }()
+	connA, err := Handshake(dcA, privA, privB.PubKey(), Config{})
+	if err != nil {
+		t.Fatalf("handshake A: %v", err)
+	}
+	defer connA.Close()
+	if err := <-errB; err != nil {
+		t.Fatalf("handshake B: %v", err)
+	}
+	defer connB.Close()
+
+	if connA.Frag() != connB.Frag() || connA.Frag().FragSize != 8*1024 {
+		t.Fatalf("frag options disagree: %+v vs %+v", connA.Frag(), connB.Frag())
+	}
+
+	big := make([]byte, 300*1024)
+	_, _ = rand.Read(big)
+	for _, msg := range [][]byte{[]byte("hello"), big} {
+		if err := connA.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := connB.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("A->B mismatch (%d bytes)", len(msg))
+		}
+	}
+	if err := connB.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := connA.Read(); err != nil || string(got) != "pong" {
+		t.Fatalf("B->A: %q %v", got, err)
+	}
+}
+
+func TestHandshakeWrongPeer(t *testing.T) {
+	privA, privB := mustPriv(0x01), mustPriv(0x02)
+	dcA, connB := connectedPair(t, func(dc *webrtc.DataChannel) *Conn {
+		return Attach(dc, privB, privA.PubKey(), Config{HandshakeTimeout: 5 * time.Second})
+	})
+	go func() { _ = connB.Handshake() }()
+	// A expects a different peer key; B's handshake is addressed to A but
+	// signed by the wrong identity from A's point of view.
+	if _, err := Handshake(dcA, privA, mustPriv(0x03).PubKey(), Config{HandshakeTimeout: 5 * time.Second}); err == nil {
+		t.Fatal("handshake with unexpected peer succeeded")
+	}
+}
+
+func TestDataChannelCheckpoints(t *testing.T) {
+	privA, privB := mustPriv(0x01), mustPriv(0x02)
+	cfgB := Config{Session: rtc.SessionConfig{Checkpoints: &rtc.CheckpointConfig{}}}
+	dcA, connB := connectedPair(t, func(dc *webrtc.DataChannel) *Conn {
+		return Attach(dc, privB, privA.PubKey(), cfgB)
+	})
+	errB := make(chan error, 1)
+	go func() { errB <- connB.Handshake() }()
+	cfgA := Config{Session: rtc.SessionConfig{Checkpoints: &rtc.CheckpointConfig{Records: 2, Interval: 50 * time.Millisecond}}}
+	connA, err := Handshake(dcA, privA, privB.PubKey(), cfgA)
+	if err != nil {
+		t.Fatalf("handshake A: %v", err)
+	}
+	defer connA.Close()
+	if err := <-errB; err != nil {
+		t.Fatalf("handshake B: %v", err)
+	}
+	defer connB.Close()
+
+	// Two records trigger a checkpoint from Write; the ticker adds one for
+	// the trailing record once the channel goes idle.
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := connA.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := connB.Read(); err != nil || string(got) != msg {
+			t.Fatalf("read %q, %v", got, err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bundle, err := connB.Session().ExportAudit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bundle.Remote.Checkpoints) == 2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("verified %d checkpoints, want 2", len(bundle.Remote.Checkpoints))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -7,14 +7,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sync"
 	"time"
 
-	"bytes"
-
 	"github.com/bsv-blockchain/go-sdk/message"
 	aesgcm "github.com/bsv-blockchain/go-sdk/primitives/aesgcm"
 	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
-	crypto "github.com/bsv-blockchain/go-sdk/primitives/hash"
 	"go.uber.org/zap"
 )
 
@@ -24,15 +23,58 @@ const (
 	tagSize     = 16
 )
 
+// ErrSeqExhausted is returned once the send seq would wrap around 2^64.
+// The nonce salt||seq must never repeat, so the session has to be replaced
+// by a new handshake (RTC spec §3.1, §4).
+var ErrSeqExhausted = errors.New("send sequence exhausted, re-handshake required")
+
+// BST2 record flags. The flags byte is part of the AEAD associated data, so
+// flag bits cannot be altered in transit.
+const (
+	FlagUnreliable byte = 0x01 // bit0: record travels over an unreliable channel
+	FlagControl    byte = 0x02 // bit1: plaintext is a control message (see ControlType)
+	FlagFragment   byte = 0x08 // bit3: plaintext is a fragment (see Fragmenter.RecordFlags)
+)
+
 type HandshakeMsg struct {
 	Proto string `json:"proto"`
 	PK    string `json:"pk"`   // compressed hex
 	Salt  string `json:"salt"` // 4 bytes hex
 	Ts    int64  `json:"ts"`
+
+	// Optional fragmentation advertisement; absent means the defaults.
+	FragSize int `json:"frag_size,omitempty"`
+	MaxFrags int `json:"max_frags,omitempty"`
+
+	// Set by Handshaker only: a fresh 128-bit nonce, and on the responder's
+	// message the SHA-256 of the initiator's message it answers.
+	Nonce string `json:"nonce,omitempty"`
+	Bind  string `json:"bind,omitempty"`
+}
+
+// Frag returns the fragment options advertised by the message.
+func (m *HandshakeMsg) Frag() FragOptions {
+	return FragOptions{FragSize: m.FragSize, MaxFrags: m.MaxFrags}
 }
 
 // BuildHandshake creates and signs a handshake payload.
 func BuildHandshake(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey) ([]byte, []byte, []byte, error) {
+	return BuildHandshakeWithFrag(selfPriv, peerPub, FragOptions{})
+}
+
+// BuildHandshakeWithFrag is BuildHandshake that also advertises the local
+// fragment options. Zero fields are left out, so FragOptions{} produces the
+// same canonical message as BuildHandshake.
+func BuildHandshakeWithFrag(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, frag FragOptions) ([]byte, []byte, []byte, error) {
+	return buildHandshake(selfPriv, peerPub, frag, "", "")
+}
+
+// buildHandshake emits the canonical message: proto, pk, salt, ts, then the
+// optional frag_size, max_frags, nonce and bind fields in that order.
+func buildHandshake(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, frag FragOptions, nonce, bind string) ([]byte, []byte, []byte, error) {
+	if _, err := frag.WithDefaults(); err != nil {
+		return nil, nil, nil, err
+	}
 	// 4-byte salt
 	salt := make([]byte, 4)
 	if _, err := rand.Read(salt); err != nil {
@@ -42,8 +84,20 @@ func BuildHandshake(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey) ([]byte, []b
 	pkHex := hex.EncodeToString(selfPriv.PubKey().Compressed())
 	saltHex := hex.EncodeToString(salt)
 	// Canonical JSON with deterministic field order
-	rawStr := fmt.Sprintf("{\"proto\":\"%s\",\"pk\":\"%s\",\"salt\":\"%s\",\"ts\":%d}", protoString, pkHex, saltHex, ts)
-	raw := []byte(rawStr)
+	rawStr := fmt.Sprintf("{\"proto\":\"%s\",\"pk\":\"%s\",\"salt\":\"%s\",\"ts\":%d", protoString, pkHex, saltHex, ts)
+	if frag.FragSize != 0 {
+		rawStr += fmt.Sprintf(",\"frag_size\":%d", frag.FragSize)
+	}
+	if frag.MaxFrags != 0 {
+		rawStr += fmt.Sprintf(",\"max_frags\":%d", frag.MaxFrags)
+	}
+	if nonce != "" {
+		rawStr += fmt.Sprintf(",\"nonce\":\"%s\"", nonce)
+	}
+	if bind != "" {
+		rawStr += fmt.Sprintf(",\"bind\":\"%s\"", bind)
+	}
+	raw := []byte(rawStr + "}")
 	// Sign raw bytes directly per BRC-77
 	// (digesting is done internally in the signing algorithm if required)
 	// Keep consistent with TypeScript implementation which signs raw.
@@ -57,67 +111,107 @@ func BuildHandshake(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey) ([]byte, []b
 
 // VerifyHandshake verifies peer handshake and returns peer pubkey & salt.
 func VerifyHandshake(raw, sig []byte, selfPriv *ec.PrivateKey) (*ec.PublicKey, []byte, error) {
+	_, peerPub, salt, err := VerifyHandshakeMsg(raw, sig, selfPriv)
+	return peerPub, salt, err
+}
+
+// VerifyHandshakeMsg is VerifyHandshake that also returns the parsed message,
+// e.g. to read the peer's fragment advertisement.
+func VerifyHandshakeMsg(raw, sig []byte, selfPriv *ec.PrivateKey) (*HandshakeMsg, *ec.PublicKey, []byte, error) {
 	// parse
 	var msg HandshakeMsg
 	if err := json.Unmarshal(raw, &msg); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	if msg.Proto != protoString {
-		return nil, nil, errors.New("protocol mismatch")
+		return nil, nil, nil, errors.New("protocol mismatch")
 	}
 	peerPubBytes, err := hex.DecodeString(msg.PK)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	peerPub, err := ec.ParsePubKey(peerPubBytes)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	if len(sig) < minBRC77SigLen {
+		return nil, nil, nil, errors.New("signature too short")
 	}
 	ok, err := message.Verify(raw, sig, selfPriv)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	if !ok {
-		return nil, nil, errors.New("signature invalid")
+		return nil, nil, nil, errors.New("signature invalid")
 	}
 	saltBytes, err := hex.DecodeString(msg.Salt)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	if _, err := msg.Frag().WithDefaults(); err != nil {
+		return nil, nil, nil, err
 	}
-	return peerPub, saltBytes, nil
+	return &msg, peerPub, saltBytes, nil
 }
 
 // Session represents an established BST2 session.
 type Session struct {
-	key        []byte // 32-byte AES key
-	saltSend   []byte // 4 bytes – 用于本端发送
-	saltRecv   []byte // 4 bytes – 用于解密对端数据
-	seq        uint64 // send seq
-	recvWindow *window
-	peerPub    *ec.PublicKey // remote party's public key
+	sendKey     []byte // 32-byte AES key for outbound records
+	recvKey     []byte // 32-byte AES key for inbound records
+	exporter    []byte // exporter secret; nil for KeyScheduleLegacy
+	keySchedule KeySchedule
+	saltSend    []byte // 4 bytes – 用于本端发送
+	saltRecv    []byte // 4 bytes – 用于解密对端数据
+	seq         uint64 // send seq
+	recvWindow  *window
+	peerPub     *ec.PublicKey // remote party's public key
+	selfPriv    *ec.PrivateKey
+	cp          *checkpointState // nil unless BSC3 is enabled
 	// no cipher.AEAD, use aesgcm helpers
-}
 
-type window struct {
-	size   uint64
-	maxSeq uint64
-	bitmap uint64 // supports up to 64
+	sendMu sync.Mutex // guards seq and the send side of cp
+	recvMu sync.Mutex // guards recvWindow and the receive side of cp
 }
 
-// deriveKey derives 32-byte session key from shared secret + salts.
-func deriveKey(shared, saltA, saltB []byte) []byte {
-	// 为保证两端顺序一致，按字典序拼接 saltA、saltB。
-	if bytes.Compare(saltA, saltB) > 0 {
-		saltA, saltB = saltB, saltA
-	}
-	data := append(shared, saltA...)
-	data = append(data, saltB...)
-	return crypto.Sha256(data)
+// SessionConfig tunes a Session. The zero value reproduces NewSession.
+type SessionConfig struct {
+	// KeySchedule selects the key derivation; zero means KeyScheduleLegacy.
+	// Both peers must use the same value.
+	KeySchedule KeySchedule
+
+	// WindowSize is the replay window in records: a power of two between
+	// DefaultWindowSize and MaxWindowSize. Zero means DefaultWindowSize.
+	// Only the receiver uses it, so peers may pick different sizes.
+	WindowSize int
+
+	// Checkpoints enables BSC3 transcript tracking and signed checkpoints.
+	// Nil disables them; checkpoints received from the peer are then passed
+	// through unverified.
+	Checkpoints *CheckpointConfig
 }
 
 // NewSession creates session after both handshakes exchanged.
+// It uses KeyScheduleLegacy; see NewSessionWithConfig for other options.
 // If logger is nil, the function stays silent.
 func NewSession(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, selfSalt, peerSalt []byte, logger *zap.Logger) (*Session, error) {
+	return NewSessionWithConfig(selfPriv, peerPub, selfSalt, peerSalt, SessionConfig{}, logger)
+}
+
+// NewSessionWithConfig creates a session like NewSession, tuned by cfg.
+func NewSessionWithConfig(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, selfSalt, peerSalt []byte, cfg SessionConfig, logger *zap.Logger) (*Session, error) {
+	return newSession(selfPriv, peerPub, selfSalt, peerSalt, nil, cfg, logger)
+}
+
+// newSession is NewSessionWithConfig with an optional handshake transcript
+// hash mixed into the key schedule.
+func newSession(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, selfSalt, peerSalt, transcript []byte, cfg SessionConfig, logger *zap.Logger) (*Session, error) {
+	if cfg.KeySchedule == 0 {
+		cfg.KeySchedule = KeyScheduleLegacy
+	}
+	recvWindow, err := newWindow(cfg.WindowSize)
+	if err != nil {
+		return nil, err
+	}
 	sharedPoint, err := selfPriv.DeriveSharedSecret(peerPub)
 	if err != nil {
 		return nil, err
@@ -125,11 +219,14 @@ func NewSession(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, selfSalt, peerSa
 	sharedBytes := sharedPoint.Compressed()
 	// DEBUG: 可选日志
 	if logger != nil {
-		logger.Debug("derive input", zap.String("saltA", fmt.Sprintf("%x", selfSalt)), zap.String("saltB", fmt.Sprintf("%x", peerSalt)), zap.String("shared_first16", fmt.Sprintf("%x", sharedBytes[:16])))
+		logger.Debug("derive input", zap.Stringer("schedule", cfg.KeySchedule), zap.String("saltA", fmt.Sprintf("%x", selfSalt)), zap.String("saltB", fmt.Sprintf("%x", peerSalt)), zap.String("shared_first16", fmt.Sprintf("%x", sharedBytes[:16])))
+	}
+	keys, err := deriveSessionKeys(cfg.KeySchedule, sharedBytes, selfPriv.PubKey(), peerPub, selfSalt, peerSalt, transcript)
+	if err != nil {
+		return nil, err
 	}
-	key := deriveKey(sharedBytes, selfSalt, peerSalt)
 	if logger != nil {
-		logger.Debug("derive output", zap.String("key_first16", fmt.Sprintf("%x", key[:16])))
+		logger.Debug("derive output", zap.String("send_key_first16", fmt.Sprintf("%x", keys.send[:16])), zap.String("recv_key_first16", fmt.Sprintf("%x", keys.recv[:16])))
 	}
 
 	// no need to init AESGCM cipher here
@@ -139,29 +236,49 @@ func NewSession(selfPriv *ec.PrivateKey, peerPub *ec.PublicKey, selfSalt, peerSa
 	if _, err := rand.Read(randBytes); err != nil {
 		return nil, err
 	}
-	initSeq := binary.BigEndian.Uint64(randBytes)
+	// The top bit is cleared so every session has at least 2^63 records of
+	// headroom before ErrSeqExhausted.
+	initSeq := binary.BigEndian.Uint64(randBytes) &^ (1 << 63)
 
-	return &Session{
-		key:        key,
-		saltSend:   selfSalt,
-		saltRecv:   peerSalt,
-		seq:        initSeq,
-		recvWindow: &window{size: 64, maxSeq: 0, bitmap: 0},
-		peerPub:    peerPub,
+	sess := &Session{
+		sendKey:     keys.send,
+		recvKey:     keys.recv,
+		exporter:    keys.exporter,
+		keySchedule: cfg.KeySchedule,
+		saltSend:    selfSalt,
+		saltRecv:    peerSalt,
+		seq:         initSeq,
+		recvWindow:  recvWindow,
+		peerPub:     peerPub,
+		selfPriv:    selfPriv,
 		// aead field removed
-	}, nil
+	}
+	if cfg.Checkpoints != nil {
+		sess.cp = newCheckpointState(*cfg.Checkpoints, selfPriv.PubKey(), selfSalt, peerPub, peerSalt)
+	}
+	return sess, nil
 }
 
 // EncodeRecord encrypts plaintext into a BST2 frame.
 func (s *Session) EncodeRecord(plaintext []byte, flags byte) ([]byte, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.encodeRecordLocked(plaintext, flags)
+}
+
+// encodeRecordLocked seals one record; the caller holds sendMu.
+func (s *Session) encodeRecordLocked(plaintext []byte, flags byte) ([]byte, error) {
+	if s.seq == math.MaxUint64 {
+		return nil, ErrSeqExhausted
+	}
 	s.seq++
 	seqBytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(seqBytes, s.seq)
-	nonce := append(s.saltSend, seqBytes...)
+	nonce := makeNonce(s.saltSend, seqBytes)
 	ad := append([]byte{flags}, seqBytes...)
 
 	// Use optimized sdk implementation that returns ciphertext and tag separately.
-	cipherTextOnly, tag, err := aesgcm.AESGCMEncrypt(plaintext, s.key, nonce, ad)
+	cipherTextOnly, tag, err := aesgcm.AESGCMEncrypt(plaintext, s.sendKey, nonce, ad)
 	if err != nil {
 		return nil, err
 	}
@@ -173,62 +290,83 @@ func (s *Session) EncodeRecord(plaintext []byte, flags byte) ([]byte, error) {
 	copy(buf[5:13], seqBytes)
 	copy(buf[13:13+len(cipherTextOnly)], cipherTextOnly)
 	copy(buf[13+len(cipherTextOnly):], tag)
+	if s.cp != nil {
+		s.cp.sent(buf)
+	}
 	return buf, nil
 }
 
 // DecodeRecord decrypts frame and returns plaintext.
 func (s *Session) DecodeRecord(frame []byte) ([]byte, error) {
+	plain, _, err := s.DecodeRecordFlags(frame)
+	return plain, err
+}
+
+// DecodeRecordFlags decrypts frame and returns plaintext together with the
+// record flags. Records carrying FlagControl are handled by the session where
+// it understands them (e.g. BSC3 checkpoints are verified here) and are still
+// returned so transports can skip or act on them.
+func (s *Session) DecodeRecordFlags(frame []byte) ([]byte, byte, error) {
 	if len(frame) < 4+1+8+tagSize {
-		return nil, errors.New("frame too short")
+		return nil, 0, errors.New("frame too short")
 	}
 	length := binary.BigEndian.Uint32(frame[:4])
 	if int(length) != len(frame[4:]) {
-		return nil, fmt.Errorf("length mismatch: %d vs %d", length, len(frame[4:]))
+		return nil, 0, fmt.Errorf("length mismatch: %d vs %d", length, len(frame[4:]))
 	}
 	flags := frame[4]
 	seq := binary.BigEndian.Uint64(frame[5:13])
+
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
 	// replay window check
-	if !s.recvWindow.accept(seq) {
-		return nil, errors.New("replay or old packet")
+	if !s.recvWindow.check(seq) {
+		return nil, 0, errors.New("replay or old packet")
 	}
 	cipherTextOnly := frame[13 : len(frame)-tagSize]
 	tag := frame[len(frame)-tagSize:]
-	seqBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(seqBytes, seq)
-	nonce := append(s.saltRecv, seqBytes...)
+	seqBytes := frame[5:13]
+	nonce := makeNonce(s.saltRecv, seqBytes)
 	ad := append([]byte{flags}, seqBytes...)
 
-	plain, err := aesgcm.AESGCMDecrypt(cipherTextOnly, s.key, nonce, ad, tag)
+	plain, err := aesgcm.AESGCMDecrypt(cipherTextOnly, s.recvKey, nonce, ad, tag)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return plain, nil
-}
-
-func (w *window) accept(seq uint64) bool {
-	if seq > w.maxSeq {
-		shift := seq - w.maxSeq
-		if shift >= w.size {
-			w.bitmap = 0
-		} else {
-			w.bitmap <<= shift
+	// Only authenticated records may move the window.
+	s.recvWindow.commit(seq)
+	if s.cp != nil && flags&FlagControl != 0 && len(plain) > 0 && ControlType(plain[0]) == ControlCheckpoint {
+		if err := s.verifyCheckpointLocked(plain[1:]); err != nil {
+			return nil, 0, err
 		}
-		w.bitmap |= 1
-		w.maxSeq = seq
-		return true
-	}
-	offset := w.maxSeq - seq
-	if offset >= w.size {
-		return false
 	}
-	if (w.bitmap>>offset)&1 == 1 {
-		return false
+	if s.cp != nil {
+		s.cp.received(frame)
 	}
-	w.bitmap |= (1 << offset)
-	return true
+	return plain, flags, nil
+}
+
+// makeNonce builds salt || seq in a fresh slice so concurrent callers never
+// share the salt's backing array.
+func makeNonce(salt, seqBytes []byte) []byte {
+	nonce := make([]byte, 0, len(salt)+len(seqBytes))
+	nonce = append(nonce, salt...)
+	return append(nonce, seqBytes...)
 }
 
 // PeerPub returns peer's public key.
 func (s *Session) PeerPub() *ec.PublicKey {
 	return s.peerPub
 }
+
+// KeySchedule reports which key schedule the session was derived with.
+func (s *Session) KeySchedule() KeySchedule {
+	return s.keySchedule
+}
+
+// ExportKeyingMaterial derives length bytes of application keying material
+// bound to this session, label and context. Both peers obtain the same bytes.
+// Only sessions using KeyScheduleHKDF support it; others return ErrNoExporter.
+func (s *Session) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	return exportKeyingMaterial(s.exporter, label, context, length)
+}
@@ -0,0 +1,212 @@
+package rtc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streaming fragmentation: messages of unknown or unbounded length sent with
+// constant memory on both ends.
+//
+// A stream is a sequence of Profile L records whose fragment header has
+// bit2 set and replaces fragID/total with a 32-bit fragment index:
+//   0       : flags (bit0 = last fragment, bit2 = stream, bit3 = aborted)
+//   1..3    : msgID (24-bit)
+//   4..7    : index (uint32, starting 0)
+// Each record is sealed and authenticated on its own, so the receiver writes
+// fragments to its io.Writer as soon as they are in order.
+
+const (
+	fragFlagStream = 0x04
+	fragFlagAbort  = 0x08
+
+	// DefaultStreamPending bounds out-of-order fragments a StreamReassembler
+	// holds before giving up (1 MiB with the default FRAG_SIZE).
+	DefaultStreamPending = 64
+
+	// maxStreamIndex is the last fragment index of a stream.
+	maxStreamIndex = 0xFFFFFFFF
+)
+
+// ErrStreamAborted is returned by StreamReassembler.Push when the sender
+// aborted the stream.
+var ErrStreamAborted = errors.New("stream aborted by sender")
+
+// EncodeStream reads r until EOF and emits one sealed stream fragment per
+// FragSize chunk through emit. emit is called synchronously, so a blocking
+// emit applies backpressure to the reader; an error from emit stops the
+// stream. If r fails, an abort fragment is emitted so the receiver does not
+// wait forever. It returns the number of payload bytes sent.
+func (f *Fragmenter) EncodeStream(r io.Reader, emit func(frame []byte) error) (int64, error) {
+	f.nextMsgID = (f.nextMsgID + 1) & 0xFFFFFF
+	msgID := f.nextMsgID
+
+	send := func(index uint32, flags byte, chunk []byte) error {
+		plain := make([]byte, hdrLen+len(chunk))
+		plain[0] = fragFlagStream | flags
+		put24(plain[1:4], msgID)
+		binary.BigEndian.PutUint32(plain[4:8], index)
+		copy(plain[hdrLen:], chunk)
+		frame, err := f.sess.EncodeRecord(plain, f.RecordFlags)
+		if err != nil {
+			return err
+		}
+		return emit(frame)
+	}
+
+	// Read one chunk ahead so the final fragment can carry the last flag.
+	cur := make([]byte, f.opts.FragSize)
+	next := make([]byte, f.opts.FragSize)
+	n, err := io.ReadFull(r, cur)
+	var sent int64
+	var index uint32
+	for {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sent + int64(n), send(index, fragFlagLast, cur[:n])
+		}
+		if err != nil {
+			_ = send(index, fragFlagLast|fragFlagAbort, nil)
+			return sent, err
+		}
+		m, nextErr := io.ReadFull(r, next)
+		if nextErr == io.EOF {
+			return sent + int64(n), send(index, fragFlagLast, cur[:n])
+		}
+		if index == f.maxIndex {
+			// No index is left for the rest of the stream: abort it here so
+			// the receiver does not hold a half-open stream.
+			_ = send(index, fragFlagLast|fragFlagAbort, nil)
+			return sent, errors.New("stream exceeds 2^32 fragments")
+		}
+		if err := send(index, 0, cur[:n]); err != nil {
+			return sent, err
+		}
+		sent += int64(n)
+		index++
+		cur, next = next, cur
+		n, err = m, nextErr
+	}
+}
+
+// StreamReassembler writes one incoming stream to an io.Writer in fragment
+// order. Out-of-order fragments are held up to MaxPending; the writer sees
+// each byte exactly once. It is not safe for concurrent use.
+type StreamReassembler struct {
+	sess     *Session
+	w        io.Writer
+	fragSize int
+
+	// MaxPending caps buffered out-of-order fragments; zero means
+	// DefaultStreamPending.
+	MaxPending int
+
+	msgID   uint32
+	started bool
+	next    uint32
+	lastIdx uint32
+	sawLast bool
+	pending map[uint32][]byte
+	written int64
+	done    bool
+}
+
+// NewStreamReassembler creates a receiver that writes the next stream arriving
+// on sess to w.
+func NewStreamReassembler(sess *Session, w io.Writer) *StreamReassembler {
+	return &StreamReassembler{sess: sess, w: w, fragSize: FRAG_SIZE, pending: make(map[uint32][]byte)}
+}
+
+// NewStreamReassemblerWithOptions is NewStreamReassembler for a link using
+// negotiated fragment options. Only FragSize applies to streams.
+func NewStreamReassemblerWithOptions(sess *Session, w io.Writer, opts FragOptions) (*StreamReassembler, error) {
+	opts, err := opts.WithDefaults()
+	if err != nil {
+		return nil, err
+	}
+	s := NewStreamReassembler(sess, w)
+	s.fragSize = opts.FragSize
+	return s, nil
+}
+
+// Written returns the number of payload bytes written so far.
+func (s *StreamReassembler) Written() int64 {
+	return s.written
+}
+
+// Push decodes one frame of the stream. It returns true once the last
+// fragment has been written. Control records are consumed and return false.
+func (s *StreamReassembler) Push(frame []byte) (bool, error) {
+	if s.done {
+		return true, errors.New("stream already complete")
+	}
+	plain, recFlags, err := s.sess.DecodeRecordFlags(frame)
+	if err != nil {
+		return false, err
+	}
+	if recFlags&FlagControl != 0 {
+		return false, nil
+	}
+	if len(plain) < hdrLen {
+		return false, errors.New("fragment too small")
+	}
+	flags := plain[0]
+	if flags&fragFlagStream == 0 {
+		return false, errors.New("not a stream fragment")
+	}
+	msgID := get24(plain[1:4])
+	index := binary.BigEndian.Uint32(plain[4:8])
+	data := plain[hdrLen:]
+	if len(data) > s.fragSize {
+		return false, fmt.Errorf("fragment larger than %d bytes", s.fragSize)
+	}
+	if !s.started {
+		s.started, s.msgID = true, msgID
+	} else if msgID != s.msgID {
+		return false, fmt.Errorf("fragment of stream %d while receiving %d", msgID, s.msgID)
+	}
+	if flags&fragFlagAbort != 0 {
+		s.done = true
+		return true, ErrStreamAborted
+	}
+	if flags&fragFlagLast != 0 {
+		if s.sawLast && index != s.lastIdx {
+			return false, errors.New("conflicting last fragment")
+		}
+		s.sawLast, s.lastIdx = true, index
+	}
+	if index < s.next || (s.sawLast && index > s.lastIdx) {
+		return false, nil // duplicate or beyond the end
+	}
+	if index > s.next {
+		if _, dup := s.pending[index]; !dup {
+			limit := s.MaxPending
+			if limit <= 0 {
+				limit = DefaultStreamPending
+			}
+			if len(s.pending) >= limit {
+				return false, errors.New("too many out-of-order stream fragments")
+			}
+			s.pending[index] = data
+		}
+		return false, nil
+	}
+
+	for {
+		if _, err := s.w.Write(data); err != nil {
+			return false, err
+		}
+		s.written += int64(len(data))
+		if s.sawLast && s.next == s.lastIdx {
+			s.done = true
+			return true, nil
+		}
+		s.next++
+		var ok bool
+		if data, ok = s.pending[s.next]; !ok {
+			return false, nil
+		}
+		delete(s.pending, s.next)
+	}
+}
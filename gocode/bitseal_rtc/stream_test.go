@@ -0,0 +1,108 @@
+package rtc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// TestStreamRoundtrip pushes a reader through EncodeStream into a
+// StreamReassembler with some reordering, never holding the whole payload
+// as frames.
+func TestStreamRoundtrip(t *testing.T) {
+	for _, size := range []int{0, 1, FRAG_SIZE, 3*FRAG_SIZE + 7, 100 * FRAG_SIZE} {
+		sessA, sessB := sessionPair(t, SessionConfig{}, SessionConfig{})
+
+		src := make([]byte, size)
+		_, _ = rand.Read(src)
+		var out bytes.Buffer
+		recv := NewStreamReassembler(sessB, &out)
+
+		var held []byte // swap every pair of frames
+		done := false
+		emit := func(frame []byte) error {
+			if held == nil {
+				held = frame
+				return nil
+			}
+			for _, f := range [][]byte{frame, held} {
+				ok, err := recv.Push(f)
+				if err != nil {
+					return err
+				}
+				done = done || ok
+			}
+			held = nil
+			return nil
+		}
+		n, err := NewFragmenter(sessA).EncodeStream(bytes.NewReader(src), emit)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if held != nil {
+			ok, err := recv.Push(held)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = done || ok
+		}
+		if !done || n != int64(size) || recv.Written() != int64(size) {
+			t.Fatalf("size %d: done=%v sent=%d written=%d", size, done, n, recv.Written())
+		}
+		if !bytes.Equal(out.Bytes(), src) {
+			t.Fatalf("size %d: stream mismatch", size)
+		}
+	}
+}
+
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("disk on fire")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func TestStreamAbort(t *testing.T) {
+	sessA, sessB := sessionPair(t, SessionConfig{}, SessionConfig{})
+	recv := NewStreamReassembler(sessB, io.Discard)
+
+	var lastErr error
+	_, err := NewFragmenter(sessA).EncodeStream(&failingReader{n: 2*FRAG_SIZE + 5}, func(frame []byte) error {
+		_, lastErr = recv.Push(frame)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("reader error not reported")
+	}
+	if !errors.Is(lastErr, ErrStreamAborted) {
+		t.Fatalf("receiver not told about abort: %v", lastErr)
+	}
+}
+
+// TestStreamIndexExhausted aborts a stream that runs out of fragment indexes
+// instead of leaving the receiver waiting.
+func TestStreamIndexExhausted(t *testing.T) {
+	sessA, sessB := sessionPair(t, SessionConfig{}, SessionConfig{})
+	frag := NewFragmenter(sessA)
+	frag.maxIndex = 2
+	recv := NewStreamReassembler(sessB, io.Discard)
+	var lastErr error
+	_, err := frag.EncodeStream(bytes.NewReader(make([]byte, 5*FRAG_SIZE)), func(frame []byte) error {
+		_, lastErr = recv.Push(frame)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("index exhaustion not reported")
+	}
+	if !errors.Is(lastErr, ErrStreamAborted) {
+		t.Fatalf("receiver not told about abort: %v", lastErr)
+	}
+}
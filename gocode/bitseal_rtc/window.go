@@ -0,0 +1,150 @@
+package rtc
+
+import "fmt"
+
+const (
+	// DefaultWindowSize is the spec default replay window (RTC spec §3.5).
+	DefaultWindowSize = 64
+	// MaxWindowSize bounds SessionConfig.WindowSize.
+	MaxWindowSize = 4096
+)
+
+// window is the receiver's sliding replay window. Size 64 keeps the original
+// single-word bitmap; larger sizes use a ring bitset where bit (seq mod size)
+// tracks seq, so accept stays O(1) amortised: every bit is cleared at most
+// once per window advance.
+//
+// The window is anchored on the first authenticated record rather than on
+// seq 0, because senders start from a random seq_init. Receivers call check
+// before decrypting and commit only once the AEAD tag verified, so forged
+// records can never move the window.
+type window struct {
+	size     uint64
+	maxSeq   uint64
+	anchored bool     // false until the first commit
+	bitmap   uint64   // size == 64
+	ring     []uint64 // size > 64
+}
+
+func newWindow(size int) (*window, error) {
+	if size == 0 {
+		size = DefaultWindowSize
+	}
+	if size < DefaultWindowSize || size > MaxWindowSize || size&(size-1) != 0 {
+		return nil, fmt.Errorf("replay window size %d: must be a power of two in [%d, %d]", size, DefaultWindowSize, MaxWindowSize)
+	}
+	w := &window{size: uint64(size)}
+	if size > 64 {
+		w.ring = make([]uint64, size/64)
+	}
+	return w, nil
+}
+
+// check reports whether seq is new and inside the window without changing
+// any state.
+func (w *window) check(seq uint64) bool {
+	if !w.anchored || seq > w.maxSeq {
+		return true
+	}
+	offset := w.maxSeq - seq
+	if offset >= w.size {
+		return false
+	}
+	if w.ring == nil {
+		return (w.bitmap>>offset)&1 == 0
+	}
+	return !w.test(seq)
+}
+
+// commit marks an authenticated seq as seen; seq must have passed check.
+// The first commit anchors the window on seq. The single-word window used for
+// size 64 is handled here without further calls, as the receive fast path.
+func (w *window) commit(seq uint64) {
+	if w.ring != nil || !w.anchored {
+		w.commitSlow(seq)
+		return
+	}
+	if seq > w.maxSeq {
+		// Shifting a uint64 by 64 or more yields 0, which clears the window.
+		w.bitmap = w.bitmap<<(seq-w.maxSeq) | 1
+		w.maxSeq = seq
+		return
+	}
+	w.bitmap |= 1 << (w.maxSeq - seq)
+}
+
+// commitSlow anchors the window on the first commit, or commits into the
+// ring used for sizes above 64.
+func (w *window) commitSlow(seq uint64) {
+	if !w.anchored {
+		w.anchored = true
+		w.maxSeq = seq
+		w.bitmap = 1
+		if w.ring != nil {
+			w.set(seq)
+		}
+		return
+	}
+	w.acceptRing(seq)
+}
+
+// accept is check followed by commit.
+func (w *window) accept(seq uint64) bool {
+	if !w.check(seq) {
+		return false
+	}
+	w.commit(seq)
+	return true
+}
+
+func (w *window) acceptRing(seq uint64) bool {
+	if seq > w.maxSeq {
+		shift := seq - w.maxSeq
+		if shift >= w.size {
+			clear(w.ring)
+		} else {
+			w.clearRange(w.maxSeq+1, shift)
+		}
+		w.set(seq)
+		w.maxSeq = seq
+		return true
+	}
+	if w.maxSeq-seq >= w.size {
+		return false
+	}
+	if w.test(seq) {
+		return false
+	}
+	w.set(seq)
+	return true
+}
+
+func (w *window) test(seq uint64) bool {
+	idx := seq & (w.size - 1)
+	return w.ring[idx>>6]&(1<<(idx&63)) != 0
+}
+
+func (w *window) set(seq uint64) {
+	idx := seq & (w.size - 1)
+	w.ring[idx>>6] |= 1 << (idx & 63)
+}
+
+// clearRange clears the bits of n consecutive seqs starting at from, a word
+// at a time where possible.
+func (w *window) clearRange(from, n uint64) {
+	for n > 0 {
+		idx := from & (w.size - 1)
+		bit := idx & 63
+		k := 64 - bit
+		if k > n {
+			k = n
+		}
+		mask := ^uint64(0)
+		if k < 64 {
+			mask = (uint64(1)<<k - 1) << bit
+		}
+		w.ring[idx>>6] &^= mask
+		from += k
+		n -= k
+	}
+}
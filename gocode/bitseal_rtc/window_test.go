@@ -0,0 +1,216 @@
+package rtc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// refWindow is a map-based model of the replay window used to cross-check
+// the bitmap and ring implementations.
+type refWindow struct {
+	size   uint64
+	maxSeq uint64
+	seen   map[uint64]bool
+}
+
+func (r *refWindow) accept(seq uint64) bool {
+	if seq > r.maxSeq {
+		r.maxSeq = seq
+		r.seen[seq] = true
+		return true
+	}
+	if r.maxSeq-seq >= r.size || r.seen[seq] {
+		return false
+	}
+	r.seen[seq] = true
+	return true
+}
+
+func TestWindowMatchesModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{64, 128, 1024, 4096} {
+		w, err := newWindow(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := &refWindow{size: uint64(size), seen: map[uint64]bool{}}
+		base := uint64(1000)
+		for i := 0; i < 50000; i++ {
+			// mostly forward with jitter, occasional big jumps and replays
+			var seq uint64
+			switch r := rng.Intn(100); {
+			case r < 2:
+				base += uint64(rng.Intn(3 * size))
+				seq = base
+			case r < 10:
+				seq = base - uint64(rng.Intn(size+10))
+			default:
+				base++
+				seq = base - uint64(rng.Intn(8))
+			}
+			if got, want := w.accept(seq), ref.accept(seq); got != want {
+				t.Fatalf("size %d step %d seq %d: got %v want %v", size, i, seq, got, want)
+			}
+		}
+	}
+}
+
+func TestWindowSizeValidation(t *testing.T) {
+	for _, size := range []int{32, 96, 8192} {
+		if _, err := newWindow(size); err == nil {
+			t.Fatalf("size %d accepted", size)
+		}
+	}
+	priv := mustPriv(0x03)
+	salt := []byte{1, 1, 1, 1}
+	if _, err := NewSessionWithConfig(priv, priv.PubKey(), salt, salt, SessionConfig{WindowSize: 100}, nil); err == nil {
+		t.Fatal("invalid window size accepted by NewSessionWithConfig")
+	}
+}
+
+// TestLargeWindowReorder delivers a frame 200 records late.
+func TestLargeWindowReorder(t *testing.T) {
+	priv := mustPriv(0x03)
+	salt := []byte{1, 1, 1, 1}
+	sess, err := NewSessionWithConfig(priv, priv.PubKey(), salt, salt, SessionConfig{WindowSize: 256}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, _ := sess.EncodeRecord([]byte("late"), 0)
+	for i := 0; i < 200; i++ {
+		frame, _ := sess.EncodeRecord([]byte{byte(i)}, 0)
+		if _, err := sess.DecodeRecord(frame); err != nil {
+			t.Fatalf("decode %d: %v", i, err)
+		}
+	}
+	if _, err := sess.DecodeRecord(late); err != nil {
+		t.Fatalf("late frame rejected: %v", err)
+	}
+	if _, err := sess.DecodeRecord(late); err == nil {
+		t.Fatal("replayed late frame accepted")
+	}
+}
+
+// legacyWindow is the original single-uint64 implementation, kept as the
+// benchmark baseline for the 64 case.
+type legacyWindow struct {
+	size   uint64
+	maxSeq uint64
+	bitmap uint64
+}
+
+func (w *legacyWindow) accept(seq uint64) bool {
+	if seq > w.maxSeq {
+		shift := seq - w.maxSeq
+		if shift >= w.size {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.maxSeq = seq
+		return true
+	}
+	offset := w.maxSeq - seq
+	if offset >= w.size {
+		return false
+	}
+	if (w.bitmap>>offset)&1 == 1 {
+		return false
+	}
+	w.bitmap |= (1 << offset)
+	return true
+}
+
+func benchSeqs() []uint64 {
+	rng := rand.New(rand.NewSource(2))
+	seqs := make([]uint64, 4096)
+	base := uint64(1 << 40)
+	for i := range seqs {
+		base++
+		seqs[i] = base - uint64(rng.Intn(4)) // light reordering
+	}
+	return seqs
+}
+
+func BenchmarkWindowAccept(b *testing.B) {
+	seqs := benchSeqs()
+	b.Run("legacy64", func(b *testing.B) {
+		w := &legacyWindow{size: 64}
+		for i := 0; i < b.N; i++ {
+			w.accept(seqs[i&4095] + uint64(i>>12)<<13)
+		}
+	})
+	for _, size := range []int{64, 128, 1024, 4096} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			w, _ := newWindow(size)
+			for i := 0; i < b.N; i++ {
+				// same check/commit pair as DecodeRecordFlags
+				seq := seqs[i&4095] + uint64(i>>12)<<13
+				if !w.check(seq) {
+					continue
+				}
+				w.commit(seq)
+			}
+		})
+	}
+}
+
+// TestForgedSeqDoesNotAdvance sends a forged record with a far-ahead seq; it
+// must fail authentication without pushing genuine traffic out of the window.
+func TestForgedSeqDoesNotAdvance(t *testing.T) {
+	sessA, sessB := sessionPair(t, SessionConfig{}, SessionConfig{})
+
+	first, _ := sessA.EncodeRecord([]byte("one"), 0)
+	second, _ := sessA.EncodeRecord([]byte("two"), 0)
+	if _, err := sessB.DecodeRecord(first); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := append([]byte(nil), second...)
+	binary.BigEndian.PutUint64(forged[5:13], binary.BigEndian.Uint64(second[5:13])+1000)
+	if _, err := sessB.DecodeRecord(forged); err == nil {
+		t.Fatal("forged record accepted")
+	}
+	if _, err := sessB.DecodeRecord(second); err != nil {
+		t.Fatalf("genuine record rejected after forgery: %v", err)
+	}
+}
+
+// TestWindowAnchorsOnFirstRecord delivers the first records out of order:
+// the window starts at the first authenticated seq, not at zero.
+func TestWindowAnchorsOnFirstRecord(t *testing.T) {
+	priv := mustPriv(0x03)
+	salt := []byte{1, 1, 1, 1}
+	sess, _ := NewSession(priv, priv.PubKey(), salt, salt, nil)
+
+	frames := make([][]byte, 10)
+	for i := range frames {
+		frames[i], _ = sess.EncodeRecord([]byte{byte(i)}, 0)
+	}
+	for _, i := range []int{9, 0, 5, 1} {
+		if _, err := sess.DecodeRecord(frames[i]); err != nil {
+			t.Fatalf("frame %d rejected: %v", i, err)
+		}
+	}
+	if _, err := sess.DecodeRecord(frames[5]); err == nil {
+		t.Fatal("duplicate accepted")
+	}
+}
+
+func TestSeqExhausted(t *testing.T) {
+	priv := mustPriv(0x03)
+	salt := []byte{1, 1, 1, 1}
+	sess, _ := NewSession(priv, priv.PubKey(), salt, salt, nil)
+	sess.seq = math.MaxUint64 - 1
+	if _, err := sess.EncodeRecord([]byte("last"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.EncodeRecord([]byte("wrap"), 0); !errors.Is(err, ErrSeqExhausted) {
+		t.Fatalf("expected ErrSeqExhausted, got %v", err)
+	}
+}
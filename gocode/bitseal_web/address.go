@@ -0,0 +1,63 @@
+package bitseal
+
+import (
+	"bytes"
+	"errors"
+
+	base58 "github.com/bsv-blockchain/go-sdk/compat/base58"
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	crypto "github.com/bsv-blockchain/go-sdk/primitives/hash"
+)
+
+// Network selects the version byte of a P2PKH address.
+type Network byte
+
+const (
+	Mainnet Network = 0x00 // addresses start with "1"
+	Testnet Network = 0x6f // addresses start with "m" or "n"
+)
+
+func (n Network) String() string {
+	switch n {
+	case Mainnet:
+		return "mainnet"
+	case Testnet:
+		return "testnet"
+	}
+	return "unknown"
+}
+
+// ErrInvalidAddress is returned by ParseAddress for malformed addresses.
+var ErrInvalidAddress = errors.New("invalid P2PKH address")
+
+// Address returns the P2PKH address of pub (compressed encoding), the account
+// key of the frictionless account model (§9):
+// Base58Check(version || RIPEMD160(SHA256(pk))).
+func Address(pub *ec.PublicKey, net Network) string {
+	payload := append([]byte{byte(net)}, pub.Hash()...)
+	return base58.Encode(append(payload, crypto.Sha256d(payload)[:4]...))
+}
+
+// ParseAddress validates a P2PKH address, including its checksum, and
+// returns the 20-byte public key hash and the network it belongs to.
+func ParseAddress(addr string) (pkh []byte, net Network, err error) {
+	raw, err := base58.Decode(addr)
+	if err != nil || len(raw) != 25 {
+		return nil, 0, ErrInvalidAddress
+	}
+	net = Network(raw[0])
+	if net != Mainnet && net != Testnet {
+		return nil, 0, ErrInvalidAddress
+	}
+	if !bytes.Equal(crypto.Sha256d(raw[:21])[:4], raw[21:]) {
+		return nil, 0, ErrInvalidAddress
+	}
+	return raw[1:21], net, nil
+}
+
+// AddressMatches reports whether addr is a valid P2PKH address of pub on
+// either network.
+func AddressMatches(addr string, pub *ec.PublicKey) bool {
+	pkh, _, err := ParseAddress(addr)
+	return err == nil && bytes.Equal(pkh, pub.Hash())
+}
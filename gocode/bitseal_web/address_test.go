@@ -0,0 +1,39 @@
+package bitseal
+
+import (
+	"testing"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+)
+
+func TestAddress(t *testing.T) {
+	// Private key 1: the generator point.
+	priv, _ := ec.PrivateKeyFromBytes(append(make([]byte, 31), 1))
+	pub := priv.PubKey()
+	for net, want := range map[Network]string{
+		Mainnet: "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH",
+		Testnet: "mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r",
+	} {
+		addr := Address(pub, net)
+		if addr != want {
+			t.Fatalf("%s address %s, want %s", net, addr, want)
+		}
+		pkh, gotNet, err := ParseAddress(addr)
+		if err != nil || gotNet != net || len(pkh) != 20 {
+			t.Fatalf("parse %s: %x %s %v", addr, pkh, gotNet, err)
+		}
+		if !AddressMatches(addr, pub) {
+			t.Fatalf("%s does not match its key", addr)
+		}
+	}
+
+	other, _ := ec.PrivateKeyFromBytes(append(make([]byte, 31), 2))
+	if AddressMatches(Address(pub, Mainnet), other.PubKey()) {
+		t.Fatal("address matched another key")
+	}
+	for _, bad := range []string{"", "pk:02abc", "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMJ", "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy"} {
+		if _, _, err := ParseAddress(bad); err == nil {
+			t.Fatalf("accepted %q", bad)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package bitsealws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	bsweb "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_web"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+)
+
+// AuthorizeFunc 决定是否接受客户端握手（见 Server.Authorize）。
+// 返回 error 即拒绝：*HandshakeError 可指定 HTTP 状态码与 B 系列错误码，其他 error 按 403 返回。
+// 返回的 claims 会写入 SimpleToken，Upgrade 后可通过 ServerConn.Claims 读取
+// （经过 JSON 往返，数字为 float64）；addr / salt_s / nonce / iat / exp 为保留声明，不可覆盖。
+type AuthorizeFunc func(ctx context.Context, clientPub *ec.PublicKey, r *http.Request) (map[string]any, error)
+
+// reservedClaims 由协议设置，Authorize 返回的同名声明被忽略。
+var reservedClaims = map[string]bool{"addr": true, "salt_s": true, "nonce": true, "iat": true, "exp": true}
+
+// ClaimAddress 读取并校验令牌声明中的 addr（P2PKH 地址，含校验和），
+// 返回地址与所属网络；可用于 ServerConn.Claims 或 BitSealWSConn.Claims。
+func ClaimAddress(claims map[string]any) (string, bsweb.Network, error) {
+	addr, _ := claims["addr"].(string)
+	if addr == "" {
+		return "", 0, errors.New("addr claim missing")
+	}
+	_, net, err := bsweb.ParseAddress(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	return addr, net, nil
+}
+
+// AllowKeys 返回只接受给定公钥的 AuthorizeFunc；其余公钥以 403 / B012 拒绝。
+func AllowKeys(keys ...*ec.PublicKey) AuthorizeFunc {
+	set := keySet(keys)
+	return func(ctx context.Context, clientPub *ec.PublicKey, r *http.Request) (map[string]any, error) {
+		if !set[fmt.Sprintf("%x", clientPub.Compressed())] {
+			return nil, &HandshakeError{Status: http.StatusForbidden, Code: CodeBanned, Message: "key not allowed"}
+		}
+		return nil, nil
+	}
+}
+
+// DenyKeys 返回拒绝给定公钥（403 / B012）、接受其余公钥的 AuthorizeFunc。
+func DenyKeys(keys ...*ec.PublicKey) AuthorizeFunc {
+	set := keySet(keys)
+	return func(ctx context.Context, clientPub *ec.PublicKey, r *http.Request) (map[string]any, error) {
+		if set[fmt.Sprintf("%x", clientPub.Compressed())] {
+			return nil, &HandshakeError{Status: http.StatusForbidden, Code: CodeBanned, Message: "key denied"}
+		}
+		return nil, nil
+	}
+}
+
+// ChainAuthorize 依次执行多个 AuthorizeFunc：任一拒绝即拒绝，
+// 全部通过时合并各自返回的 claims（后者覆盖前者）。
+func ChainAuthorize(fns ...AuthorizeFunc) AuthorizeFunc {
+	return func(ctx context.Context, clientPub *ec.PublicKey, r *http.Request) (map[string]any, error) {
+		var claims map[string]any
+		for _, fn := range fns {
+			c, err := fn(ctx, clientPub, r)
+			if err != nil {
+				return nil, err
+			}
+			if len(c) > 0 && claims == nil {
+				claims = make(map[string]any, len(c))
+			}
+			for k, v := range c {
+				claims[k] = v
+			}
+		}
+		return claims, nil
+	}
+}
+
+func keySet(keys []*ec.PublicKey) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[fmt.Sprintf("%x", k.Compressed())] = true
+	}
+	return set
+}
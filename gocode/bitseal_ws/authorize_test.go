@@ -0,0 +1,106 @@
+package bitsealws_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	bsweb "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_web"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+func TestAuthorizeClaims(t *testing.T) {
+	adminPriv, userPriv, bannedPriv := fixedPriv(0x33), fixedPriv(0x44), fixedPriv(0x66)
+	var server *ws.Server
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.Authorize = ws.ChainAuthorize(
+			ws.DenyKeys(bannedPriv.PubKey()),
+			func(ctx context.Context, clientPub *ec.PublicKey, r *http.Request) (map[string]any, error) {
+				role := "user"
+				if clientPub.IsEqual(adminPriv.PubKey()) {
+					role = "admin"
+				}
+				return map[string]any{"role": role, "nonce": "forged", "addr": "forged"}, nil
+			},
+		)
+		// Echo the role the connection was authorized with.
+		s.OnMessage = func(sess *rtc.Session, plain []byte) ([]byte, error) {
+			role, _ := server.SessionConn(sess).Claims()["role"].(string)
+			return []byte(role), nil
+		}
+	})
+
+	if _, err := ws.ConnectBitSealWS(bannedPriv, serverPriv.PubKey(), wsURL); err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), ws.CodeBanned) {
+		t.Fatalf("denied key: %v", err)
+	}
+	for priv, want := range map[*ec.PrivateKey]string{adminPriv: "admin", userPriv: "user"} {
+		c, err := ws.ConnectBitSealWS(priv, serverPriv.PubKey(), wsURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Claims["role"] != want || c.Claims["nonce"] == "forged" || c.Claims["addr"] == "forged" {
+			t.Fatalf("client claims %v", c.Claims)
+		}
+		if err := c.Write([]byte("role?")); err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := readWithin(c, 5*time.Second); err != nil || string(msg) != want {
+			t.Fatalf("server-side role %q, %v", msg, err)
+		}
+		c.Close()
+	}
+}
+
+func TestAuthorizeAllowKeys(t *testing.T) {
+	allowed := fixedPriv(0x33)
+	_, serverPriv, wsURL := startServer(t, func(s *ws.Server) { s.Authorize = ws.AllowKeys(allowed.PubKey()) })
+	c, err := ws.ConnectBitSealWS(allowed, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := ws.ConnectBitSealWS(fixedPriv(0x44), serverPriv.PubKey(), wsURL); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("key outside allow list: %v", err)
+	}
+}
+
+func TestTokenAddress(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) { s.Network = bsweb.Testnet })
+	clientPriv := fixedPriv(0x33)
+	pub := clientPriv.PubKey()
+	c, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	addr, network, err := ws.ClaimAddress(c.Claims)
+	if err != nil || network != bsweb.Testnet || addr != bsweb.Address(pub, bsweb.Testnet) {
+		t.Fatalf("addr claim %q (%s): %v", addr, network, err)
+	}
+	conn := waitConns(t, server, pub, 1)[0]
+	if conn.Addr() != addr {
+		t.Fatalf("conn addr %q, want %q", conn.Addr(), addr)
+	}
+	// Lookups accept the key's address on either network.
+	for _, a := range []string{addr, bsweb.Address(pub, bsweb.Mainnet)} {
+		if conns := server.ConnsByAddr(a); len(conns) != 1 || conns[0] != conn {
+			t.Fatalf("ConnsByAddr(%s) = %v", a, conns)
+		}
+	}
+	if conns := server.ConnsByAddr(bsweb.Address(fixedPriv(0x44).PubKey(), bsweb.Testnet)); conns != nil {
+		t.Fatal("found connections for an offline address")
+	}
+	c.Close()
+	waitConns(t, server, pub, 0)
+	if conns := server.ConnsByAddr(addr); conns != nil {
+		t.Fatal("address still indexed after disconnect")
+	}
+	if _, _, err := ws.ClaimAddress(map[string]any{"addr": "pk:02ab"}); err == nil {
+		t.Fatal("accepted placeholder addr claim")
+	}
+}
@@ -0,0 +1,60 @@
+package bitsealws
+
+import (
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// BSC3 检查点（BitSeal-RTC §5）：Server.Checkpoints / ConnectOptions.Checkpoints 启用后，
+// 会话记录收发两个方向的转录哈希并验证对端的检查点；只向能识别控制记录的对端
+// （握手中声明了 heartbeat）发出检查点。检查点在每次发送后与每个 Interval 的定时器上检查，
+// 因此空闲连接也会为最后的记录签发检查点。
+
+// checkpointLocked 在检查点到期时将其发出；调用方持有 sendMu，保证检查点紧跟其覆盖的记录。
+func (f *framer) checkpointLocked(ws *websocket.Conn) error {
+	if !f.checkpoints {
+		return nil
+	}
+	frame, err := f.sess.MaybeCheckpoint()
+	if err != nil || frame == nil {
+		return err
+	}
+	return websocket.Message.Send(ws, frame)
+}
+
+// checkpoint 供定时器调用；timeout 大于 0 时设置写超时。
+func (f *framer) checkpoint(ws *websocket.Conn, timeout time.Duration) error {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if timeout > 0 {
+		_ = ws.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return f.checkpointLocked(ws)
+}
+
+// checkpointTicker 返回检查点定时器；未启用检查点或未设置 Interval 时返回 nil。
+func (f *framer) checkpointTicker() *time.Ticker {
+	if !f.checkpoints {
+		return nil
+	}
+	if interval := f.sess.CheckpointInterval(); interval > 0 {
+		return time.NewTicker(interval)
+	}
+	return nil
+}
+
+// checkpointLoop 按 Interval 为空闲连接签发检查点，直到 stop 关闭。
+func (c *BitSealWSConn) checkpointLoop(t *time.Ticker, stop <-chan struct{}) {
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.framing().checkpoint(c.Conn, 0); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
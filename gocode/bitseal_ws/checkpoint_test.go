@@ -0,0 +1,49 @@
+package bitsealws_test
+
+import (
+	"testing"
+	"time"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+func TestCheckpoints(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.OnMessage = nil // echo
+		s.Checkpoints = &rtc.CheckpointConfig{Interval: 20 * time.Millisecond}
+	})
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWSWithOptions(clientPriv, serverPriv.PubKey(), wsURL, ws.ConnectOptions{
+		Checkpoints: &rtc.CheckpointConfig{Records: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := waitConns(t, server, clientPriv.PubKey(), 1)[0]
+
+	if err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readWithin(c, 2*time.Second); err != nil || string(got) != "hello" {
+		t.Fatalf("echo %q, %v", got, err)
+	}
+	// The echo is checkpointed by the server's ticker while the link is idle;
+	// Read consumes the checkpoint record and times out.
+	if _, err := readWithin(c, 200*time.Millisecond); err == nil {
+		t.Fatal("control record surfaced from Read")
+	}
+
+	srvAudit, err := conn.Session().ExportAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliAudit, err := c.Session.ExportAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvAudit.Remote.Checkpoints) != 1 || len(cliAudit.Remote.Checkpoints) != 1 {
+		t.Fatalf("verified checkpoints: server %d, client %d", len(srvAudit.Remote.Checkpoints), len(cliAudit.Remote.Checkpoints))
+	}
+}
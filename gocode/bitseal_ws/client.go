@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
@@ -26,41 +28,87 @@ type BitSealWSConn struct {
 	Conn    *websocket.Conn
 	Session *rtc.Session
 
+	// Claims 为服务器签发的 SimpleToken 声明（含服务器 Authorize 添加的声明，如角色）。
+	Claims map[string]any
+
 	// Extra 保存服务器握手响应中除 token/salt_s/ts/nonce 之外的所有字段，
 	// 对应服务端 OnHandshakeResponse 注入的自定义数据。
 	Extra map[string]any
 
+	// Frag 为与服务器协商后的分片参数（双方声明取较小值）。
+	// 服务器支持分片时，Write 会对超过 Frag.FragSize 的消息自动分片，
+	// Read 则在凑齐所有分片后才返回整条消息。
+	Frag rtc.FragOptions
+
+	framer     *framer
+	framerOnce sync.Once
+
+	// 心跳：idle 为生效的空闲时限（0 表示不限制），stop 在 Close 时关闭以停止 ping。
+	idle      time.Duration
+	stop      chan struct{}
+	closeOnce sync.Once
+
 	// OnMessage 若非 nil，则 Serve/ServeAsync 解包明文后调用；
 	// 返回值非 nil ⇒ 自动 Encode + 发送；
 	OnMessage func(sess *rtc.Session, plain []byte) ([]byte, error)
+
+	// OnGoAway 若非 nil，则在服务器通知即将关闭（Server.Shutdown）时由 Read 调用。
+	// 之后仍可能收到在途消息，随后连接以 Close Code 1001 关闭；可借此提前重连。
+	OnGoAway func(reason string)
 }
 
-// Write 加密并发送明文数据。
+// framing 返回连接的 framer；手工构造的 BitSealWSConn 在首次使用时
+// 按默认参数创建（只重组、不分片）。
+func (c *BitSealWSConn) framing() *framer {
+	c.framerOnce.Do(func() {
+		if c.framer == nil {
+			c.framer, _ = newFramer(c.Session, rtc.FragOptions{}, false, 0)
+		}
+		c.framer.onGoAway = func(reason string) {
+			if c.OnGoAway != nil {
+				c.OnGoAway(reason)
+			}
+		}
+	})
+	return c.framer
+}
+
+// Write 加密并发送明文数据，必要时自动分片。
 func (c *BitSealWSConn) Write(plain []byte) error {
 	if c == nil || c.Conn == nil || c.Session == nil {
 		return errors.New("BitSealWSConn nil")
 	}
-	frame, err := c.Session.EncodeRecord(plain, 0)
-	if err != nil {
-		return err
-	}
-	return websocket.Message.Send(c.Conn, frame)
+	return c.framing().send(c.Conn, plain)
 }
 
-// Read 接收并解密下一帧，返回明文。
+// Read 接收并解密下一条完整消息，返回明文。分片消息在内部重组，
+// 心跳控制记录在内部处理（回应 ping、更新 RTT），不会返回给调用方。
+// 启用了空闲时限时，Read 会自行设置读超时；超时后以 CloseIdleTimeout 关闭连接并返回 ErrIdleTimeout。
 func (c *BitSealWSConn) Read() ([]byte, error) {
 	if c == nil || c.Conn == nil || c.Session == nil {
 		return nil, errors.New("BitSealWSConn nil")
 	}
-	var frame []byte
-	if err := websocket.Message.Receive(c.Conn, &frame); err != nil {
-		return nil, err
-	}
-	plain, err := c.Session.DecodeRecord(frame)
-	if err != nil {
-		return nil, err
+	fr := c.framing()
+	for {
+		if c.idle > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+		}
+		var frame []byte
+		if err := websocket.Message.Receive(c.Conn, &frame); err != nil {
+			if c.idle > 0 && isTimeout(err) {
+				_ = c.closeWithCode(CloseIdleTimeout, "idle timeout")
+				return nil, ErrIdleTimeout
+			}
+			return nil, err
+		}
+		plain, ok, err := fr.decode(c.Conn, frame, 0)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return plain, nil
+		}
 	}
-	return plain, nil
 }
 
 // Close 关闭底层 websocket 连接。
@@ -68,9 +116,32 @@ func (c *BitSealWSConn) Close() error {
 	if c == nil || c.Conn == nil {
 		return nil
 	}
+	c.stopPing()
 	return c.Conn.Close()
 }
 
+// closeWithCode 发送带状态码的 Close 帧后关闭连接。
+func (c *BitSealWSConn) closeWithCode(code int, reason string) error {
+	c.stopPing()
+	fr := c.framing()
+	fr.sendMu.Lock()
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	err := writeCloseFrame(c.Conn, code, reason)
+	if cerr := closeWithoutFrame(c.Conn); err == nil {
+		err = cerr
+	}
+	fr.sendMu.Unlock()
+	return err
+}
+
+func (c *BitSealWSConn) stopPing() {
+	c.closeOnce.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+		}
+	})
+}
+
 // Serve 在当前 goroutine 中持续读取并分发消息，直到 Read 返回错误或连接关闭。
 // 若设置了 OnMessage，则自动调用并根据返回值决定是否回复。
 func (c *BitSealWSConn) Serve() {
@@ -97,12 +168,51 @@ func (c *BitSealWSConn) ServeAsync() {
 	go c.Serve()
 }
 
+// ConnectOptions 为 ConnectBitSealWSWithOptions 的可选参数；零值等同 ConnectBitSealWS。
+type ConnectOptions struct {
+	// Frag 为本端可接受的分片参数，将在握手请求中声明；
+	// 零值字段取默认值（FRAG_SIZE / MAX_FRAGS）。
+	Frag rtc.FragOptions
+
+	// PingInterval 大于 0 时，每隔该时间向服务器发送加密 ping（服务器需在握手中声明支持心跳），
+	// RTT 可通过 BitSealWSConn.RTT 读取。pong 在 Read 中处理，因此需要持续读取连接。
+	PingInterval time.Duration
+	// IdleTimeout 为 Read 等待下一条记录的最长时间，超时即断开；
+	// 0 表示启用 ping 时取 2×PingInterval，否则不限制。
+	IdleTimeout time.Duration
+
+	// Checkpoints 若不为 nil，则启用 BSC3 检查点：验证服务器发来的检查点，
+	// 并在服务器声明支持心跳时按该配置发出检查点，见 Session.ExportAudit。
+	Checkpoints *rtc.CheckpointConfig
+
+	// HandshakePath 为握手 POST 的路径，签名覆盖该路径，须与服务器的 Server.HandshakePath 一致。
+	// 为空时由 wsURL 推导：路径以 /socket 结尾时替换为 /handshake
+	// （wss://host/api/v2/ws/socket -> /api/v2/ws/handshake），否则为 DefaultHandshakePath。
+	HandshakePath string
+}
+
+// handshakePath 返回 opts 对应 u 的握手路径。
+func (opts ConnectOptions) handshakePath(u *url.URL) string {
+	if opts.HandshakePath != "" {
+		return opts.HandshakePath
+	}
+	if strings.HasSuffix(u.Path, "/socket") {
+		return strings.TrimSuffix(u.Path, "socket") + "handshake"
+	}
+	return DefaultHandshakePath
+}
+
 // ConnectBitSealWS 完成客户端两步握手并建立 BST2 会话，返回包装后的连接。
 //  1. HTTP POST /ws/handshake – BitSeal-WEB 签名请求
 //  2. WebSocket Upgrade /ws/socket – 子协议携带 SimpleToken
 //
-// wsURL 形如 wss://host/ws/socket
+// wsURL 形如 wss://host/ws/socket；挂载在其他路径下时握手路径见 ConnectOptions.HandshakePath。
 func ConnectBitSealWS(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, wsURL string) (*BitSealWSConn, error) {
+	return ConnectBitSealWSWithOptions(clientPriv, serverPub, wsURL, ConnectOptions{})
+}
+
+// ConnectBitSealWSWithOptions 与 ConnectBitSealWS 相同，但接受额外选项。
+func ConnectBitSealWSWithOptions(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, wsURL string, opts ConnectOptions) (*BitSealWSConn, error) {
 	// ---------- 衍生 HTTP 基地址 ----------
 	u, err := url.Parse(wsURL)
 	if err != nil {
@@ -118,13 +228,18 @@ func ConnectBitSealWS(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, wsURL
 	if err != nil {
 		return nil, err
 	}
-	body, signedHeaders, err := BuildHandshakeRequest(clientPriv, serverPub, saltC, "")
+	localFrag, err := opts.Frag.WithDefaults()
+	if err != nil {
+		return nil, err
+	}
+	path := opts.handshakePath(u)
+	body, signedHeaders, err := buildHandshakeRequest(clientPriv, serverPub, path, saltC, "", localFrag, true)
 	if err != nil {
 		return nil, err
 	}
 
-	// HTTP POST /ws/handshake
-	handshakeURL := httpBase.String() + "/ws/handshake"
+	// HTTP POST /ws/handshake（或 opts.HandshakePath）
+	handshakeURL := httpBase.String() + path
 	req, err := http.NewRequest(http.MethodPost, handshakeURL, bytes.NewBufferString(body))
 	if err != nil {
 		return nil, err
@@ -160,7 +275,7 @@ func ConnectBitSealWS(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, wsURL
 	}
 
 	// 验证服务器签名
-	ok, err := bsweb.VerifyRequest("POST", "/ws/handshake", "", respBodyStr, hdr, clientPriv)
+	ok, err := bsweb.VerifyRequest("POST", path, "", respBodyStr, hdr, clientPriv)
 	if err != nil {
 		return nil, err
 	}
@@ -184,13 +299,27 @@ func ConnectBitSealWS(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, wsURL
 	}
 
 	// 验证 SimpleToken
-	if _, err := VerifyToken(tokenVal, serverPub); err != nil {
+	claims, err := VerifyToken(tokenVal, serverPub)
+	if err != nil {
 		return nil, fmt.Errorf("token verify: %w", err)
 	}
 
+	// 服务器仅在客户端声明分片参数时回应自己的声明；未回应则视为默认值
+	serverFrag, err := parseFragAdvert(respBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	frag, err := rtc.NegotiateFrag(localFrag, serverFrag)
+	if err != nil {
+		return nil, err
+	}
+
 	// 分离 extra 字段
 	delete(raw, "token")
 	delete(raw, "salt_s")
+	delete(raw, "frag_size")
+	delete(raw, "max_frags")
+	delete(raw, "heartbeat")
 	// 其余字段原样保存
 
 	// ---------- Step-2 WebSocket Upgrade ----------
@@ -211,13 +340,30 @@ func ConnectBitSealWS(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, wsURL
 	// ---------- 建立 BST2 会话 ----------
 	saltCBytes, _ := hex.DecodeString(saltC)
 	saltSBytes, _ := hex.DecodeString(saltSVal)
-	sess, err := rtc.NewSession(clientPriv, serverPub, saltCBytes, saltSBytes, nil)
+	sess, err := rtc.NewSessionWithConfig(clientPriv, serverPub, saltCBytes, saltSBytes, rtc.SessionConfig{Checkpoints: opts.Checkpoints}, nil)
 	if err != nil {
 		wsConn.Close()
 		return nil, err
 	}
 
-	return &BitSealWSConn{Conn: wsConn, Session: sess, Extra: raw}, nil
+	fr, err := newFramer(sess, frag, serverFrag != (rtc.FragOptions{}), 0)
+	if err != nil {
+		wsConn.Close()
+		return nil, err
+	}
+
+	conn := &BitSealWSConn{Conn: wsConn, Session: sess, Claims: claims, Extra: raw, Frag: frag, framer: fr}
+	serverHeartbeat := parseHeartbeatAdvert(respBodyBytes)
+	fr.checkpoints = opts.Checkpoints != nil && serverHeartbeat
+	conn.idle = idleTimeout(opts.IdleTimeout, opts.PingInterval, serverHeartbeat)
+	conn.stop = make(chan struct{})
+	if opts.PingInterval > 0 && serverHeartbeat {
+		go conn.pingLoop(opts.PingInterval, conn.stop)
+	}
+	if t := fr.checkpointTicker(); t != nil {
+		go conn.checkpointLoop(t, conn.stop)
+	}
+	return conn, nil
 }
 
 // randomSalt4Hex 生成 4 字节随机盐（8 字符 hex）。
@@ -0,0 +1,566 @@
+package bitsealws
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	bsweb "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_web"
+
+	"golang.org/x/net/websocket"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	"go.uber.org/zap"
+)
+
+// ConnPolicy 决定同一公钥的连接数达到 Server.MaxConnsPerKey 时如何处理新连接。
+type ConnPolicy int
+
+const (
+	// ConnAllowMany 允许任意多个连接（默认）；MaxConnsPerKey 不生效。
+	ConnAllowMany ConnPolicy = iota
+	// ConnReplaceOldest 接受新连接并以 CloseConnLimit 关闭最早的连接。
+	ConnReplaceOldest
+	// ConnRejectNew 拒绝新连接：握手返回 409，Upgrade 后以 CloseConnLimit 关闭。
+	ConnRejectNew
+)
+
+// OverflowPolicy 决定连接发送队列已满时 Send 的行为。
+type OverflowPolicy int
+
+const (
+	// OverflowBlock 等待队列出现空位（默认）；SendContext 可用 ctx 限制等待时间。
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop 丢弃该消息并返回 ErrQueueFull。
+	OverflowDrop
+	// OverflowDisconnect 以 CloseSlowConsumer 断开慢速连接并返回 ErrQueueFull。
+	OverflowDisconnect
+)
+
+const (
+	// controlQueueSize 为每条连接控制记录队列的长度。
+	controlQueueSize = 8
+	// DefaultSendQueueSize 为 Server.SendQueueSize 为 0 时每条连接的发送队列长度。
+	DefaultSendQueueSize = 256
+	// DefaultWriteTimeout 为 Server.WriteTimeout 为 0 时单条消息写入 socket 的时限。
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// WebSocket Close Code（BitSeal-WS §9）。
+const (
+	// CloseIdleTimeout 因空闲超时（心跳无响应）被关闭。
+	CloseIdleTimeout = 4408
+	// CloseQuotaExceeded 因额度或消息速率超限被关闭（RateClose）。
+	CloseQuotaExceeded = 4409
+	// CloseConnLimit 因连接数限制被关闭。
+	CloseConnLimit = 4410
+	// CloseSlowConsumer 因发送队列溢出被关闭（OverflowDisconnect）。
+	CloseSlowConsumer = 4411
+)
+
+var (
+	// ErrPeerNotConnected 表示目标公钥或连接当前不在线。
+	ErrPeerNotConnected = errors.New("peer not connected")
+	// ErrQueueFull 表示发送队列已满，消息未发送。
+	ErrQueueFull = errors.New("send queue full")
+	// ErrConnClosed 表示连接已关闭。
+	ErrConnClosed = errors.New("connection closed")
+)
+
+// ConnStats 为连接发送队列的统计数据。
+type ConnStats struct {
+	Queued    int    // 当前排队的消息数
+	MaxQueued int    // 队列深度的历史最大值
+	Sent      uint64 // 已写入 socket 的消息数
+	Dropped   uint64 // 因队列已满被丢弃的消息数
+}
+
+// ServerConn 是服务端的一条已建立会话的连接。同一公钥可同时拥有多条连接
+// （例如多个浏览器标签页），以 ID 区分。
+type ServerConn struct {
+	id        uint64
+	peerPub   *ec.PublicKey
+	peerHex   string
+	addr      string
+	sess      *rtc.Session
+	ws        *websocket.Conn
+	framer    *framer
+	createdAt time.Time
+	logger    *zap.Logger
+
+	// 发送队列：Send 入队，writeLoop 独占写入 socket。
+	// ctl 为控制记录（pong 等）队列，writeLoop 优先于 out 写出，不受 Overflow 策略影响。
+	out          chan []byte
+	ctl          chan controlRecord
+	overflow     OverflowPolicy
+	writeTimeout time.Duration
+	sent         atomic.Uint64
+	dropped      atomic.Uint64
+	maxQueued    atomic.Int64
+
+	// claims 为 SimpleToken 的声明，extra 为握手响应的附加字段。
+	claims map[string]any
+	extra  map[string]any
+
+	// rpcSlots 为在途 RPC 处理函数的信号量，容量为 Server.MaxInFlightRPC。
+	rpcSlots chan struct{}
+
+	// control 表示客户端能识别控制记录（握手中声明了 heartbeat），可向其发送 ping / go-away。
+	control bool
+
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeReason error // 在 closeOnce 中写入
+}
+
+func (s *Server) newServerConn(peerPub *ec.PublicKey, sess *rtc.Session, ws *websocket.Conn, fr *framer) *ServerConn {
+	size := s.SendQueueSize
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	timeout := s.WriteTimeout
+	if timeout == 0 {
+		timeout = DefaultWriteTimeout
+	}
+	inFlight := s.MaxInFlightRPC
+	if inFlight <= 0 {
+		inFlight = DefaultMaxInFlightRPC
+	}
+	c := &ServerConn{
+		id:           s.nextConn.Add(1),
+		peerPub:      peerPub,
+		peerHex:      fmt.Sprintf("%x", peerPub.Compressed()),
+		addr:         bsweb.Address(peerPub, s.Network),
+		sess:         sess,
+		ws:           ws,
+		framer:       fr,
+		createdAt:    time.Now(),
+		logger:       s.logger,
+		out:          make(chan []byte, size),
+		ctl:          make(chan controlRecord, controlQueueSize),
+		overflow:     s.Overflow,
+		writeTimeout: timeout,
+		rpcSlots:     make(chan struct{}, inFlight),
+		done:         make(chan struct{}),
+	}
+	fr.onPing = func(body []byte) { _ = c.queueControl(rtc.ControlPong, body) }
+	return c
+}
+
+// controlRecord 为等待写 goroutine 发出的控制记录。
+type controlRecord struct {
+	typ  rtc.ControlType
+	body []byte
+}
+
+// queueControl 将控制记录交给写 goroutine；队列已满时丢弃并返回 ErrQueueFull（对端会重发 ping）。
+func (c *ServerConn) queueControl(typ rtc.ControlType, body []byte) error {
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+	select {
+	case c.ctl <- controlRecord{typ: typ, body: body}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// ID 返回服务器内唯一、单调递增的连接编号。
+func (c *ServerConn) ID() uint64 { return c.id }
+
+// PeerPub 返回客户端公钥。
+func (c *ServerConn) PeerPub() *ec.PublicKey { return c.peerPub }
+
+// Addr 返回客户端公钥的 P2PKH 地址（按 Server.Network），即令牌中的 addr 声明与账户主键。
+func (c *ServerConn) Addr() string { return c.addr }
+
+// Session 返回连接的 BST2 会话。
+func (c *ServerConn) Session() *rtc.Session { return c.sess }
+
+// RemoteAddr 返回客户端地址（取自 Upgrade 请求）。
+func (c *ServerConn) RemoteAddr() string { return c.ws.Request().RemoteAddr }
+
+// ConnectedAt 返回连接建立时间。
+func (c *ServerConn) ConnectedAt() time.Time { return c.createdAt }
+
+// Claims 返回握手时签发的 SimpleToken 声明，调用方不应修改。
+func (c *ServerConn) Claims() map[string]any { return c.claims }
+
+// Extra 返回握手响应中由 OnHandshakeResponse 附加的字段（客户端的 BitSealWSConn.Extra），调用方不应修改。
+func (c *ServerConn) Extra() map[string]any { return c.extra }
+
+// Send 将一条明文消息放入发送队列，由连接的写 goroutine 加密发送（必要时分片）。
+// 队列已满时按 Server.Overflow 处理；返回 nil 仅表示已入队。plain 会被复制。
+func (c *ServerConn) Send(plain []byte) error {
+	return c.SendContext(context.Background(), plain)
+}
+
+// SendContext 与 Send 相同；OverflowBlock 下最多等待到 ctx 结束。
+func (c *ServerConn) SendContext(ctx context.Context, plain []byte) error {
+	return c.send(ctx, plain, true)
+}
+
+// trySend 与 Send 相同但从不等待队列空位：队列已满时 OverflowBlock 按 OverflowDrop 处理。
+func (c *ServerConn) trySend(plain []byte) error {
+	return c.send(context.Background(), plain, false)
+}
+
+func (c *ServerConn) send(ctx context.Context, plain []byte, wait bool) error {
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+	msg := append(make([]byte, 0, len(plain)), plain...) // 非 nil：nil 为关闭标记，见 closeAfterFlush
+	select {
+	case c.out <- msg:
+		c.noteDepth()
+		return nil
+	default:
+	}
+	policy := c.overflow
+	if !wait && policy == OverflowBlock {
+		policy = OverflowDrop
+	}
+	switch policy {
+	case OverflowDrop:
+		c.dropped.Add(1)
+		return ErrQueueFull
+	case OverflowDisconnect:
+		c.dropped.Add(1)
+		if c.logger != nil {
+			c.logger.Warn("send queue overflow, disconnecting slow consumer", zap.Uint64("conn", c.id))
+		}
+		// 写 goroutine 可能正阻塞在 socket 上，异步关闭以免调用方等待
+		go c.CloseWithCode(CloseSlowConsumer, "slow consumer")
+		return ErrQueueFull
+	}
+	select {
+	case c.out <- msg:
+		c.noteDepth()
+		return nil
+	case <-c.done:
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *ServerConn) noteDepth() {
+	d := int64(len(c.out))
+	for {
+		cur := c.maxQueued.Load()
+		if d <= cur || c.maxQueued.CompareAndSwap(cur, d) {
+			return
+		}
+	}
+}
+
+// writeLoop 按入队顺序写出消息；写入失败或超时即关闭连接。
+func (c *ServerConn) writeLoop() {
+	var tick <-chan time.Time
+	if t := c.framer.checkpointTicker(); t != nil {
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		// 控制记录优先：每次写出普通消息前先清空 ctl
+		select {
+		case rec := <-c.ctl:
+			if c.writeControl(rec) != nil {
+				return
+			}
+			continue
+		default:
+		}
+		select {
+		case rec := <-c.ctl:
+			if c.writeControl(rec) != nil {
+				return
+			}
+		case plain := <-c.out:
+			if plain == nil {
+				_ = c.CloseWithCode(CloseGoingAway, shutdownReason)
+				return
+			}
+			_ = c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			if err := c.framer.send(c.ws, plain); err != nil {
+				if c.logger != nil {
+					c.logger.Warn("send error, closing connection", zap.Uint64("conn", c.id), zap.Error(err))
+				}
+				_ = c.closeWithReason(err)
+				return
+			}
+			c.sent.Add(1)
+		case <-tick:
+			if err := c.framer.checkpoint(c.ws, c.writeTimeout); err != nil {
+				_ = c.closeWithReason(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// writeControl 写出一条控制记录，失败时关闭连接。
+func (c *ServerConn) writeControl(rec controlRecord) error {
+	err := c.framer.sendControl(c.ws, rec.typ, rec.body, c.writeTimeout)
+	if err != nil {
+		_ = c.closeWithReason(err)
+	}
+	return err
+}
+
+// Stats 返回发送队列的统计数据。
+func (c *ServerConn) Stats() ConnStats {
+	return ConnStats{
+		Queued:    len(c.out),
+		MaxQueued: int(c.maxQueued.Load()),
+		Sent:      c.sent.Load(),
+		Dropped:   c.dropped.Load(),
+	}
+}
+
+// Close 关闭连接（Close Code 1000），队列中未发送的消息被丢弃。
+func (c *ServerConn) Close() error {
+	return c.closeWithReason(ErrConnClosed)
+}
+
+// closeWithReason 关闭连接并记录关闭原因（见 Hooks.OnDisconnect），只有第一次关闭生效。
+func (c *ServerConn) closeWithReason(reason error) error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.closeReason = reason
+		close(c.done)
+		err = c.ws.Close()
+	})
+	return err
+}
+
+// abort 立即关闭连接：不等待阻塞在 socket 上的写入，也不发送 Close 帧。
+func (c *ServerConn) abort(reason error) {
+	c.closeOnce.Do(func() {
+		c.closeReason = reason
+		close(c.done)
+		_ = closeWithoutFrame(c.ws)
+	})
+}
+
+// CloseWithCode 发送带状态码与原因的 Close 帧后关闭连接。
+func (c *ServerConn) CloseWithCode(code int, reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.closeReason = &CloseError{Code: code, Reason: reason}
+		close(c.done)
+		c.framer.sendMu.Lock()
+		_ = c.ws.SetWriteDeadline(time.Now().Add(time.Second))
+		err = writeCloseFrame(c.ws, code, reason)
+		if cerr := closeWithoutFrame(c.ws); err == nil {
+			err = cerr
+		}
+		c.framer.sendMu.Unlock()
+	})
+	return err
+}
+
+// writeCloseFrame 借助 PayloadType 发送自定义 Close 帧（x/net/websocket 未直接提供）。
+// 调用方需持有 framer.sendMu，避免与其他写入交错。
+func writeCloseFrame(ws *websocket.Conn, code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	prev := ws.PayloadType
+	ws.PayloadType = websocket.CloseFrame
+	_, err := ws.Write(payload)
+	ws.PayloadType = prev
+	return err
+}
+
+// closeWithoutFrame 关闭底层连接而不发送 Close 帧（例如已由 writeCloseFrame 发出）。ws.Close 总会再写一个
+// 1000 Close 帧，而 x/net/websocket 不暴露底层 net.Conn；先把写截止时间设为过去，使这次写入立即失败、
+// 不发出任何字节，随后 ws.Close 照常关闭底层连接。阻塞中的写入也会因此立即返回。
+func closeWithoutFrame(ws *websocket.Conn) error {
+	_ = ws.SetWriteDeadline(time.Unix(1, 0))
+	if err := ws.Close(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	return nil
+}
+
+// ---------- Server 连接表 ----------
+
+// connLimitReached 报告按当前策略是否应拒绝该公钥的新连接。
+func (s *Server) connLimitReached(peerHex string) bool {
+	if s.ConnPolicy != ConnRejectNew {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients[peerHex]) >= s.maxConnsPerKey()
+}
+
+func (s *Server) maxConnsPerKey() int {
+	if s.MaxConnsPerKey > 0 {
+		return s.MaxConnsPerKey
+	}
+	return 1
+}
+
+// addConn 登记新连接；返回按 ConnReplaceOldest 需要关闭的旧连接。
+// ConnRejectNew 且已达上限或服务器已调用 Shutdown 时返回 ok=false。
+func (s *Server) addConn(c *ServerConn) (evicted []*ServerConn, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients == nil {
+		s.clients = make(map[string]map[uint64]*ServerConn)
+	}
+	set := s.clients[c.peerHex]
+	if s.closing {
+		return nil, false
+	}
+	if s.ConnPolicy == ConnRejectNew && len(set) >= s.maxConnsPerKey() {
+		return nil, false
+	}
+	if set == nil {
+		set = make(map[uint64]*ServerConn)
+		s.clients[c.peerHex] = set
+		if s.clientsByPKH == nil {
+			s.clientsByPKH = make(map[string]string)
+		}
+		s.clientsByPKH[string(c.peerPub.Hash())] = c.peerHex
+	}
+	set[c.id] = c
+	if s.connsByID == nil {
+		s.connsByID = make(map[uint64]*ServerConn)
+	}
+	s.connsByID[c.id] = c
+	if s.connsBySess == nil {
+		s.connsBySess = make(map[*rtc.Session]*ServerConn)
+	}
+	s.connsBySess[c.sess] = c
+	if s.ConnPolicy == ConnReplaceOldest {
+		if extra := len(set) - s.maxConnsPerKey(); extra > 0 {
+			evicted = sortedConns(set)[:extra]
+		}
+	}
+	return evicted, true
+}
+
+// removeConn 只移除该连接本身；返回该公钥是否已无其他连接。
+func (s *Server) removeConn(c *ServerConn) (last bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.connsByID, c.id)
+	delete(s.connsBySess, c.sess)
+	set := s.clients[c.peerHex]
+	delete(set, c.id)
+	if len(set) == 0 {
+		delete(s.clients, c.peerHex)
+		delete(s.clientsByPKH, string(c.peerPub.Hash()))
+		return true
+	}
+	return false
+}
+
+// Conns 返回该公钥当前的所有连接，按建立顺序排列。
+func (s *Server) Conns(peerPub *ec.PublicKey) []*ServerConn {
+	if peerPub == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedConns(s.clients[fmt.Sprintf("%x", peerPub.Compressed())])
+}
+
+// ConnsByAddr 返回 P2PKH 地址对应公钥的所有连接（任一网络的地址均可），按建立顺序排列；
+// 地址无效或不在线时返回 nil。
+func (s *Server) ConnsByAddr(addr string) []*ServerConn {
+	pkh, _, err := bsweb.ParseAddress(addr)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peerHex, ok := s.clientsByPKH[string(pkh)]
+	if !ok {
+		return nil
+	}
+	return sortedConns(s.clients[peerHex])
+}
+
+// Conn 按 ID 查找连接；不存在时返回 nil。
+func (s *Server) Conn(id uint64) *ServerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connsByID[id]
+}
+
+// SessionConn 返回会话所属的连接（例如在 OnMessage 中读取 Claims）；连接已关闭时返回 nil。
+func (s *Server) SessionConn(sess *rtc.Session) *ServerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connsBySess[sess]
+}
+
+// SendToConn 向指定连接发送明文。
+func (s *Server) SendToConn(id uint64, plain []byte) error {
+	c := s.Conn(id)
+	if c == nil {
+		return ErrPeerNotConnected
+	}
+	return c.Send(plain)
+}
+
+// ServerStats 汇总当前所有连接的发送队列统计。
+type ServerStats struct {
+	Conns     int
+	Queued    int    // 所有连接当前排队的消息数之和
+	MaxQueued int    // 单条连接队列深度的最大值
+	Sent      uint64 // 当前连接已发送消息数之和
+	Dropped   uint64 // 当前连接丢弃消息数之和
+}
+
+// Stats 返回当前连接的发送队列统计，可用于导出监控指标。
+func (s *Server) Stats() ServerStats {
+	s.mu.Lock()
+	conns := make([]*ServerConn, 0, len(s.connsByID))
+	for _, c := range s.connsByID {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	var st ServerStats
+	for _, c := range conns {
+		cs := c.Stats()
+		st.Conns++
+		st.Queued += cs.Queued
+		st.Sent += cs.Sent
+		st.Dropped += cs.Dropped
+		if cs.MaxQueued > st.MaxQueued {
+			st.MaxQueued = cs.MaxQueued
+		}
+	}
+	return st
+}
+
+func sortedConns(set map[uint64]*ServerConn) []*ServerConn {
+	out := make([]*ServerConn, 0, len(set))
+	for _, c := range set {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
@@ -1,14 +1,21 @@
 package bitsealws_test
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
 	"net/url"
 	"testing"
+	"time"
 
 	"net/http/httptest"
 
 	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
 	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
 	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/websocket"
 )
 
 func fixedPriv(b byte) *ec.PrivateKey {
@@ -51,3 +58,146 @@ func TestConnectBitSealWS(t *testing.T) {
 		t.Fatalf("echo mismatch: got %q want %q", echo, payload)
 	}
 }
+
+// TestConnectFragAdvert checks that fragment options advertised by the client
+// are negotiated with the server and kept out of Extra.
+func TestConnectFragAdvert(t *testing.T) {
+	serverPriv := fixedPriv(0x55)
+	server := ws.NewServer(serverPriv, nil)
+	server.Frag = rtc.FragOptions{FragSize: 64 * 1024}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	httpURL, _ := url.Parse(ts.URL)
+	wsURL := "ws://" + httpURL.Host + "/ws/socket"
+
+	conn, err := ws.ConnectBitSealWSWithOptions(fixedPriv(0x33), serverPriv.PubKey(), wsURL, ws.ConnectOptions{
+		Frag: rtc.FragOptions{FragSize: 256 * 1024, MaxFrags: 1024},
+	})
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	// max_frags is clamped to DefaultMaxReassemblyBytes / frag_size
+	if want := (rtc.FragOptions{FragSize: 64 * 1024, MaxFrags: ws.DefaultMaxReassemblyBytes / (64 * 1024)}); conn.Frag != want {
+		t.Fatalf("negotiated %+v, want %+v", conn.Frag, want)
+	}
+	if _, ok := conn.Extra["frag_size"]; ok {
+		t.Fatal("frag_size leaked into Extra")
+	}
+
+	// a client without options advertises the defaults
+	plain, err := ws.ConnectBitSealWS(fixedPriv(0x34), serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer plain.Close()
+	if want := (rtc.FragOptions{FragSize: rtc.FRAG_SIZE, MaxFrags: ws.DefaultMaxReassemblyBytes / rtc.FRAG_SIZE}); plain.Frag != want {
+		t.Fatalf("default client negotiated %+v", plain.Frag)
+	}
+}
+
+// TestLargeMessageEcho sends messages larger than the old 64 KiB read buffer
+// and the fragment size through the echo server in both directions.
+func TestLargeMessageEcho(t *testing.T) {
+	serverPriv := fixedPriv(0x55)
+	server := ws.NewServer(serverPriv, nil)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	httpURL, _ := url.Parse(ts.URL)
+	wsURL := "ws://" + httpURL.Host + "/ws/socket"
+
+	conn, err := ws.ConnectBitSealWS(fixedPriv(0x33), serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	for _, size := range []int{10, rtc.FRAG_SIZE, rtc.FRAG_SIZE + 1, 1 << 20} {
+		payload := make([]byte, size)
+		_, _ = rand.Read(payload)
+		if err := conn.Write(payload); err != nil {
+			t.Fatalf("write %d: %v", size, err)
+		}
+		echo, err := conn.Read()
+		if err != nil {
+			t.Fatalf("read %d: %v", size, err)
+		}
+		if !bytes.Equal(echo, payload) {
+			t.Fatalf("echo mismatch for %d bytes (got %d)", size, len(echo))
+		}
+	}
+}
+
+// TestReassemblyLimit clamps the negotiated max_frags to the server's
+// per-connection reassembly buffer, so a message just over it fails in the
+// client's Write instead of being dropped by the server.
+func TestReassemblyLimit(t *testing.T) {
+	const limit = 64 * 1024
+	decodeErrs := make(chan error, 16)
+	_, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.OnMessage = nil // echo
+		s.MaxReassemblyBytes = limit
+		s.Hooks.OnDecodeError = func(c *ws.ServerConn, err error) {
+			select {
+			case decodeErrs <- err:
+			default:
+			}
+		}
+	})
+	conn, err := ws.ConnectBitSealWS(fixedPriv(0x33), serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Write(make([]byte, limit+1)); err == nil {
+		t.Fatal("message over the reassembly limit sent")
+	}
+	msg := make([]byte, limit)
+	_, _ = rand.Read(msg)
+	if err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readWithin(conn, 2*time.Second); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("echo of %d bytes: got %d bytes, %v", len(msg), len(got), err)
+	}
+	select {
+	case err := <-decodeErrs:
+		t.Fatalf("server decode error %v", err)
+	default:
+	}
+}
+
+func TestCloseWithCodeSingleFrame(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, nil)
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := waitConns(t, server, clientPriv.PubKey(), 1)[0]
+	if err := conn.CloseWithCode(ws.CloseSlowConsumer, "slow consumer"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read raw frames until the socket closes: exactly one close frame, carrying our code.
+	_ = c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var codes []uint16
+	for {
+		fr, err := c.Conn.NewFrameReader()
+		if err != nil {
+			break
+		}
+		payload, _ := io.ReadAll(fr)
+		if fr.PayloadType() == websocket.CloseFrame && len(payload) >= 2 {
+			codes = append(codes, binary.BigEndian.Uint16(payload))
+		}
+	}
+	if len(codes) != 1 || codes[0] != ws.CloseSlowConsumer {
+		t.Fatalf("close frames %v, want [%d]", codes, ws.CloseSlowConsumer)
+	}
+}
@@ -0,0 +1,156 @@
+package bitsealws_test
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+func startServer(t *testing.T, configure func(*ws.Server)) (*ws.Server, *ec.PrivateKey, string) {
+	t.Helper()
+	serverPriv := fixedPriv(0x55)
+	server := ws.NewServer(serverPriv, nil)
+	server.OnMessage = func(sess *rtc.Session, plain []byte) ([]byte, error) { return nil, nil }
+	if configure != nil {
+		configure(server)
+	}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	httpURL, _ := url.Parse(ts.URL)
+	return server, serverPriv, "ws://" + httpURL.Host + "/ws/socket"
+}
+
+// waitConns polls until the server has registered n connections for pub.
+func waitConns(t *testing.T, server *ws.Server, pub *ec.PublicKey, n int) []*ws.ServerConn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conns := server.Conns(pub)
+		if len(conns) == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("have %d connections, want %d", len(conns), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func readWithin(c *ws.BitSealWSConn, d time.Duration) ([]byte, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(d))
+	return c.Read()
+}
+
+func TestMultipleConnsPerKey(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, nil)
+	clientPriv := fixedPriv(0x33)
+	pub := clientPriv.PubKey()
+
+	c1, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	conns := waitConns(t, server, pub, 2)
+	if conns[0].ID() >= conns[1].ID() {
+		t.Fatalf("connection IDs not ordered: %d, %d", conns[0].ID(), conns[1].ID())
+	}
+
+	// SendTo reaches every connection of the key.
+	if err := server.SendTo(pub, []byte("all")); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []*ws.BitSealWSConn{c1, c2} {
+		if msg, err := readWithin(c, 5*time.Second); err != nil || string(msg) != "all" {
+			t.Fatalf("conn %d: %q, %v", i, msg, err)
+		}
+	}
+
+	// SendToConn reaches only the targeted one.
+	if err := server.SendToConn(conns[1].ID(), []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readWithin(c2, 5*time.Second); err != nil || string(msg) != "one" {
+		t.Fatalf("targeted conn: %q, %v", msg, err)
+	}
+	if _, err := readWithin(c1, 100*time.Millisecond); err == nil {
+		t.Fatal("untargeted conn received a message")
+	}
+
+	// Closing the first connection leaves the second registered.
+	c1.Close()
+	conns = waitConns(t, server, pub, 1)
+	if server.Conn(conns[0].ID()) == nil {
+		t.Fatal("remaining connection not found by ID")
+	}
+	if err := server.SendTo(pub, []byte("still")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readWithin(c2, 5*time.Second); err != nil || string(msg) != "still" {
+		t.Fatalf("after close: %q, %v", msg, err)
+	}
+
+	c2.Close()
+	waitConns(t, server, pub, 0)
+	if err := server.SendTo(pub, []byte("gone")); err != ws.ErrPeerNotConnected {
+		t.Fatalf("SendTo without connections: %v", err)
+	}
+}
+
+func TestConnPolicyReplaceOldest(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) { s.ConnPolicy = ws.ConnReplaceOldest })
+	clientPriv := fixedPriv(0x33)
+
+	c1, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	first := waitConns(t, server, clientPriv.PubKey(), 1)[0]
+
+	c2, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if _, err := readWithin(c1, 5*time.Second); err == nil {
+		t.Fatal("oldest connection still open")
+	}
+	conns := waitConns(t, server, clientPriv.PubKey(), 1)
+	if conns[0].ID() == first.ID() {
+		t.Fatal("kept the oldest connection instead of the newest")
+	}
+}
+
+func TestConnPolicyRejectNew(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) { s.ConnPolicy = ws.ConnRejectNew })
+	clientPriv := fixedPriv(0x33)
+
+	c1, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	waitConns(t, server, clientPriv.PubKey(), 1)
+
+	if _, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("second connection: %v", err)
+	}
+	// Other keys are unaffected.
+	other, err := ws.ConnectBitSealWS(fixedPriv(0x44), serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+}
@@ -0,0 +1,128 @@
+package bitsealws
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CORS 配置握手端点的跨域策略；同一策略也用于检查 WebSocket Upgrade 请求的 Origin 头。
+// Server.CORS 为 nil 时保持旧行为：任何来源均可（Access-Control-Allow-Origin: *），Upgrade 不检查 Origin。
+//
+// 设置后：
+//   - 未携带 Origin 的请求（非浏览器客户端）照常处理；
+//   - 与请求 scheme 与 Host 均相同的来源（同源页面）始终允许；
+//   - 其他来源需通过 AllowOrigin 或 AllowedOrigins，否则握手与 Upgrade 均以 403 拒绝；
+//   - 允许的来源被原样回显在 Access-Control-Allow-Origin 中（附 Vary: Origin），不再使用 "*"。
+type CORS struct {
+	// AllowedOrigins 为允许的来源列表，形如 "https://app.example.com"（scheme://host[:port]，不区分大小写）；
+	// "*" 表示允许任何来源，但仅凭 "*" 匹配的来源不会获得 Access-Control-Allow-Credentials。
+	AllowedOrigins []string
+	// AllowOrigin 若不为 nil，则代替 AllowedOrigins 判断来源是否允许（例如按子域名匹配）。
+	AllowOrigin func(origin string) bool
+	// AllowCredentials 为 true 时对同源、AllowOrigin 或 AllowedOrigins 中具体列出的来源返回
+	// Access-Control-Allow-Credentials: true，允许浏览器携带 Cookie。
+	AllowCredentials bool
+	// MaxAge 大于 0 时通过 Access-Control-Max-Age 允许浏览器缓存预检结果（按秒取整）。
+	MaxAge time.Duration
+}
+
+const (
+	corsAllowMethods  = "POST, OPTIONS"
+	corsAllowHeaders  = "Content-Type, X-BKSA-Protocol, X-BKSA-Sig, X-BKSA-Timestamp, X-BKSA-Nonce"
+	corsExposeHeaders = "X-BKSA-Protocol, X-BKSA-Sig, X-BKSA-Timestamp, X-BKSA-Nonce"
+)
+
+// allowed 报告 origin 是否被策略允许；r 用于判断同源。
+// wildcard 为 true 表示仅因 AllowedOrigins 中的 "*" 而允许，此时不应回应凭据。
+func (c *CORS) allowed(origin string, r *http.Request) (ok, wildcard bool) {
+	if origin == "" || sameOrigin(origin, r) {
+		return true, false
+	}
+	if c.AllowOrigin != nil {
+		return c.AllowOrigin(origin), false
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			wildcard = true
+		} else if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true, false
+		}
+	}
+	return wildcard, wildcard
+}
+
+// sameOrigin 报告 origin 的 scheme 与主机部分是否与请求相同。
+func sameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Scheme, requestScheme(r)) && strings.EqualFold(u.Host, r.Host)
+}
+
+// requestScheme 返回浏览器看到的请求 scheme：TLS 连接或反向代理声明 X-Forwarded-Proto: https 时为 "https"。
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	if strings.EqualFold(strings.TrimSpace(proto), "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// applyCORS 为握手响应写入 CORS 头；来源不被允许时写出 403 并返回 false。
+// preflight 为 true 时额外写入预检相关的头。
+func (s *Server) applyCORS(w http.ResponseWriter, r *http.Request, preflight bool) bool {
+	h := w.Header()
+	c := s.CORS
+	if c == nil {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		origin := r.Header.Get("Origin")
+		h.Add("Vary", "Origin")
+		ok, wildcard := c.allowed(origin, r)
+		if !ok {
+			if s.logger != nil {
+				s.logger.Info("handshake origin rejected", zap.String("origin", origin))
+			}
+			writeHandshakeError(w, &HandshakeError{Status: http.StatusForbidden, Message: "origin not allowed"})
+			return false
+		}
+		if origin != "" {
+			h.Set("Access-Control-Allow-Origin", origin)
+			if c.AllowCredentials && !wildcard {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if preflight && c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+	}
+	if preflight {
+		h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+		h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+	} else {
+		// 允许浏览器脚本访问签名头
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	}
+	return true
+}
+
+// checkUpgradeOrigin 对 WebSocket Upgrade 请求执行与握手相同的来源策略。
+func (s *Server) checkUpgradeOrigin(r *http.Request) bool {
+	if s.CORS == nil {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if ok, _ := s.CORS.allowed(origin, r); ok {
+		return true
+	}
+	if s.logger != nil {
+		s.logger.Info("upgrade origin rejected", zap.String("origin", origin))
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package bitsealws_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+	"golang.org/x/net/websocket"
+)
+
+func preflight(t *testing.T, wsURL, origin string) *http.Response {
+	t.Helper()
+	handshakeURL := "http://" + strings.TrimPrefix(strings.TrimSuffix(wsURL, "/ws/socket"), "ws://") + "/ws/handshake"
+	req, _ := http.NewRequest(http.MethodOptions, handshakeURL, nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORSDefault(t *testing.T) {
+	_, _, wsURL := startServer(t, nil)
+	resp := preflight(t, wsURL, "https://anywhere.example")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("preflight: %d %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	const app = "https://app.example.com"
+	_, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.CORS = &ws.CORS{AllowedOrigins: []string{app}, AllowCredentials: true, MaxAge: 10 * time.Minute}
+	})
+
+	resp := preflight(t, wsURL, app)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("allowed preflight: %d", resp.StatusCode)
+	}
+	for k, want := range map[string]string{
+		"Access-Control-Allow-Origin":      app,
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+		"Vary":                             "Origin",
+	} {
+		if got := resp.Header.Get(k); got != want {
+			t.Fatalf("%s = %q, want %q", k, got, want)
+		}
+	}
+	if resp := preflight(t, wsURL, "https://evil.example"); resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("disallowed preflight: %d %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	// The Go client has no Origin on the POST and a same-origin Origin on the upgrade.
+	c, err := ws.ConnectBitSealWS(fixedPriv(0x33), serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// A cross-origin upgrade is refused before the token is even looked at.
+	for origin, ok := range map[string]bool{app: true, "https://evil.example": false} {
+		cfg, _ := websocket.NewConfig(wsURL, origin)
+		cfg.Protocol = []string{"BitSeal-WS.1", "bogus-token"}
+		conn, err := websocket.DialConfig(cfg)
+		if ok {
+			if err != nil {
+				t.Fatalf("upgrade from %s: %v", origin, err)
+			}
+			conn.Close()
+		} else if err == nil {
+			conn.Close()
+			t.Fatalf("upgrade from %s accepted", origin)
+		}
+	}
+}
+
+func TestCORSWildcardCredentials(t *testing.T) {
+	const app = "https://app.example.com"
+	_, _, wsURL := startServer(t, func(s *ws.Server) {
+		s.CORS = &ws.CORS{AllowedOrigins: []string{app, "*"}, AllowCredentials: true}
+	})
+	for origin, creds := range map[string]string{app: "true", "https://other.example": ""} {
+		resp := preflight(t, wsURL, origin)
+		if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != origin {
+			t.Fatalf("%s: %d %q", origin, resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Credentials"); got != creds {
+			t.Fatalf("%s: credentials %q, want %q", origin, got, creds)
+		}
+	}
+}
+
+func TestCORSSameOriginScheme(t *testing.T) {
+	_, _, wsURL := startServer(t, func(s *ws.Server) { s.CORS = &ws.CORS{} })
+	host := strings.TrimSuffix(strings.TrimPrefix(wsURL, "ws://"), "/ws/socket")
+	if resp := preflight(t, wsURL, "http://"+host); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("same origin: %d", resp.StatusCode)
+	}
+	// Same host but a different scheme is a different origin.
+	if resp := preflight(t, wsURL, "https://"+host); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("https page on an http server: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,102 @@
+package bitsealws
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+
+	"golang.org/x/net/websocket"
+)
+
+// framer 负责 WS 连接上的透明分片（Profile L）：
+//   - 发送：对端在握手中声明了分片参数时，超过 FragSize 的消息自动拆片，
+//     每片 BST2 flags 置 rtc.FlagFragment；其余消息仍为单条记录。
+//   - 接收：带 FlagFragment 的记录交给 Reassembler，凑齐后才交付整条消息。
+//
+// 未声明分片参数的对端（如旧版 TS 客户端）只会收到单条记录，保持兼容。
+type framer struct {
+	sess  *rtc.Session
+	frag  *rtc.Fragmenter // nil ⇒ 对端不支持分片
+	limit int             // 超过该长度才分片
+	reasm *rtc.Reassembler
+
+	// sendMu 保证一条消息的所有分片连续发出，并保护 Fragmenter 的 msgID。
+	sendMu sync.Mutex
+
+	// 心跳计时起点与最近一次 RTT（纳秒），见 heartbeat.go。
+	start time.Time
+	rtt   atomic.Int64
+
+	// checkpoints 为 true 时在发送后按会话配置签发 BSC3 检查点，见 checkpoint.go。
+	checkpoints bool
+
+	// onGoAway 若不为 nil，则在收到对端的 go-away 通知时调用（读 goroutine 中）。
+	onGoAway func(reason string)
+	// onPing 若不为 nil，则代替就地回复处理对端的 ping（读 goroutine 中）；服务端据此经写 goroutine 回复 pong。
+	onPing func(body []byte)
+}
+
+// newFramer 按协商结果创建 framer；peerFrag 为 false 时不对外分片。
+// maxBuffered 限制重组缓冲的字节数，0 表示 rtc 的默认值（两条最大长度的消息）。
+func newFramer(sess *rtc.Session, opts rtc.FragOptions, peerFrag bool, maxBuffered int) (*framer, error) {
+	reasm, err := rtc.NewReassemblerWithConfig(sess, rtc.ReassemblerConfig{Frag: opts, MaxBufferedBytes: maxBuffered})
+	if err != nil {
+		return nil, err
+	}
+	f := &framer{sess: sess, reasm: reasm, start: time.Now()}
+	if peerFrag {
+		frag, err := rtc.NewFragmenterWithOptions(sess, opts)
+		if err != nil {
+			return nil, err
+		}
+		frag.RecordFlags = rtc.FlagFragment
+		opts, _ = opts.WithDefaults() // 已由 NewFragmenterWithOptions 校验
+		f.frag, f.limit = frag, opts.FragSize
+	}
+	return f, nil
+}
+
+// send 加密并发送一条完整消息，必要时拆片。
+func (f *framer) send(ws *websocket.Conn, plain []byte) error {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if f.frag == nil || len(plain) <= f.limit {
+		frame, err := f.sess.EncodeRecord(plain, 0)
+		if err != nil {
+			return err
+		}
+		if err := websocket.Message.Send(ws, frame); err != nil {
+			return err
+		}
+		return f.checkpointLocked(ws)
+	}
+	frames, err := f.frag.Encode(plain)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err := websocket.Message.Send(ws, frame); err != nil {
+			return err
+		}
+	}
+	return f.checkpointLocked(ws)
+}
+
+// decode 解密一帧；ok 为 false 表示这是尚未凑齐的分片或控制记录。
+// 控制记录在此处理（如回应 ping），pong 经 ws 发出，timeout 为其写超时（0 表示不设）。
+// 只能在单个读 goroutine 中调用。
+func (f *framer) decode(ws *websocket.Conn, frame []byte, timeout time.Duration) (plain []byte, ok bool, err error) {
+	if len(frame) > 4 && frame[4]&rtc.FlagFragment != 0 {
+		return f.reasm.Push(frame)
+	}
+	plain, flags, err := f.sess.DecodeRecordFlags(frame)
+	if err != nil {
+		return nil, false, err
+	}
+	if flags&rtc.FlagControl != 0 {
+		return nil, false, f.control(ws, plain, timeout)
+	}
+	return plain, true, nil
+}
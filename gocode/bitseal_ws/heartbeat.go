@@ -0,0 +1,143 @@
+package bitsealws
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+
+	"golang.org/x/net/websocket"
+)
+
+// 心跳（BitSeal-WS §8.3）：
+//   - ping / pong 为 BST2 控制记录（flags 置 rtc.FlagControl，类型 rtc.ControlPing / rtc.ControlPong），
+//     与普通记录一样加密认证，中间设备无法伪造或吞掉后冒充。
+//   - ping 的 body 为发送方自连接建立起的 8 字节纳秒计时，对端原样回显，发送方据此计算 RTT。
+//   - 客户端在握手请求中以 "heartbeat":1 声明支持，服务端在响应中同样回应；
+//     只向已声明的对端发送 ping，旧客户端不会收到无法识别的控制记录。
+//   - 超过空闲时限未收到任何记录（含 pong）即以 CloseIdleTimeout 关闭连接。
+//   - 服务端的 pong 经控制队列交给写 goroutine，排在已入队的普通消息之前，读 goroutine 不会阻塞在写 socket 上。
+
+// heartbeatVersion 为握手中 "heartbeat" 字段的取值。
+const heartbeatVersion = 1
+
+// ErrIdleTimeout 表示连接在空闲时限内未收到任何记录，已被关闭。
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// parseHeartbeatAdvert 读取握手 JSON 中可选的 heartbeat 字段；未声明时返回 false。
+func parseHeartbeatAdvert(body []byte) bool {
+	var obj struct {
+		Heartbeat int `json:"heartbeat"`
+	}
+	return json.Unmarshal(body, &obj) == nil && obj.Heartbeat >= heartbeatVersion
+}
+
+// idleTimeout 返回生效的空闲时限：显式配置优先；
+// 否则在对端支持心跳且启用了 ping 时取 2×pingInterval，其余情况不限制。
+func idleTimeout(idle, pingInterval time.Duration, peerHeartbeat bool) time.Duration {
+	if idle > 0 {
+		return idle
+	}
+	if pingInterval > 0 && peerHeartbeat {
+		return 2 * pingInterval
+	}
+	return 0
+}
+
+// isTimeout 报告 err 是否为读写超时。
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// sendControl 加密并发送一条控制记录；timeout 大于 0 时设置写超时。
+func (f *framer) sendControl(ws *websocket.Conn, typ rtc.ControlType, body []byte, timeout time.Duration) error {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if timeout > 0 {
+		_ = ws.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	frame, err := f.sess.EncodeControl(typ, body)
+	if err != nil {
+		return err
+	}
+	return websocket.Message.Send(ws, frame)
+}
+
+// ping 发送一条携带当前计时的 ping。
+func (f *framer) ping(ws *websocket.Conn, timeout time.Duration) error {
+	body := binary.BigEndian.AppendUint64(nil, uint64(time.Since(f.start)))
+	return f.sendControl(ws, rtc.ControlPing, body, timeout)
+}
+
+// control 处理一条已解密的控制记录：回应 ping，按 pong 更新 RTT，
+// 将 go-away 交给 onGoAway，其余类型忽略。
+func (f *framer) control(ws *websocket.Conn, plain []byte, timeout time.Duration) error {
+	typ, body, err := rtc.ParseControl(plain)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case rtc.ControlPing:
+		if f.onPing != nil {
+			f.onPing(body)
+			return nil
+		}
+		return f.sendControl(ws, rtc.ControlPong, body, timeout)
+	case rtc.ControlPong:
+		if len(body) != 8 {
+			return errors.New("malformed pong")
+		}
+		rtt := time.Since(f.start) - time.Duration(binary.BigEndian.Uint64(body))
+		if rtt >= 0 {
+			f.rtt.Store(int64(rtt))
+		}
+	case rtc.ControlGoAway:
+		if f.onGoAway != nil {
+			f.onGoAway(string(body))
+		}
+	}
+	return nil
+}
+
+// RTT 返回最近一次 ping/pong 测得的往返时间；尚未测得时为 0。
+func (c *ServerConn) RTT() time.Duration { return time.Duration(c.framer.rtt.Load()) }
+
+// pingLoop 每隔 interval 向客户端发送 ping，直到连接关闭。
+func (c *ServerConn) pingLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.framer.ping(c.ws, c.writeTimeout); err != nil {
+				_ = c.closeWithReason(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// RTT 返回最近一次 ping/pong 测得的往返时间；尚未测得时为 0。
+func (c *BitSealWSConn) RTT() time.Duration { return time.Duration(c.framing().rtt.Load()) }
+
+// pingLoop 每隔 interval 向服务器发送 ping，直到连接关闭。
+func (c *BitSealWSConn) pingLoop(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.framing().ping(c.Conn, 0); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package bitsealws_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+func TestHeartbeatRTT(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.PingInterval = 20 * time.Millisecond
+		s.OnMessage = nil // echo
+	})
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWSWithOptions(clientPriv, serverPriv.PubKey(), wsURL, ws.ConnectOptions{PingInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := waitConns(t, server, clientPriv.PubKey(), 1)[0]
+
+	// Control records never surface from Read.
+	msgs := make(chan []byte, 1)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := c.Read()
+			if err != nil {
+				errs <- err
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.RTT() == 0 || conn.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no RTT measured: client %v, server %v", c.RTT(), conn.RTT())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Write([]byte("ping?")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-msgs:
+		if string(msg) != "ping?" {
+			t.Fatalf("echo %q", msg)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo")
+	}
+
+	// Both sides keep pinging, so the connection outlives several idle periods.
+	time.Sleep(150 * time.Millisecond)
+	if len(server.Conns(clientPriv.PubKey())) != 1 {
+		t.Fatal("heartbeating connection was closed")
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) { s.IdleTimeout = 100 * time.Millisecond })
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitConns(t, server, clientPriv.PubKey(), 1)
+	waitConns(t, server, clientPriv.PubKey(), 0)
+	if _, err := readWithin(c, 5*time.Second); err == nil {
+		t.Fatal("idle connection still open")
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, nil)
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWSWithOptions(clientPriv, serverPriv.PubKey(), wsURL, ws.ConnectOptions{IdleTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Read(); !errors.Is(err, ws.ErrIdleTimeout) {
+		t.Fatalf("Read: %v", err)
+	}
+	waitConns(t, server, clientPriv.PubKey(), 0)
+}
+
+func TestPongQueued(t *testing.T) {
+	got := make(chan string, 16)
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.SendQueueSize = 4
+		s.Overflow = ws.OverflowDrop
+		s.WriteTimeout = 30 * time.Second
+		s.OnMessage = func(sess *rtc.Session, plain []byte) ([]byte, error) {
+			got <- string(plain)
+			return nil, nil
+		}
+	})
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWSWithOptions(clientPriv, serverPriv.PubKey(), wsURL, ws.ConnectOptions{PingInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := waitConns(t, server, clientPriv.PubKey(), 1)[0]
+
+	// The client never reads, so the server's writer blocks on the socket.
+	// Pings keep arriving; answering them must not stall the read loop.
+	big := make([]byte, 256*1024)
+	for end := time.Now().Add(500 * time.Millisecond); time.Now().Before(end); {
+		if err := conn.Send(big); err != nil && !errors.Is(err, ws.ErrQueueFull) {
+			t.Fatal(err)
+		}
+	}
+	if st := conn.Stats(); st.Dropped == 0 {
+		t.Fatalf("send queue never filled (stats %+v)", st)
+	}
+	if err := c.Write([]byte("still reading")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-got:
+		if msg != "still reading" {
+			t.Fatalf("got %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server read loop blocked behind a pong")
+	}
+}
@@ -0,0 +1,97 @@
+package bitsealws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+)
+
+// BitSeal-WEB §10 错误码，用于 HandshakeError.Code。
+const (
+	CodeMalformed     = "B001" // 400 请求头缺失或格式错误
+	CodeBadSignature  = "B002" // 401 签名验证失败
+	CodeStale         = "B003" // 401 时间戳 / nonce 无效
+	CodeQuotaExceeded = "B010" // 402 匿名额度超限，需 KYC
+	CodeRevoked       = "B011" // 403 地址已吊销
+	CodeBanned        = "B012" // 403 地址已封禁
+	CodeInternal      = "B099" // 500 服务器内部错误
+)
+
+// HandshakeError 由握手阶段的回调返回以拒绝握手，并指定 HTTP 状态码与 B 系列错误码。
+// 响应体为 JSON：{"code":"B012","message":"..."}。
+type HandshakeError struct {
+	Status  int    // HTTP 状态码；0 表示 403
+	Code    string // B 系列错误码，可为空
+	Message string
+}
+
+func (e *HandshakeError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("handshake rejected: %s %s", e.Code, e.Message)
+	}
+	return "handshake rejected: " + e.Message
+}
+
+// writeHandshakeError 按 err 写出拒绝响应；非 *HandshakeError 的错误按 403 处理。
+func writeHandshakeError(w http.ResponseWriter, err error) {
+	var he *HandshakeError
+	if !errors.As(err, &he) {
+		he = &HandshakeError{Message: err.Error()}
+	}
+	status := he.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	body, _ := json.Marshal(struct {
+		Code    string `json:"code,omitempty"`
+		Message string `json:"message"`
+	}{he.Code, he.Message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// HandshakeInfo 为 Hooks.OnHandshake 的参数：即将签发给客户端的令牌声明与响应附加字段。
+type HandshakeInfo struct {
+	PeerPub    *ec.PublicKey
+	RemoteAddr string
+	Request    *http.Request
+	// Claims 为 SimpleToken 的声明，Extra 为 OnHandshakeResponse 附加到响应中的字段；
+	// Upgrade 后可通过 ServerConn.Claims / ServerConn.Extra 读取。
+	Claims map[string]any
+	Extra  map[string]any
+}
+
+// CloseError 表示服务端以指定 Close Code 关闭了连接（见 ServerConn.CloseWithCode）。
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Hooks 为连接生命周期回调，均可为 nil；除 OnHandshake 外不影响服务器行为，
+// 适合审计、统计与清理。回调在连接的读 goroutine 中同步执行，不应长时间阻塞。
+type Hooks struct {
+	// OnHandshake 在客户端签名验证通过、签发令牌之前调用；返回 error 即拒绝握手，
+	// *HandshakeError 可指定状态码与 B 系列错误码，其他 error 按 403 返回。
+	OnHandshake func(info *HandshakeInfo) error
+
+	// OnConnect 在连接登记完成、开始接收消息前调用。
+	OnConnect func(c *ServerConn)
+
+	// OnDisconnect 在连接移除后调用。reason 为关闭原因：客户端关闭时为读取错误（通常是 io.EOF），
+	// 服务端以 Close Code 关闭时为 *CloseError，发送失败时为对应错误，ServerConn.Close 为 ErrConnClosed。
+	OnDisconnect func(c *ServerConn, reason error)
+
+	// OnDecodeError 在收到的帧无法解密或重组时调用；该帧被丢弃，连接继续。
+	OnDecodeError func(c *ServerConn, err error)
+
+	// OnMessageError 在 OnMessage 返回错误时调用；该消息不回复，连接继续。
+	OnMessageError func(c *ServerConn, err error)
+}
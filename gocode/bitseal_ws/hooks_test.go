@@ -0,0 +1,124 @@
+package bitsealws_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+
+	"golang.org/x/net/websocket"
+)
+
+type hookEvent struct {
+	name   string
+	conn   *ws.ServerConn
+	reason error
+}
+
+func TestHooks(t *testing.T) {
+	banned := fixedPriv(0x44).PubKey()
+	events := make(chan hookEvent, 16)
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.OnHandshakeResponse = func(r *http.Request, clientPub *ec.PublicKey, nonce string) map[string]any {
+			return map[string]any{"welcome": "hello"}
+		}
+		s.OnMessage = func(sess *rtc.Session, plain []byte) ([]byte, error) {
+			if string(plain) == "bad" {
+				return nil, errors.New("bad message")
+			}
+			return plain, nil
+		}
+		s.Hooks = ws.Hooks{
+			OnHandshake: func(info *ws.HandshakeInfo) error {
+				if info.PeerPub.IsEqual(banned) {
+					return &ws.HandshakeError{Code: ws.CodeBanned, Message: "address banned"}
+				}
+				if info.Extra["welcome"] != "hello" || info.Claims["nonce"] == nil {
+					t.Errorf("handshake info %+v", info)
+				}
+				return nil
+			},
+			OnConnect:      func(c *ws.ServerConn) { events <- hookEvent{name: "connect", conn: c} },
+			OnDisconnect:   func(c *ws.ServerConn, reason error) { events <- hookEvent{"disconnect", c, reason} },
+			OnDecodeError:  func(c *ws.ServerConn, err error) { events <- hookEvent{"decode", c, err} },
+			OnMessageError: func(c *ws.ServerConn, err error) { events <- hookEvent{"message", c, err} },
+		}
+	})
+	next := func(name string) hookEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.name != name {
+				t.Fatalf("got %s hook, want %s", ev.name, name)
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s hook", name)
+			return hookEvent{}
+		}
+	}
+
+	_, err := ws.ConnectBitSealWS(fixedPriv(0x44), serverPriv.PubKey(), wsURL)
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), ws.CodeBanned) {
+		t.Fatalf("banned key: %v", err)
+	}
+
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := next("connect").conn
+	if !conn.PeerPub().IsEqual(clientPriv.PubKey()) || conn.RemoteAddr() == "" {
+		t.Fatalf("connect handle: %x %q", conn.PeerPub().Compressed(), conn.RemoteAddr())
+	}
+	if conn.Extra()["welcome"] != "hello" || conn.Claims()["nonce"] == nil {
+		t.Fatalf("claims %v, extra %v", conn.Claims(), conn.Extra())
+	}
+
+	// A frame that fails to decrypt is reported and skipped.
+	if err := websocket.Message.Send(c.Conn, make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next("decode"); ev.conn != conn || ev.reason == nil {
+		t.Fatalf("decode hook %+v", ev)
+	}
+	if err := c.Write([]byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next("message"); ev.reason == nil || ev.reason.Error() != "bad message" {
+		t.Fatalf("message hook %+v", ev)
+	}
+	if err := c.Write([]byte("good")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readWithin(c, 5*time.Second); err != nil || string(msg) != "good" {
+		t.Fatalf("after errors: %q, %v", msg, err)
+	}
+
+	c.Close()
+	if ev := next("disconnect"); ev.conn != conn || !errors.Is(ev.reason, io.EOF) {
+		t.Fatalf("client close reason: %v", ev.reason)
+	}
+
+	// Server-initiated closes report the close code.
+	c2, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	conn = next("connect").conn
+	_ = conn.CloseWithCode(ws.CloseConnLimit, "kicked")
+	var ce *ws.CloseError
+	if ev := next("disconnect"); !errors.As(ev.reason, &ce) || ce.Code != ws.CloseConnLimit {
+		t.Fatalf("server close reason: %v", ev.reason)
+	}
+	waitConns(t, server, clientPriv.PubKey(), 0)
+}
@@ -0,0 +1,107 @@
+package bitsealws_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+func TestMountedHandlers(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		mount func(s *ws.Server) http.Handler
+		path  string // wsURL path
+		opts  ws.ConnectOptions
+	}{
+		{"prefix", func(s *ws.Server) http.Handler {
+			mux := http.NewServeMux()
+			mux.Handle("/api/v2/ws/handshake", s.HandshakeHandler())
+			mux.Handle("GET /api/v2/ws/socket", s.SocketHandler())
+			return mux
+		}, "/api/v2/ws/socket", ws.ConnectOptions{}},
+		{"strip-prefix", func(s *ws.Server) http.Handler {
+			s.HandshakePath = "/api/v2/ws/handshake"
+			inner := http.NewServeMux()
+			inner.Handle("/handshake", s.HandshakeHandler())
+			inner.Handle("/socket", s.SocketHandler())
+			mux := http.NewServeMux()
+			mux.Handle("/api/v2/ws/", http.StripPrefix("/api/v2/ws", inner))
+			return mux
+		}, "/api/v2/ws/socket", ws.ConnectOptions{}},
+		{"custom-paths", func(s *ws.Server) http.Handler {
+			s.HandshakePath = "/hs"
+			s.SocketPath = "/sock"
+			return s
+		}, "/sock", ws.ConnectOptions{HandshakePath: "/hs"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverPriv := fixedPriv(0x55)
+			server := ws.NewServer(serverPriv, nil)
+			server.OnMessage = nil // echo
+			ts := httptest.NewServer(tc.mount(server))
+			defer ts.Close()
+			wsURL := "ws://" + strings.TrimPrefix(ts.URL, "http://") + tc.path
+
+			c, err := ws.ConnectBitSealWSWithOptions(fixedPriv(0x33), serverPriv.PubKey(), wsURL, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := readWithin(c, 2*time.Second); err != nil || string(got) != "ping" {
+				t.Fatalf("echo %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestHandshakePathSigned(t *testing.T) {
+	// A handshake signed for one path is rejected when replayed against another.
+	serverPriv := fixedPriv(0x55)
+	server := ws.NewServer(serverPriv, nil)
+	server.HandshakePath = "/a/handshake"
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	wsURL := "ws://" + strings.TrimPrefix(ts.URL, "http://") + "/ws/socket"
+	c, err := ws.ConnectBitSealWSWithOptions(fixedPriv(0x33), serverPriv.PubKey(), wsURL, ws.ConnectOptions{HandshakePath: "/a/handshake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	post := func(body string, headers map[string]string) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/a/handshake", strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	body, headers, err := ws.BuildHandshakeRequest(fixedPriv(0x33), serverPriv.PubKey(), "00112233", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post(body, headers) == http.StatusOK {
+		t.Fatal("handshake signed for /ws/handshake accepted on /a/handshake")
+	}
+
+	body, headers, err = ws.BuildHandshakeRequestWithPath(fixedPriv(0x34), serverPriv.PubKey(), "/a/handshake", "00112233", "", rtc.FragOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := post(body, headers); code != http.StatusOK {
+		t.Fatalf("handshake signed for /a/handshake rejected: %d", code)
+	}
+}
@@ -0,0 +1,312 @@
+package bitsealws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	"go.uber.org/zap"
+)
+
+// 主题订阅（BitSeal-WS §8.2）基于 RPC 层的保留方法：
+//
+//	bitseal.subscribe   {"topic":"room/1"} → 当前订阅者公钥（hex）列表
+//	bitseal.unsubscribe {"topic":"room/1"} → null
+//	bitseal.message     通知 {"topic":"room/1","data":<JSON>}           （Server.Publish）
+//	bitseal.presence    通知 {"topic":"room/1","peer":"02..","event":"join"|"leave"}
+//
+// 保留方法不需要 Server.Handle 注册；未使用时服务器行为不变。
+// 客户端之间的消息转发由业务层决定，例如注册一个调用 Publish 的 RPC 方法。
+
+// 保留的 RPC 方法名。
+const (
+	MethodSubscribe   = "bitseal.subscribe"
+	MethodUnsubscribe = "bitseal.unsubscribe"
+	NotifyMessage     = "bitseal.message"
+	NotifyPresence    = "bitseal.presence"
+)
+
+// Presence 事件类型。
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// MaxTopicLen 限制主题名长度。
+const MaxTopicLen = 256
+
+// RPCTopicDenied 为 AuthorizeTopic 拒绝订阅时返回的 RPC 错误码
+// （JSON-RPC 实现自定义区间 -32000..-32099）。
+const RPCTopicDenied = -32001
+
+// RPCTooManyTopics 表示客户端订阅的主题数已达 Server.MaxTopicsPerClient。
+const RPCTooManyTopics = -32002
+
+// DefaultMaxTopicsPerClient 为 Server.MaxTopicsPerClient 为 0 时每个公钥可订阅的主题数上限。
+const DefaultMaxTopicsPerClient = 256
+
+var errTooManyTopics = errors.New("too many topics")
+
+// TopicMessage 为 bitseal.message 通知的 params。
+type TopicMessage struct {
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// PresenceEvent 为 bitseal.presence 通知的 params；Peer 为压缩公钥 hex。
+type PresenceEvent struct {
+	Topic string `json:"topic"`
+	Peer  string `json:"peer"`
+	Event string `json:"event"`
+}
+
+type topicParams struct {
+	Topic string `json:"topic"`
+}
+
+func validTopic(topic string) error {
+	if topic == "" || len(topic) > MaxTopicLen {
+		return fmt.Errorf("topic length must be 1..%d", MaxTopicLen)
+	}
+	if strings.ContainsAny(topic, "\x00\r\n") {
+		return errors.New("topic contains control characters")
+	}
+	return nil
+}
+
+// builtinRPC 返回保留方法的处理函数；不是保留方法则返回 nil。
+func (s *Server) builtinRPC(method string) RPCHandler {
+	switch method {
+	case MethodSubscribe:
+		return s.rpcSubscribe
+	case MethodUnsubscribe:
+		return s.rpcUnsubscribe
+	}
+	return nil
+}
+
+func (s *Server) rpcSubscribe(ctx context.Context, call *RPCCall) (any, error) {
+	var p topicParams
+	if err := call.Bind(&p); err != nil {
+		return nil, err
+	}
+	if err := validTopic(p.Topic); err != nil {
+		return nil, &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+	}
+	if s.AuthorizeTopic != nil {
+		if err := s.AuthorizeTopic(call.PeerPub, p.Topic); err != nil {
+			if s.logger != nil {
+				s.logger.Info("topic subscription denied", zap.String("topic", p.Topic), zap.Error(err))
+			}
+			return nil, &RPCError{Code: RPCTopicDenied, Message: err.Error()}
+		}
+	}
+	if err := s.subscribe(call.PeerPub, p.Topic, s.maxTopicsPerClient()); err != nil {
+		return nil, &RPCError{Code: RPCTooManyTopics, Message: err.Error()}
+	}
+	if err := ctx.Err(); err != nil {
+		// 连接已在处理期间关闭；若该公钥已无连接，unsubscribeAll 可能已执行过
+		if len(s.Conns(call.PeerPub)) == 0 {
+			s.Unsubscribe(call.PeerPub, p.Topic)
+		}
+		return nil, err
+	}
+	members := []string{}
+	for _, pub := range s.Subscribers(p.Topic) {
+		members = append(members, fmt.Sprintf("%x", pub.Compressed()))
+	}
+	return members, nil
+}
+
+func (s *Server) rpcUnsubscribe(ctx context.Context, call *RPCCall) (any, error) {
+	var p topicParams
+	if err := call.Bind(&p); err != nil {
+		return nil, err
+	}
+	s.Unsubscribe(call.PeerPub, p.Topic)
+	return nil, nil
+}
+
+// Subscribe 将客户端加入主题（不经 AuthorizeTopic 与 MaxTopicsPerClient），并向其他订阅者发送 join 事件。
+// 订阅按公钥记录：该公钥的所有连接都会收到主题消息，最后一条连接断开时自动退出所有主题。
+func (s *Server) Subscribe(peerPub *ec.PublicKey, topic string) {
+	_ = s.subscribe(peerPub, topic, 0)
+}
+
+// subscribe 实现 Subscribe；limit 大于 0 时，已订阅 limit 个主题的公钥不能再加入新主题。
+func (s *Server) subscribe(peerPub *ec.PublicKey, topic string, limit int) error {
+	key := fmt.Sprintf("%x", peerPub.Compressed())
+	s.mu.Lock()
+	if s.topics == nil {
+		s.topics = make(map[string]map[string]*ec.PublicKey)
+		s.topicCount = make(map[string]int)
+	}
+	members := s.topics[topic]
+	_, already := members[key]
+	if !already && limit > 0 && s.topicCount[key] >= limit {
+		s.mu.Unlock()
+		return errTooManyTopics
+	}
+	if members == nil {
+		members = make(map[string]*ec.PublicKey)
+		s.topics[topic] = members
+	}
+	members[key] = peerPub
+	if !already {
+		s.topicCount[key]++
+	}
+	s.mu.Unlock()
+	if !already {
+		s.presence(topic, peerPub, true)
+	}
+	return nil
+}
+
+func (s *Server) maxTopicsPerClient() int {
+	if s.MaxTopicsPerClient > 0 {
+		return s.MaxTopicsPerClient
+	}
+	return DefaultMaxTopicsPerClient
+}
+
+// Unsubscribe 将客户端移出主题，并向其余订阅者发送 leave 事件。
+func (s *Server) Unsubscribe(peerPub *ec.PublicKey, topic string) {
+	key := fmt.Sprintf("%x", peerPub.Compressed())
+	s.mu.Lock()
+	members := s.topics[topic]
+	_, ok := members[key]
+	delete(members, key)
+	if len(members) == 0 {
+		delete(s.topics, topic)
+	}
+	if ok {
+		if s.topicCount[key]--; s.topicCount[key] == 0 {
+			delete(s.topicCount, key)
+		}
+	}
+	s.mu.Unlock()
+	if ok {
+		s.presence(topic, peerPub, false)
+	}
+}
+
+// unsubscribeAll 在连接关闭时调用。
+func (s *Server) unsubscribeAll(peerPub *ec.PublicKey) {
+	key := fmt.Sprintf("%x", peerPub.Compressed())
+	var left []string
+	s.mu.Lock()
+	for topic, members := range s.topics {
+		if _, ok := members[key]; ok {
+			left = append(left, topic)
+		}
+	}
+	s.mu.Unlock()
+	for _, topic := range left {
+		s.Unsubscribe(peerPub, topic)
+	}
+}
+
+// Subscribers 返回主题当前的订阅者，按公钥排序。
+func (s *Server) Subscribers(topic string) []*ec.PublicKey {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.topics[topic]))
+	for k := range s.topics[topic] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*ec.PublicKey, len(keys))
+	for i, k := range keys {
+		out[i] = s.topics[topic][k]
+	}
+	s.mu.Unlock()
+	return out
+}
+
+// Publish 将 data（JSON 编码；已编码的可传 json.RawMessage）作为 bitseal.message
+// 通知发给主题的每个订阅者，每个接收方用各自的会话加密。
+// 返回成功入队的订阅者数量；单个订阅者发送失败不影响其他人。
+// Publish 不等待发送队列：队列已满的订阅者（无论 Overflow 策略）收不到该消息，计入其 Dropped。
+func (s *Server) Publish(topic string, data any) (int, error) {
+	raw, err := encodeParams(data)
+	if err != nil {
+		return 0, err
+	}
+	if raw == nil {
+		raw = json.RawMessage("null")
+	}
+	return s.broadcast(topic, nil, NotifyMessage, TopicMessage{Topic: topic, Data: raw}), nil
+}
+
+func (s *Server) presence(topic string, peerPub *ec.PublicKey, joined bool) {
+	ev := PresenceEvent{Topic: topic, Peer: fmt.Sprintf("%x", peerPub.Compressed()), Event: PresenceLeave}
+	if joined {
+		ev.Event = PresenceJoin
+	}
+	s.broadcast(topic, peerPub, NotifyPresence, ev)
+	if s.OnPresence != nil {
+		s.OnPresence(topic, peerPub, joined)
+	}
+}
+
+// broadcast 向主题订阅者（except 除外）发送通知，返回至少一条连接入队成功的订阅者数量。
+// 入队不阻塞：presence 事件在订阅与断开路径上同步发送，一个停止读取的订阅者不能拖住它们。
+func (s *Server) broadcast(topic string, except *ec.PublicKey, method string, params any) int {
+	raw, _ := json.Marshal(params)
+	msg := marshalRPC(&rpcMessage{Method: method, Params: raw})
+	sent := 0
+	for _, pub := range s.Subscribers(topic) {
+		if except != nil && pub.IsEqual(except) {
+			continue
+		}
+		ok := false
+		for _, c := range s.Conns(pub) {
+			if err := c.trySend(msg); err == nil {
+				ok = true
+			} else if s.logger != nil {
+				s.logger.Warn("topic notification dropped", zap.String("topic", topic), zap.Uint64("conn", c.id), zap.Error(err))
+			}
+		}
+		if ok {
+			sent++
+		}
+	}
+	return sent
+}
+
+// ---------- Client ----------
+
+// Subscribe 订阅主题，返回包括自己在内的当前订阅者公钥（hex）。
+// 主题消息与 presence 事件以 bitseal.message / bitseal.presence 通知交给 OnNotify，
+// 可用 ParseTopicMessage / ParsePresence 解析。
+func (c *RPCClient) Subscribe(ctx context.Context, topic string) ([]string, error) {
+	var members []string
+	if err := c.Call(ctx, MethodSubscribe, topicParams{Topic: topic}, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Unsubscribe 退出主题。
+func (c *RPCClient) Unsubscribe(ctx context.Context, topic string) error {
+	return c.Call(ctx, MethodUnsubscribe, topicParams{Topic: topic}, nil)
+}
+
+// ParseTopicMessage 解析 bitseal.message 通知；method 不匹配时 ok 为 false。
+func ParseTopicMessage(method string, params json.RawMessage) (msg TopicMessage, ok bool) {
+	if method != NotifyMessage || json.Unmarshal(params, &msg) != nil {
+		return TopicMessage{}, false
+	}
+	return msg, true
+}
+
+// ParsePresence 解析 bitseal.presence 通知；method 不匹配时 ok 为 false。
+func ParsePresence(method string, params json.RawMessage) (ev PresenceEvent, ok bool) {
+	if method != NotifyPresence || json.Unmarshal(params, &ev) != nil {
+		return PresenceEvent{}, false
+	}
+	return ev, true
+}
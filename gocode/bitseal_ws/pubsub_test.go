@@ -0,0 +1,181 @@
+package bitsealws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+type notification struct {
+	method string
+	params json.RawMessage
+}
+
+func dialRPC(t *testing.T, wsURL string, serverPub *ec.PublicKey, priv *ec.PrivateKey) (*ws.RPCClient, chan notification) {
+	t.Helper()
+	conn, err := ws.ConnectBitSealWS(priv, serverPub, wsURL)
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	notes := make(chan notification, 16)
+	c := ws.NewRPCClientWith(conn, func(method string, params json.RawMessage) {
+		notes <- notification{method, params}
+	}, nil)
+	t.Cleanup(func() { c.Close() })
+	return c, notes
+}
+
+func nextNote(t *testing.T, notes chan notification) notification {
+	t.Helper()
+	select {
+	case n := <-notes:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+		return notification{}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	serverPriv := fixedPriv(0x55)
+	server := ws.NewServer(serverPriv, nil)
+	server.AuthorizeTopic = func(peerPub *ec.PublicKey, topic string) error {
+		if strings.HasPrefix(topic, "admin/") {
+			return errors.New("admins only")
+		}
+		return nil
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	httpURL, _ := url.Parse(ts.URL)
+	wsURL := "ws://" + httpURL.Host + "/ws/socket"
+	ctx := context.Background()
+
+	privA, privB := fixedPriv(0x33), fixedPriv(0x44)
+	hexA := fmt.Sprintf("%x", privA.PubKey().Compressed())
+	hexB := fmt.Sprintf("%x", privB.PubKey().Compressed())
+	a, notesA := dialRPC(t, wsURL, serverPriv.PubKey(), privA)
+	b, notesB := dialRPC(t, wsURL, serverPriv.PubKey(), privB)
+
+	var rpcErr *ws.RPCError
+	if _, err := a.Subscribe(ctx, "admin/logs"); !errors.As(err, &rpcErr) || rpcErr.Code != ws.RPCTopicDenied {
+		t.Fatalf("denied topic: %v", err)
+	}
+
+	members, err := a.Subscribe(ctx, "room/1")
+	if err != nil || len(members) != 1 || members[0] != hexA {
+		t.Fatalf("first subscribe: %v, %v", members, err)
+	}
+	members, err = b.Subscribe(ctx, "room/1")
+	if err != nil || len(members) != 2 {
+		t.Fatalf("second subscribe: %v, %v", members, err)
+	}
+	n := nextNote(t, notesA)
+	if ev, ok := ws.ParsePresence(n.method, n.params); !ok || ev.Peer != hexB || ev.Event != ws.PresenceJoin {
+		t.Fatalf("join event %s %s", n.method, n.params)
+	}
+
+	sent, err := server.Publish("room/1", map[string]string{"text": "hello"})
+	if err != nil || sent != 2 {
+		t.Fatalf("Publish sent %d, %v", sent, err)
+	}
+	for _, notes := range []chan notification{notesA, notesB} {
+		n := nextNote(t, notes)
+		msg, ok := ws.ParseTopicMessage(n.method, n.params)
+		if !ok || msg.Topic != "room/1" || string(msg.Data) != `{"text":"hello"}` {
+			t.Fatalf("topic message %s %s", n.method, n.params)
+		}
+	}
+
+	// Disconnecting leaves every topic.
+	b.Close()
+	n = nextNote(t, notesA)
+	if ev, ok := ws.ParsePresence(n.method, n.params); !ok || ev.Peer != hexB || ev.Event != ws.PresenceLeave {
+		t.Fatalf("leave event %s %s", n.method, n.params)
+	}
+	if subs := server.Subscribers("room/1"); len(subs) != 1 {
+		t.Fatalf("subscribers after leave: %d", len(subs))
+	}
+
+	if err := a.Unsubscribe(ctx, "room/1"); err != nil {
+		t.Fatal(err)
+	}
+	if sent, _ := server.Publish("room/1", "x"); sent != 0 {
+		t.Fatalf("Publish after unsubscribe sent %d", sent)
+	}
+}
+
+func TestTopicLimit(t *testing.T) {
+	_, serverPriv, wsURL := startServer(t, func(s *ws.Server) { s.MaxTopicsPerClient = 2 })
+	c, _ := dialRPC(t, wsURL, serverPriv.PubKey(), fixedPriv(0x33))
+	ctx := context.Background()
+	for _, topic := range []string{"a", "b", "a"} {
+		if _, err := c.Subscribe(ctx, topic); err != nil {
+			t.Fatalf("subscribe %s: %v", topic, err)
+		}
+	}
+	var rpcErr *ws.RPCError
+	if _, err := c.Subscribe(ctx, "c"); !errors.As(err, &rpcErr) || rpcErr.Code != ws.RPCTooManyTopics {
+		t.Fatalf("third topic: %v", err)
+	}
+	if err := c.Unsubscribe(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Subscribe(ctx, "c"); err != nil {
+		t.Fatalf("after unsubscribe: %v", err)
+	}
+}
+
+func TestPublishSlowSubscriber(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.SendQueueSize = 4
+		s.Overflow = ws.OverflowBlock
+	})
+	slowPriv := fixedPriv(0x44)
+	slow, err := ws.ConnectBitSealWS(slowPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slowConn := waitConns(t, server, slowPriv.PubKey(), 1)[0]
+	server.Subscribe(slowPriv.PubKey(), "room")
+
+	fast, notes := dialRPC(t, wsURL, serverPriv.PubKey(), fixedPriv(0x33))
+	if _, err := fast.Subscribe(context.Background(), "room"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The slow client never reads; with OverflowBlock a blocking fan-out would
+	// stall here once its queue and socket buffers fill.
+	big := strings.Repeat("x", 256*1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 64; i++ {
+			_, _ = server.Publish("room", big)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Publish blocked on a stalled subscriber")
+	}
+	if st := slowConn.Stats(); st.Dropped == 0 {
+		t.Fatalf("slow subscriber stats %+v", st)
+	}
+	for {
+		n := nextNote(t, notes)
+		if m, ok := ws.ParseTopicMessage(n.method, n.params); ok && m.Topic == "room" {
+			break
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package bitsealws_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+// stall fills a connection whose client never reads until Send fails.
+func stall(t *testing.T, conn *ws.ServerConn, send func([]byte) error) error {
+	t.Helper()
+	big := make([]byte, 256*1024)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := send(big); err != nil {
+			return err
+		}
+	}
+	t.Fatalf("send queue never filled (stats %+v)", conn.Stats())
+	return nil
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy ws.OverflowPolicy
+	}{
+		{"drop", ws.OverflowDrop},
+		{"disconnect", ws.OverflowDisconnect},
+		{"block", ws.OverflowBlock},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+				s.SendQueueSize = 4
+				s.Overflow = tc.policy
+			})
+			slowPriv, fastPriv := fixedPriv(0x33), fixedPriv(0x44)
+			slow, err := ws.ConnectBitSealWS(slowPriv, serverPriv.PubKey(), wsURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer slow.Close()
+			fast, err := ws.ConnectBitSealWS(fastPriv, serverPriv.PubKey(), wsURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fast.Close()
+			conn := waitConns(t, server, slowPriv.PubKey(), 1)[0]
+			waitConns(t, server, fastPriv.PubKey(), 1)
+
+			var err2 error
+			if tc.policy == ws.OverflowBlock {
+				err2 = stall(t, conn, func(b []byte) error {
+					ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+					defer cancel()
+					return server.SendToContext(ctx, slowPriv.PubKey(), b)
+				})
+				if !errors.Is(err2, context.DeadlineExceeded) {
+					t.Fatalf("blocked send: %v", err2)
+				}
+			} else {
+				err2 = stall(t, conn, conn.Send)
+				if !errors.Is(err2, ws.ErrQueueFull) {
+					t.Fatalf("overflow: %v", err2)
+				}
+				if st := conn.Stats(); st.Dropped == 0 || st.MaxQueued != 4 {
+					t.Fatalf("stats %+v", st)
+				}
+			}
+			if st := server.Stats(); st.Conns < 1 || st.MaxQueued != 4 {
+				t.Fatalf("server stats %+v", st)
+			}
+
+			// A stalled client does not hold up others.
+			if err := server.SendTo(fastPriv.PubKey(), []byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+			if msg, err := readWithin(fast, 5*time.Second); err != nil || string(msg) != "hi" {
+				t.Fatalf("fast client: %q, %v", msg, err)
+			}
+
+			if tc.policy == ws.OverflowDisconnect {
+				waitConns(t, server, slowPriv.PubKey(), 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package bitsealws
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Limiter 为可插拔的限流器，按 key 分别计数（IP、公钥或连接 ID）。
+// Take 尝试为 key 取 n 个令牌：允许时消耗并返回 ok=true；
+// 否则不消耗，返回预计需要等待的时间（<=0 表示未知，调用方自行退避）。
+// 实现必须可并发调用。
+type Limiter interface {
+	Take(key string, n int) (wait time.Duration, ok bool)
+}
+
+// RateAction 决定会话消息超出限额时的处理方式。
+type RateAction int
+
+const (
+	// RateDrop 丢弃超额的帧（不解密），连接继续（默认）。
+	RateDrop RateAction = iota
+	// RateDelay 暂停读取直到令牌足够，借 TCP 反压减慢客户端。
+	RateDelay
+	// RateClose 以 CloseQuotaExceeded 关闭连接。
+	RateClose
+)
+
+// RateLimits 配置服务器的限流，各 Limiter 为 nil 时不限制。
+type RateLimits struct {
+	// HandshakePerIP 按客户端 IP 限制 /ws/handshake，在验签之前检查；超限返回 429。
+	HandshakePerIP Limiter
+	// HandshakePerKey 按客户端公钥（压缩 hex）限制握手，在验签之后、ECDH 与签发令牌之前检查。
+	HandshakePerKey Limiter
+
+	// Messages 按连接限制收到的 WebSocket 帧数（每帧 1 个令牌，含分片与心跳）。
+	Messages Limiter
+	// Bytes 按连接限制收到的字节数（每帧按长度计）。
+	Bytes Limiter
+	// Action 为 Messages / Bytes 超限时的处理方式。
+	Action RateAction
+
+	// ClientIP 从请求中提取客户端 IP（例如在反向代理后读取 X-Forwarded-For）；
+	// 为 nil 时取 RemoteAddr 的主机部分。
+	ClientIP func(r *http.Request) string
+}
+
+func (l *RateLimits) clientIP(r *http.Request) string {
+	if l.ClientIP != nil {
+		return l.ClientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowHandshake 检查 lim；超限时写出 429 并返回 false。
+func (s *Server) allowHandshake(w http.ResponseWriter, lim Limiter, key string) bool {
+	if lim == nil {
+		return true
+	}
+	wait, ok := lim.Take(key, 1)
+	if ok {
+		return true
+	}
+	if s.logger != nil {
+		s.logger.Info("handshake rate limited", zap.String("key", key))
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	writeHandshakeError(w, &HandshakeError{Status: http.StatusTooManyRequests, Message: "too many handshakes"})
+	return false
+}
+
+// allowFrame 对连接收到的一帧计费；返回 false 表示该帧应丢弃或连接已关闭（closed=true）。
+func (s *Server) allowFrame(c *ServerConn, size int) (ok, closed bool) {
+	lim := &s.RateLimits
+	key := strconv.FormatUint(c.id, 10)
+	for _, t := range []struct {
+		l Limiter
+		n int
+	}{{lim.Messages, 1}, {lim.Bytes, size}} {
+		if t.l == nil {
+			continue
+		}
+		for {
+			wait, ok := t.l.Take(key, t.n)
+			if ok {
+				break
+			}
+			switch lim.Action {
+			case RateDelay:
+				if wait <= 0 {
+					wait = 10 * time.Millisecond
+				}
+				select {
+				case <-time.After(wait):
+					continue
+				case <-c.done:
+					return false, true
+				}
+			case RateClose:
+				if s.logger != nil {
+					s.logger.Info("message rate exceeded, closing connection", zap.Uint64("conn", c.id))
+				}
+				_ = c.CloseWithCode(CloseQuotaExceeded, "rate limit exceeded")
+				return false, true
+			default:
+				if s.logger != nil {
+					s.logger.Debug("message rate exceeded, dropping frame", zap.Uint64("conn", c.id))
+				}
+				return false, false
+			}
+		}
+	}
+	return true, false
+}
+
+// TokenBucket 为按 key 独立计数的令牌桶 Limiter：每个 key 的桶容量为 burst，
+// 每秒补充 rate 个令牌。单次请求超过 burst 时只要桶是满的即放行（随后欠账），
+// 因此大于 burst 的消息不会被永久拒绝。长时间空闲（桶已满）的 key 会被定期清理。
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket 创建令牌桶；rate 为每秒补充的令牌数，burst 为桶容量（至少为 1）。
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// Take 实现 Limiter。
+func (tb *TokenBucket) Take(key string, n int) (time.Duration, bool) {
+	now := time.Now()
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.sweep(now)
+	b := tb.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: tb.burst, last: now}
+		tb.buckets[key] = b
+	}
+	tb.refill(b, now)
+	need := math.Min(float64(n), tb.burst)
+	if b.tokens >= need {
+		b.tokens -= float64(n)
+		return 0, true
+	}
+	if tb.rate <= 0 {
+		return 0, false
+	}
+	return time.Duration((need - b.tokens) / tb.rate * float64(time.Second)), false
+}
+
+func (tb *TokenBucket) refill(b *bucket, now time.Time) {
+	b.tokens = math.Min(tb.burst, b.tokens+now.Sub(b.last).Seconds()*tb.rate)
+	b.last = now
+}
+
+// sweep 每分钟清理一次已回满的桶；调用方需持有 mu。
+func (tb *TokenBucket) sweep(now time.Time) {
+	if now.Sub(tb.lastSweep) < time.Minute {
+		return
+	}
+	tb.lastSweep = now
+	for k, b := range tb.buckets {
+		tb.refill(b, now)
+		if b.tokens >= tb.burst {
+			delete(tb.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package bitsealws_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := ws.NewTokenBucket(10, 2)
+	for i := 0; i < 2; i++ {
+		if _, ok := tb.Take("a", 1); !ok {
+			t.Fatalf("take %d denied", i)
+		}
+	}
+	wait, ok := tb.Take("a", 1)
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("empty bucket: wait %v, ok %v", wait, ok)
+	}
+	if _, ok := tb.Take("b", 1); !ok {
+		t.Fatal("keys are not independent")
+	}
+	time.Sleep(wait + 10*time.Millisecond)
+	if _, ok := tb.Take("a", 1); !ok {
+		t.Fatal("bucket did not refill")
+	}
+	// A request larger than the burst passes on a full bucket.
+	if _, ok := tb.Take("c", 5); !ok {
+		t.Fatal("oversized take denied on a full bucket")
+	}
+	if _, ok := tb.Take("c", 1); ok {
+		t.Fatal("oversized take did not drain the bucket")
+	}
+}
+
+func TestHandshakeRateLimit(t *testing.T) {
+	_, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.RateLimits.HandshakePerIP = ws.NewTokenBucket(0.01, 2)
+	})
+	for i := 0; i < 2; i++ {
+		c, err := ws.ConnectBitSealWS(fixedPriv(0x33), serverPriv.PubKey(), wsURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if _, err := ws.ConnectBitSealWS(fixedPriv(0x44), serverPriv.PubKey(), wsURL); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("third handshake: %v", err)
+	}
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		action ws.RateAction
+		rate   float64
+		echoes int
+	}{
+		{"drop", ws.RateDrop, 0.01, 2},
+		{"close", ws.RateClose, 0.01, 0}, // queued echoes are discarded on close
+		{"delay", ws.RateDelay, 20, 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+				s.OnMessage = nil // echo
+				s.RateLimits.Messages = ws.NewTokenBucket(tc.rate, 2)
+				s.RateLimits.Action = tc.action
+			})
+			clientPriv := fixedPriv(0x33)
+			c, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			start := time.Now()
+			for i := 0; i < 4; i++ {
+				if err := c.Write([]byte{byte('0' + i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tc.echoes; i++ {
+				if msg, err := readWithin(c, 5*time.Second); err != nil || msg[0] != byte('0'+i) {
+					t.Fatalf("echo %d: %q, %v", i, msg, err)
+				}
+			}
+			switch tc.action {
+			case ws.RateDrop:
+				if _, err := readWithin(c, 200*time.Millisecond); err == nil {
+					t.Fatal("over-limit message was processed")
+				}
+				if len(server.Conns(clientPriv.PubKey())) != 1 {
+					t.Fatal("connection closed on drop")
+				}
+			case ws.RateClose:
+				for i := 0; ; i++ {
+					if _, err := readWithin(c, 5*time.Second); err != nil {
+						break
+					}
+					if i == 2 {
+						t.Fatal("connection survived the limit")
+					}
+				}
+				waitConns(t, server, clientPriv.PubKey(), 0)
+			case ws.RateDelay:
+				if d := time.Since(start); d < 80*time.Millisecond {
+					t.Fatalf("delayed messages arrived after %v", d)
+				}
+			}
+		})
+	}
+}
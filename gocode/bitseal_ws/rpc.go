@@ -0,0 +1,382 @@
+package bitsealws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	"go.uber.org/zap"
+)
+
+// RPC 层（BitSeal-WS §8.1）：每条明文消息承载一个 JSON-RPC 2.0 对象。
+//
+//	请求   {"jsonrpc":"2.0","id":7,"method":"sum","params":[1,2]}
+//	响应   {"jsonrpc":"2.0","id":7,"result":3}
+//	错误   {"jsonrpc":"2.0","id":7,"error":{"code":-32601,"message":"method not found"}}
+//	通知   {"jsonrpc":"2.0","method":"tick","params":{...}}     // 无 id，不回复
+//
+// 服务端通过 Server.Handle 注册方法后，符合上述格式的消息交给对应处理函数
+// 并发执行（每条连接至多 Server.MaxInFlightRPC 个），其余消息仍走 OnMessage / 回显逻辑；
+// 未注册任何方法时行为不变。
+// 客户端 RPCClient 接管 BitSealWSConn 的读取，按 id 匹配响应，
+// 因此多个请求可以同时在途。批量请求（JSON 数组）不支持。
+
+// JSON-RPC 2.0 标准错误码。
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+)
+
+// RPCServerBusy 表示该连接在途的 RPC 调用已达 Server.MaxInFlightRPC，请求未被执行，可稍后重试。
+const RPCServerBusy = -32000
+
+// DefaultMaxInFlightRPC 为 Server.MaxInFlightRPC 为 0 时每条连接同时执行的 RPC 处理函数上限。
+const DefaultMaxInFlightRPC = 64
+
+// DefaultRPCTimeout 在 ctx 未设置截止时间时限制 RPCClient.Call 的等待时间。
+const DefaultRPCTimeout = 30 * time.Second
+
+// ErrRPCClosed 表示连接已关闭，在途调用全部以此失败。
+var ErrRPCClosed = errors.New("bitseal rpc: connection closed")
+
+// RPCError 是 JSON-RPC 错误对象；处理函数返回 *RPCError 时原样发给客户端，
+// 其他 error 则转换为 RPCInternalError。
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// RPCCall 描述一次收到的请求或通知。
+type RPCCall struct {
+	Method  string
+	Params  json.RawMessage
+	Session *rtc.Session
+	PeerPub *ec.PublicKey
+	// Conn 为收到请求的连接，可用于只回推给该连接（同一公钥可能有多条连接）。
+	Conn *ServerConn
+	// Notification 为 true 表示对方不等待回复（无 id）。
+	Notification bool
+}
+
+// Bind 将 params 解码到 v；失败时返回 RPCInvalidParams 错误。
+func (c *RPCCall) Bind(v any) error {
+	if len(c.Params) == 0 {
+		return &RPCError{Code: RPCInvalidParams, Message: "missing params"}
+	}
+	if err := json.Unmarshal(c.Params, v); err != nil {
+		return &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// RPCHandler 处理一个方法调用；返回值编码为 result（nil ⇒ null）。
+// ctx 在连接断开或超过 Server.RPCTimeout 时取消。
+type RPCHandler func(ctx context.Context, call *RPCCall) (any, error)
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// parseRPC 识别 JSON-RPC 2.0 对象；不是则返回 nil，交给普通消息处理。
+func parseRPC(plain []byte) *rpcMessage {
+	trimmed := bytes.TrimLeft(plain, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil
+	}
+	var m rpcMessage
+	if err := json.Unmarshal(trimmed, &m); err != nil || m.JSONRPC != "2.0" {
+		return nil
+	}
+	return &m
+}
+
+func marshalRPC(m *rpcMessage) []byte {
+	m.JSONRPC = "2.0"
+	b, _ := json.Marshal(m)
+	return b
+}
+
+func encodeParams(params any) (json.RawMessage, error) {
+	if params == nil {
+		return nil, nil
+	}
+	if raw, ok := params.(json.RawMessage); ok {
+		return raw, nil
+	}
+	return json.Marshal(params)
+}
+
+// ---------- Server ----------
+
+// Handle 注册 RPC 方法；h 为 nil 时移除该方法。
+func (s *Server) Handle(method string, h RPCHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h == nil {
+		delete(s.rpc, method)
+		return
+	}
+	if s.rpc == nil {
+		s.rpc = make(map[string]RPCHandler)
+	}
+	s.rpc[method] = h
+}
+
+// Notify 向指定客户端发送服务端通知（无 id 的 JSON-RPC 请求）。
+func (s *Server) Notify(peerPub *ec.PublicKey, method string, params any) error {
+	raw, err := encodeParams(params)
+	if err != nil {
+		return err
+	}
+	return s.SendTo(peerPub, marshalRPC(&rpcMessage{Method: method, Params: raw}))
+}
+
+// serveRPC 若 plain 是 JSON-RPC 消息则异步处理并返回 true。
+func (s *Server) serveRPC(ctx context.Context, conn *ServerConn, reply func([]byte) error, plain []byte) bool {
+	s.mu.Lock()
+	enabled := len(s.rpc) > 0
+	s.mu.Unlock()
+	m := parseRPC(plain)
+	if m == nil || (!enabled && s.builtinRPC(m.Method) == nil) {
+		return false
+	}
+	if m.Method == "" {
+		// 客户端不会向服务端发送响应；无 method 的对象视为非法请求。
+		if len(m.ID) > 0 {
+			_ = reply(marshalRPC(&rpcMessage{ID: m.ID, Error: &RPCError{Code: RPCInvalidRequest, Message: "missing method"}}))
+		}
+		return true
+	}
+	h := s.builtinRPC(m.Method)
+	if h == nil {
+		s.mu.Lock()
+		h = s.rpc[m.Method]
+		s.mu.Unlock()
+	}
+
+	call := &RPCCall{Method: m.Method, Params: m.Params, Session: conn.sess, PeerPub: conn.peerPub, Conn: conn, Notification: len(m.ID) == 0}
+	select {
+	case conn.rpcSlots <- struct{}{}:
+	default:
+		// 在途调用已满：请求立即以 RPCServerBusy 回复，通知直接丢弃；读循环不阻塞，ping 等控制记录照常处理。
+		if s.logger != nil {
+			s.logger.Warn("rpc in-flight limit reached", zap.String("method", m.Method), zap.Uint64("conn", conn.id))
+		}
+		if !call.Notification {
+			_ = reply(marshalRPC(&rpcMessage{ID: m.ID, Error: &RPCError{Code: RPCServerBusy, Message: "server busy"}}))
+		}
+		return true
+	}
+	s.handlers.Add(1) // 调用方已登记当前消息，计数不为 0，见 beginHandler
+	go func() {
+		defer s.handlers.Done()
+		defer func() { <-conn.rpcSlots }()
+		resp := &rpcMessage{ID: m.ID}
+		if h == nil {
+			resp.Error = &RPCError{Code: RPCMethodNotFound, Message: "method not found: " + m.Method}
+		} else {
+			hctx, cancel := ctx, context.CancelFunc(func() {})
+			if s.RPCTimeout > 0 {
+				hctx, cancel = context.WithTimeout(ctx, s.RPCTimeout)
+			}
+			result, err := h(hctx, call)
+			cancel()
+			resp.Result, resp.Error = rpcResult(result, err)
+		}
+		if call.Notification {
+			return
+		}
+		if err := reply(marshalRPC(resp)); err != nil && s.logger != nil {
+			s.logger.Warn("rpc reply failed", zap.String("method", m.Method), zap.Error(err))
+		}
+	}()
+	return true
+}
+
+func rpcResult(result any, err error) (json.RawMessage, *RPCError) {
+	if err != nil {
+		var re *RPCError
+		if errors.As(err, &re) {
+			return nil, re
+		}
+		return nil, &RPCError{Code: RPCInternalError, Message: err.Error()}
+	}
+	raw, err := encodeParams(result)
+	if err != nil {
+		return nil, &RPCError{Code: RPCInternalError, Message: err.Error()}
+	}
+	if raw == nil {
+		raw = json.RawMessage("null")
+	}
+	return raw, nil
+}
+
+// ---------- Client ----------
+
+// RPCClient 在 BitSealWSConn 上发起 JSON-RPC 调用。创建后由它独占连接的
+// Read；非 RPC 消息交给 OnMessage。所有方法可并发调用。
+type RPCClient struct {
+	conn *BitSealWSConn
+
+	// OnNotify 处理服务端通知，在读 goroutine 中调用，应尽快返回。
+	OnNotify func(method string, params json.RawMessage)
+	// OnMessage 处理非 JSON-RPC 的普通消息；nil 则丢弃。
+	OnMessage func(plain []byte)
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan *rpcMessage
+	err     error
+	done    chan struct{}
+}
+
+// NewRPCClient 包装已建立的连接并启动读循环。OnNotify / OnMessage
+// 需在收到第一条消息前设置，建议使用 NewRPCClientWith。
+func NewRPCClient(conn *BitSealWSConn) *RPCClient {
+	return NewRPCClientWith(conn, nil, nil)
+}
+
+// NewRPCClientWith 与 NewRPCClient 相同，但在读循环启动前设置回调。
+func NewRPCClientWith(conn *BitSealWSConn, onNotify func(method string, params json.RawMessage), onMessage func(plain []byte)) *RPCClient {
+	c := &RPCClient{
+		conn:      conn,
+		OnNotify:  onNotify,
+		OnMessage: onMessage,
+		pending:   make(map[string]chan *rpcMessage),
+		done:      make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *RPCClient) readLoop() {
+	for {
+		plain, err := c.conn.Read()
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		m := parseRPC(plain)
+		switch {
+		case m == nil:
+			if c.OnMessage != nil {
+				c.OnMessage(plain)
+			}
+		case m.Method != "":
+			if len(m.ID) > 0 {
+				// 暂不支持服务端发起的请求
+				_ = c.conn.Write(marshalRPC(&rpcMessage{ID: m.ID, Error: &RPCError{Code: RPCMethodNotFound, Message: "method not found: " + m.Method}}))
+			} else if c.OnNotify != nil {
+				c.OnNotify(m.Method, m.Params)
+			}
+		default:
+			c.mu.Lock()
+			ch := c.pending[string(m.ID)]
+			delete(c.pending, string(m.ID))
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- m
+			}
+		}
+	}
+}
+
+func (c *RPCClient) shutdown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = fmt.Errorf("%w: %v", ErrRPCClosed, err)
+	close(c.done)
+}
+
+// Call 发送请求并等待响应，将 result 解码到 reply（可为 nil）。
+// 服务端返回错误对象时 err 为 *RPCError。ctx 无截止时间时使用 DefaultRPCTimeout。
+func (c *RPCClient) Call(ctx context.Context, method string, args, reply any) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRPCTimeout)
+		defer cancel()
+	}
+	params, err := encodeParams(args)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *rpcMessage, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	c.nextID++
+	id := json.RawMessage(strconv.FormatUint(c.nextID, 10))
+	c.pending[string(id)] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, string(id))
+		c.mu.Unlock()
+	}()
+
+	if err := c.conn.Write(marshalRPC(&rpcMessage{ID: id, Method: method, Params: params})); err != nil {
+		return err
+	}
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if reply == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, reply)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return c.Err()
+	}
+}
+
+// Notify 发送通知，不等待回复。
+func (c *RPCClient) Notify(method string, params any) error {
+	raw, err := encodeParams(params)
+	if err != nil {
+		return err
+	}
+	return c.conn.Write(marshalRPC(&rpcMessage{Method: method, Params: raw}))
+}
+
+// Err 返回读循环结束的原因；连接正常时为 nil。
+func (c *RPCClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close 关闭底层连接，在途调用返回 ErrRPCClosed。
+func (c *RPCClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,171 @@
+package bitsealws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+func TestRPC(t *testing.T) {
+	serverPriv := fixedPriv(0x55)
+	server := ws.NewServer(serverPriv, nil)
+	server.Handle("sum", func(ctx context.Context, call *ws.RPCCall) (any, error) {
+		var args []int
+		if err := call.Bind(&args); err != nil {
+			return nil, err
+		}
+		total := 0
+		for _, v := range args {
+			total += v
+		}
+		return total, nil
+	})
+	server.Handle("sleep", func(ctx context.Context, call *ws.RPCCall) (any, error) {
+		var ms int
+		if err := call.Bind(&ms); err != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+			return ms, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+	server.Handle("subscribe", func(ctx context.Context, call *ws.RPCCall) (any, error) {
+		go server.Notify(call.PeerPub, "tick", map[string]int{"n": 1})
+		return nil, nil
+	})
+	server.Handle("deny", func(ctx context.Context, call *ws.RPCCall) (any, error) {
+		return nil, &ws.RPCError{Code: 4003, Message: "denied"}
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	httpURL, _ := url.Parse(ts.URL)
+	conn, err := ws.ConnectBitSealWS(fixedPriv(0x33), serverPriv.PubKey(), "ws://"+httpURL.Host+"/ws/socket")
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	notes := make(chan string, 1)
+	plain := make(chan string, 1)
+	client := ws.NewRPCClientWith(conn,
+		func(method string, params json.RawMessage) { notes <- method + string(params) },
+		func(msg []byte) { plain <- string(msg) })
+	defer client.Close()
+	ctx := context.Background()
+
+	var sum int
+	if err := client.Call(ctx, "sum", []int{1, 2, 3}, &sum); err != nil || sum != 6 {
+		t.Fatalf("sum = %d, %v", sum, err)
+	}
+
+	// Replies are matched by id, so a slow call does not block a fast one.
+	var wg sync.WaitGroup
+	got := make([]int, 2)
+	for i, ms := range []int{200, 10} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.Call(ctx, "sleep", ms, &got[i]); err != nil {
+				t.Errorf("sleep %d: %v", ms, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got[0] != 200 || got[1] != 10 {
+		t.Fatalf("sleep results %v", got)
+	}
+
+	var rpcErr *ws.RPCError
+	if err := client.Call(ctx, "nope", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != ws.RPCMethodNotFound {
+		t.Fatalf("unknown method: %v", err)
+	}
+	if err := client.Call(ctx, "deny", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != 4003 {
+		t.Fatalf("handler error: %v", err)
+	}
+	if err := client.Call(ctx, "sum", "x", nil); !errors.As(err, &rpcErr) || rpcErr.Code != ws.RPCInvalidParams {
+		t.Fatalf("bad params: %v", err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := client.Call(short, "sleep", 500, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("timeout: %v", err)
+	}
+
+	if err := client.Call(ctx, "subscribe", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notes:
+		if n != `tick{"n":1}` {
+			t.Fatalf("notification %q", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+
+	// Plain messages still go through the default echo path.
+	if err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-plain:
+		if m != "ping" {
+			t.Fatalf("plain echo %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no plain echo")
+	}
+
+	client.Close()
+	if err := client.Call(ctx, "sum", []int{1}, nil); err == nil {
+		t.Fatal("call succeeded after close")
+	}
+}
+
+func TestRPCInFlightLimit(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	_, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.MaxInFlightRPC = 1
+		s.Handle("wait", func(ctx context.Context, call *ws.RPCCall) (any, error) {
+			started <- struct{}{}
+			<-release
+			return "done", nil
+		})
+	})
+	conn, err := ws.ConnectBitSealWS(fixedPriv(0x33), serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ws.NewRPCClient(conn)
+	defer client.Close()
+	ctx := context.Background()
+
+	first := make(chan error, 1)
+	go func() { first <- client.Call(ctx, "wait", nil, nil) }()
+	<-started
+
+	// The only slot is taken, so the second request is refused rather than queued.
+	var rpcErr *ws.RPCError
+	if err := client.Call(ctx, "wait", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != ws.RPCServerBusy {
+		t.Fatalf("second call: %v", err)
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	// The slot is released once the handler returns.
+	if err := client.Call(ctx, "wait", nil, nil); err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+}
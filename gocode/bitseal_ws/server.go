@@ -1,6 +1,7 @@
 package bitsealws
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
@@ -23,21 +25,43 @@ import (
 // handshakeState keeps temporary info between POST /ws/handshake and subsequent GET /ws/socket.
 type handshakeState struct {
 	clientPub  *ec.PublicKey
-	clientSalt string // 4-byte hex string from client
-	serverSalt string // 4-byte hex string generated by server
+	clientSalt string          // 4-byte hex string from client
+	serverSalt string          // 4-byte hex string generated by server
+	frag       rtc.FragOptions // 协商后的分片参数
+	peerFrag   bool            // 客户端是否声明了分片参数（即支持分片）
+	heartbeat  bool            // 客户端是否声明支持心跳
+	extra      map[string]any  // OnHandshakeResponse 附加的响应字段
 	createdAt  time.Time
 }
 
+// DefaultHandshakePath 与 DefaultSocketPath 为握手与 Upgrade 的默认路径。
+const (
+	DefaultHandshakePath = "/ws/handshake"
+	DefaultSocketPath    = "/ws/socket"
+)
+
+// DefaultMaxReassemblyBytes 为 Server.MaxReassemblyBytes 为 0 时每条连接的重组缓冲上限。
+const DefaultMaxReassemblyBytes = 4 << 20
+
 // Server bundles server private key and an in-memory map for pending sessions.
 type Server struct {
 	priv    *ec.PrivateKey
 	pub     *ec.PublicKey
-	mux     *http.ServeMux
+	socket  http.Handler               // Step-2 的 websocket.Server
 	pending map[string]*handshakeState // keyed by nonce from Step-1
 	mu      sync.Mutex
 
-	// 保存已建立连接的客户端：压缩公钥 hex -> (session, websocket.Conn)
-	clients map[string]*clientConn
+	// 保存已建立的连接：压缩公钥 hex -> 连接 ID -> 连接；connsByID / connsBySess 为按 ID / 会话的索引，
+	// clientsByPKH 为公钥哈希（hash160 原始字节）-> 压缩公钥 hex，供 ConnsByAddr 使用
+	clients      map[string]map[uint64]*ServerConn
+	connsByID    map[uint64]*ServerConn
+	connsBySess  map[*rtc.Session]*ServerConn
+	clientsByPKH map[string]string
+	nextConn     atomic.Uint64
+
+	// closing 在 Shutdown 后为 true，受 mu 保护；handlers 跟踪执行中的消息处理函数。
+	closing  bool
+	handlers sync.WaitGroup
 
 	// 可选外部注入的 logger；若为 nil，则完全静默
 	logger *zap.Logger
@@ -60,71 +84,165 @@ type Server struct {
 	//       return map[string]any{"welcome": "hello"}
 	//   }
 	OnHandshakeResponse func(r *http.Request, clientPub *ec.PublicKey, nonce string) map[string]any
-}
 
-// clientConn bundle
-type clientConn struct {
-	sess *rtc.Session
-	ws   *websocket.Conn
+	// Network 决定令牌 addr 声明与 ServerConn.Addr 使用的 P2PKH 地址网络，默认主网。
+	Network bsweb.Network
+
+	// Authorize 若不为 nil，则在客户端签名验证通过后调用，可拒绝握手或向令牌添加声明（如角色），
+	// 见 AuthorizeFunc；AllowKeys / DenyKeys / ChainAuthorize 提供常用组合。为 nil 时接受任何有效签名。
+	Authorize AuthorizeFunc
+
+	// RateLimits 配置握手与会话消息的限流，零值表示不限制，见 RateLimits。
+	RateLimits RateLimits
+
+	// HandshakePath 为客户端 POST 握手请求的公开路径（含挂载前缀，如 /api/v2/ws/handshake），
+	// ServeHTTP 按它路由，握手签名按它验证与回签；为空时 ServeHTTP 使用 DefaultHandshakePath，
+	// 签名使用请求的 r.URL.Path。通过 HandshakeHandler 挂载在会剥离前缀的路由下时
+	// （http.StripPrefix、chi 的 Mount 等）必须设置为完整的公开路径。
+	HandshakePath string
+	// SocketPath 为 ServeHTTP 路由 Upgrade 请求的路径，为空时为 DefaultSocketPath；
+	// 令牌不绑定该路径，通过 SocketHandler 挂载时无需设置。
+	SocketPath string
+
+	// CORS 为握手端点的跨域策略，同时约束 Upgrade 请求的 Origin；nil 表示允许任何来源，见 CORS。
+	CORS *CORS
+
+	// Hooks 为连接生命周期回调（握手、连接、断开、解码错误、消息错误），见 Hooks。
+	Hooks Hooks
+
+	// Frag 为服务端可接受的分片参数；零值字段取默认值。
+	// 客户端在握手中声明自己的参数时，服务端回应此值，双方各取较小值。
+	Frag rtc.FragOptions
+
+	// MaxReassemblyBytes 限制每条连接缓存的未完成分片消息的字节数，0 表示 DefaultMaxReassemblyBytes。
+	// 超出时最早的未完成消息被丢弃，因此也是单条分片消息的长度上限。
+	// rtc 的默认值（两条最大长度的消息，约 128 MiB）对服务器过大，数百个客户端即可耗尽内存。
+	MaxReassemblyBytes int
+
+	// RPCTimeout 若大于 0，则限制每次 RPC 处理函数的执行时间（见 Handle）。
+	RPCTimeout time.Duration
+	// MaxInFlightRPC 限制每条连接同时执行的 RPC 处理函数个数，0 表示 DefaultMaxInFlightRPC。
+	// 已满时新请求立即以 RPCServerBusy 错误回复，通知被丢弃。
+	MaxInFlightRPC int
+
+	// rpc 为通过 Handle 注册的 JSON-RPC 方法，受 mu 保护。
+	rpc map[string]RPCHandler
+
+	// AuthorizeTopic 若不为 nil，则在客户端订阅主题前调用；返回 error 即拒绝订阅。
+	// 可按 topic 前缀区分不同的授权规则。服务端直接调用 Subscribe 不经过此回调。
+	AuthorizeTopic func(peerPub *ec.PublicKey, topic string) error
+
+	// OnPresence 若不为 nil，则在客户端加入（joined=true）或离开主题后调用。
+	OnPresence func(topic string, peerPub *ec.PublicKey, joined bool)
+
+	// MaxTopicsPerClient 限制每个公钥通过 bitseal.subscribe 订阅的主题数，0 表示 DefaultMaxTopicsPerClient。
+	// 超出时订阅以 RPCTooManyTopics 错误拒绝；服务端直接调用 Subscribe 不受此限制。
+	MaxTopicsPerClient int
+
+	// topics: 主题 -> 压缩公钥 hex -> 公钥；topicCount: 压缩公钥 hex -> 已订阅主题数。均受 mu 保护。
+	topics     map[string]map[string]*ec.PublicKey
+	topicCount map[string]int
+
+	// ConnPolicy 与 MaxConnsPerKey 控制同一公钥的并发连接数。
+	// 默认 ConnAllowMany：不限制，SendTo 发往该公钥的所有连接。
+	// 其他策略下 MaxConnsPerKey 为 0 时按 1 处理。
+	ConnPolicy     ConnPolicy
+	MaxConnsPerKey int
+
+	// SendQueueSize 为每条连接发送队列的长度，0 表示 DefaultSendQueueSize。
+	// 回复、SendTo、Publish 等所有发送都经过该队列，由每条连接独立的写 goroutine 写出，
+	// 因此慢速客户端不会阻塞其他连接的发送方。
+	SendQueueSize int
+	// Overflow 为队列已满时的处理策略，默认 OverflowBlock。
+	Overflow OverflowPolicy
+	// WriteTimeout 限制单条消息写入 socket 的时间，超时即断开；0 表示 DefaultWriteTimeout。
+	WriteTimeout time.Duration
+
+	// Checkpoints 若不为 nil，则为每个会话启用 BSC3 检查点（BitSeal-RTC §5）：验证客户端发来的检查点，
+	// 并按该配置向声明支持心跳的客户端发出检查点，可通过 ServerConn.Session().ExportAudit 导出审计记录。
+	Checkpoints *rtc.CheckpointConfig
+
+	// PingInterval 大于 0 时，每隔该时间向声明支持心跳的客户端发送加密 ping，
+	// RTT 可通过 ServerConn.RTT 读取。无论是否设置，服务端都会回应客户端的 ping。
+	PingInterval time.Duration
+	// IdleTimeout 为等待客户端下一条记录的最长时间，超时即以 CloseIdleTimeout 关闭连接。
+	// 0 表示：对支持心跳的客户端且启用了 PingInterval 时取 2×PingInterval，否则不限制。
+	// 显式设置时对所有客户端生效，不发送心跳的旧客户端需自行保持活动。
+	IdleTimeout time.Duration
 }
 
-// SendTo 查找目标客户端并发送明文（自动 BST2 encodeRecord）。
-// 若找不到目标或发送失败则返回 error。
+// SendTo 向该公钥的所有连接发送明文（自动 BST2 encodeRecord，必要时分片）。
+// 只要有一条连接成功入队即返回 nil；无连接时返回 ErrPeerNotConnected。
+// 发往特定连接请用 SendToConn 或 ServerConn.Send。
 func (s *Server) SendTo(peerPub *ec.PublicKey, plain []byte) error {
+	return s.SendToContext(context.Background(), peerPub, plain)
+}
+
+// SendToContext 与 SendTo 相同；OverflowBlock 下等待队列空位的时间受 ctx 限制。
+func (s *Server) SendToContext(ctx context.Context, peerPub *ec.PublicKey, plain []byte) error {
 	if peerPub == nil {
 		return fmt.Errorf("nil peerPub")
 	}
-	key := fmt.Sprintf("%x", peerPub.Compressed())
-	s.mu.Lock()
-	cc, ok := s.clients[key]
-	total := len(s.clients)
-	s.mu.Unlock()
-
-	if !ok {
+	conns := s.Conns(peerPub)
+	if len(conns) == 0 {
 		if s.logger != nil {
-			s.logger.Warn("SendTo peer not connected", zap.String("peer", key), zap.Int("total_clients", total))
+			s.logger.Warn("SendTo peer not connected", zap.String("peer", fmt.Sprintf("%x", peerPub.Compressed())))
 		}
-		return fmt.Errorf("peer not connected")
-	}
-
-	frame, err := cc.sess.EncodeRecord(plain, 0)
-	if err != nil {
-		if s.logger != nil {
-			s.logger.Error("SendTo encode error", zap.Error(err))
-		}
-		return err
+		return ErrPeerNotConnected
 	}
 
 	if s.logger != nil {
-		s.logger.Debug("SendTo", zap.String("peer", key), zap.Int("plain_len", len(plain)), zap.Int("frame_len", len(frame)))
+		s.logger.Debug("SendTo", zap.String("peer", conns[0].peerHex), zap.Int("conns", len(conns)), zap.Int("plain_len", len(plain)))
 	}
 
-	if err := websocket.Message.Send(cc.ws, frame); err != nil {
-		if s.logger != nil {
-			s.logger.Error("SendTo send error", zap.Error(err))
+	var firstErr error
+	sent := 0
+	for _, c := range conns {
+		if err := c.SendContext(ctx, plain); err != nil {
+			if s.logger != nil {
+				s.logger.Error("SendTo send error", zap.Uint64("conn", c.id), zap.Error(err))
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
-		return err
+		sent++
+	}
+	if sent == 0 {
+		return firstErr
 	}
 	return nil
 }
 
-// NewServer creates a new BitSeal-WS server with its own ServeMux.
+// NewServer creates a new BitSeal-WS server. Serve it directly (see ServeHTTP)
+// or mount HandshakeHandler and SocketHandler on an existing router.
 // If logger is nil, the server remains silent.
 func NewServer(priv *ec.PrivateKey, logger *zap.Logger) *Server {
 	srv := &Server{
 		priv:    priv,
 		pub:     priv.PubKey(),
-		mux:     http.NewServeMux(),
 		pending: make(map[string]*handshakeState),
 		logger:  logger,
 	}
-	srv.routes()
+	srv.socket = srv.socketHandler()
 	return srv
 }
 
-func (s *Server) routes() {
-	s.mux.HandleFunc("/ws/handshake", s.handleHandshake)
+// HandshakeHandler returns the Step-1 handler (POST and CORS preflight) for
+// mounting on any router, e.g. mux.Handle("POST /api/v2/ws/handshake", h).
+// Set HandshakePath when the router strips a prefix before calling it.
+func (s *Server) HandshakeHandler() http.Handler {
+	return http.HandlerFunc(s.handleHandshake)
+}
+
+// SocketHandler returns the Step-2 WebSocket Upgrade handler for mounting on
+// any router.
+func (s *Server) SocketHandler() http.Handler {
+	return s.socket
+}
 
+func (s *Server) socketHandler() http.Handler {
 	// 自定义 websocket.Server 以显式允许 "BitSeal-WS.1" 子协议。
 	wsServer := websocket.Server{
 		Handshake: func(cfg *websocket.Config, req *http.Request) error {
@@ -134,26 +252,67 @@ func (s *Server) routes() {
 			}
 			// 告诉库我们接受此子协议（返回给客户端的 Sec-WebSocket-Protocol）
 			cfg.Protocol = []string{"BitSeal-WS.1"}
+			// 浏览器无法为 WebSocket 做 CORS 预检，由服务端按同一策略检查 Origin
+			if !s.checkUpgradeOrigin(req) {
+				return fmt.Errorf("origin not allowed")
+			}
 			return nil // 继续默认握手流程
 		},
 		Handler: websocket.Handler(s.handleSocket),
 	}
-	s.mux.Handle("/ws/socket", &wsServer)
+	return &wsServer
 }
 
 // ServeHTTP implements http.Handler so Server can be passed to http.ListenAndServe.
+// It serves HandshakePath and SocketPath (by default /ws/handshake and /ws/socket).
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.mux.ServeHTTP(w, r)
+	switch r.URL.Path {
+	case pathOr(s.HandshakePath, DefaultHandshakePath):
+		s.handleHandshake(w, r)
+	case pathOr(s.SocketPath, DefaultSocketPath):
+		s.socket.ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) maxReassemblyBytes() int {
+	if s.MaxReassemblyBytes > 0 {
+		return s.MaxReassemblyBytes
+	}
+	return DefaultMaxReassemblyBytes
+}
+
+// negotiateFrag 与客户端声明协商分片参数，并把 MaxFrags 压到 maxReassemblyBytes()/FragSize 以内，
+// 使超过重组上限的消息在客户端 Encode 时就失败，而不是发出后被服务端丢弃。
+func (s *Server) negotiateFrag(client rtc.FragOptions) (rtc.FragOptions, error) {
+	frag, err := rtc.NegotiateFrag(s.Frag, client)
+	if err != nil {
+		return rtc.FragOptions{}, err
+	}
+	frag.MaxFrags = max(1, min(frag.MaxFrags, s.maxReassemblyBytes()/frag.FragSize))
+	return frag, nil
+}
+
+func pathOr(path, def string) string {
+	if path == "" {
+		return def
+	}
+	return path
+}
+
+// signedPath 返回握手签名覆盖的路径，见 HandshakePath。
+func (s *Server) signedPath(r *http.Request) string {
+	return pathOr(s.HandshakePath, r.URL.Path)
 }
 
 // --- Step-1: HTTPS POST /ws/handshake ---
 func (s *Server) handleHandshake(w http.ResponseWriter, r *http.Request) {
 	// --- CORS Preflight ---
 	if r.Method == http.MethodOptions {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-BKSA-Protocol, X-BKSA-Sig, X-BKSA-Timestamp, X-BKSA-Nonce")
-		w.WriteHeader(http.StatusNoContent)
+		if s.applyCORS(w, r, true) {
+			w.WriteHeader(http.StatusNoContent)
+		}
 		return
 	}
 
@@ -162,8 +321,21 @@ func (s *Server) handleHandshake(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Allow browser cross-origin POST
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// Allow browser cross-origin POST (see CORS)
+	if !s.applyCORS(w, r, false) {
+		return
+	}
+
+	if s.isClosing() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("server shutting down"))
+		return
+	}
+
+	// 按 IP 限流在验签之前，避免被大量握手请求耗尽 CPU
+	if !s.allowHandshake(w, s.RateLimits.HandshakePerIP, s.RateLimits.clientIP(r)) {
+		return
+	}
 
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -185,7 +357,7 @@ func (s *Server) handleHandshake(w http.ResponseWriter, r *http.Request) {
 		s.logger.Debug("handshake POST", zap.String("remote", r.RemoteAddr))
 	}
 
-	clientPub, saltC, nonce, err := VerifyHandshakeRequest(bodyStr, r.Method, r.URL.Path, hdr, s.priv)
+	clientPub, saltC, nonce, err := VerifyHandshakeRequest(bodyStr, r.Method, s.signedPath(r), hdr, s.priv)
 	if err != nil {
 		if s.logger != nil {
 			s.logger.Warn("handshake verify failed", zap.Error(err))
@@ -195,18 +367,86 @@ func (s *Server) handleHandshake(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.allowHandshake(w, s.RateLimits.HandshakePerKey, fmt.Sprintf("%x", clientPub.Compressed())) {
+		return
+	}
+
+	var authClaims map[string]any
+	if s.Authorize != nil {
+		authClaims, err = s.Authorize(r.Context(), clientPub, r)
+		if err != nil {
+			if s.logger != nil {
+				s.logger.Info("handshake not authorized", zap.String("client", fmt.Sprintf("%x", clientPub.Compressed())), zap.Error(err))
+			}
+			writeHandshakeError(w, err)
+			return
+		}
+	}
+
+	// ConnRejectNew：已达连接上限时尽早拒绝，Upgrade 时还会再检查一次
+	if s.connLimitReached(fmt.Sprintf("%x", clientPub.Compressed())) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("connection limit reached"))
+		return
+	}
+
+	// 分片参数：仅当客户端声明时才回应，旧客户端的响应保持不变
+	clientFrag, err := parseFragAdvert(bodyBytes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	frag, err := s.negotiateFrag(clientFrag)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Warn("handshake frag options rejected", zap.Error(err))
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	heartbeat := parseHeartbeatAdvert(bodyBytes)
+
 	// Generate 4-byte server salt
 	saltS, _ := randomSalt4()
 	if s.logger != nil {
 		s.logger.Debug("serverSalt", zap.String("salt_s", saltS))
 	}
 
-	// Build JWT
-	claims := map[string]any{
-		"addr":   fmt.Sprintf("pk:%x", clientPub.Compressed()), // placeholder address derivation
-		"salt_s": saltS,
-		"nonce":  nonce,
+	// Build JWT；Authorize 返回的声明在前，保留声明不可覆盖
+	claims := map[string]any{}
+	for k, v := range authClaims {
+		if !reservedClaims[k] {
+			claims[k] = v
+		}
+	}
+	claims["addr"] = bsweb.Address(clientPub, s.Network) // 账户主键（BitSeal-WEB §9）
+	claims["salt_s"] = saltS
+	claims["nonce"] = nonce
+
+	// OnHandshakeResponse 允许业务层在握手阶段向返回给客户端的 JSON
+	// 中添加额外的键值对。若回调返回的 map 不为 nil，则其中的所有键值对
+	// 将被合并进默认的 respObj 中；若键已存在则以回调结果为准。
+	// 典型用法是在创建 Server 后赋值，例如：
+	//   srv.OnHandshakeResponse = func(r *http.Request, clientPub *ec.PublicKey, nonce string) map[string]any {
+	//       return map[string]any{"welcome": "hello"}
+	//   }
+	var extra map[string]any
+	if s.OnHandshakeResponse != nil {
+		extra = s.OnHandshakeResponse(r, clientPub, nonce)
 	}
+
+	if s.Hooks.OnHandshake != nil {
+		info := &HandshakeInfo{PeerPub: clientPub, RemoteAddr: r.RemoteAddr, Request: r, Claims: claims, Extra: extra}
+		if err := s.Hooks.OnHandshake(info); err != nil {
+			if s.logger != nil {
+				s.logger.Info("handshake rejected by hook", zap.String("client", fmt.Sprintf("%x", clientPub.Compressed())), zap.Error(err))
+			}
+			writeHandshakeError(w, err)
+			return
+		}
+	}
+
 	token, err := CreateToken(claims, s.priv, 60)
 	if err != nil {
 		if s.logger != nil {
@@ -222,25 +462,25 @@ func (s *Server) handleHandshake(w http.ResponseWriter, r *http.Request) {
 		"ts":     time.Now().UnixMilli(),
 		"nonce":  nonce,
 	}
+	if clientFrag != (rtc.FragOptions{}) {
+		// max_frags 取压低后的协商值，客户端与之取小后得到相同结果
+		local, _ := s.Frag.WithDefaults() // 已由 NegotiateFrag 校验
+		respObj["frag_size"] = local.FragSize
+		respObj["max_frags"] = frag.MaxFrags
+	}
+	if heartbeat {
+		respObj["heartbeat"] = heartbeatVersion
+	}
 
-	// OnHandshakeResponse 允许业务层在握手阶段向返回给客户端的 JSON
-	// 中添加额外的键值对。若回调返回的 map 不为 nil，则其中的所有键值对
-	// 将被合并进默认的 respObj 中；若键已存在则以回调结果为准。
-	// 典型用法是在创建 Server 后赋值，例如：
-	//   srv.OnHandshakeResponse = func(r *http.Request, clientPub *ec.PublicKey, nonce string) map[string]any {
-	//       return map[string]any{"welcome": "hello"}
-	//   }
-	if s.OnHandshakeResponse != nil {
-		extra := s.OnHandshakeResponse(r, clientPub, nonce)
-		for k, v := range extra {
-			respObj[k] = v // overwrite if duplicated key
-		}
+	// OnHandshakeResponse 的附加字段合并进 respObj；若键已存在则以回调结果为准。
+	for k, v := range extra {
+		respObj[k] = v // overwrite if duplicated key
 	}
 
 	respBody, _ := json.Marshal(respObj)
 
 	// Sign response headers with serverPriv and clientPub (reuse BitSeal-WEB algo)
-	respHeaders, err := bsweb.SignRequest("POST", "/ws/handshake", "", string(respBody), s.priv, clientPub)
+	respHeaders, err := bsweb.SignRequest("POST", s.signedPath(r), "", string(respBody), s.priv, clientPub)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -248,19 +488,17 @@ func (s *Server) handleHandshake(w http.ResponseWriter, r *http.Request) {
 	for k, v := range respHeaders {
 		w.Header().Set(k, v)
 	}
-	// 允许浏览器脚本访问签名头
-	w.Header().Set("Access-Control-Expose-Headers", "X-BKSA-Protocol, X-BKSA-Sig, X-BKSA-Timestamp, X-BKSA-Nonce")
 	w.Header().Set("Content-Type", "application/json")
 
 	// Remember state keyed by nonce for later Upgrade validation
 	s.mu.Lock()
-	s.pending[nonce] = &handshakeState{clientPub: clientPub, clientSalt: saltC, serverSalt: saltS, createdAt: time.Now()}
+	s.pending[nonce] = &handshakeState{clientPub: clientPub, clientSalt: saltC, serverSalt: saltS, frag: frag, peerFrag: clientFrag != (rtc.FragOptions{}), heartbeat: heartbeat, extra: extra, createdAt: time.Now()}
 	s.mu.Unlock()
 
 	_, _ = w.Write(respBody)
 
 	if s.logger != nil {
-		s.logger.Info("handshake success", zap.String("nonce", nonce), zap.String("client", fmt.Sprintf("%x", clientPub.Compressed())))
+		s.logger.Info("handshake success", zap.String("nonce", nonce), zap.String("client", fmt.Sprintf("%x", clientPub.Compressed())), zap.String("addr", claims["addr"].(string)))
 	}
 }
 
@@ -317,7 +555,8 @@ func (s *Server) handleSocket(ws *websocket.Conn) {
 	}
 
 	// Build BST2 session
-	sess, err := rtc.NewSession(s.priv, state.clientPub, bytesFromHex(state.serverSalt), bytesFromHex(state.clientSalt), s.logger)
+	sessCfg := rtc.SessionConfig{Checkpoints: s.Checkpoints}
+	sess, err := rtc.NewSessionWithConfig(s.priv, state.clientPub, bytesFromHex(state.serverSalt), bytesFromHex(state.clientSalt), sessCfg, s.logger)
 	if err != nil {
 		if s.logger != nil {
 			s.logger.Error("session creation failed", zap.Error(err))
@@ -326,83 +565,159 @@ func (s *Server) handleSocket(ws *websocket.Conn) {
 		return
 	}
 
+	fr, err := newFramer(sess, state.frag, state.peerFrag, s.maxReassemblyBytes())
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Error("framer creation failed", zap.Error(err))
+		}
+		_ = ws.Close()
+		return
+	}
+	fr.checkpoints = s.Checkpoints != nil && state.heartbeat
+
 	if s.logger != nil {
-		s.logger.Info("session established", zap.String("client", fmt.Sprintf("%x", state.clientPub.Compressed())))
+		s.logger.Info("session established", zap.String("client", fmt.Sprintf("%x", state.clientPub.Compressed())), zap.String("addr", bsweb.Address(state.clientPub, s.Network)))
 	}
 
-	// 将连接保存至 clients map
-	peerHex := fmt.Sprintf("%x", state.clientPub.Compressed())
-	s.mu.Lock()
-	if s.clients == nil {
-		s.clients = make(map[string]*clientConn)
+	// 强制后续发送使用 BinaryFrame，避免客户端误解为文本
+	ws.PayloadType = websocket.BinaryFrame
+
+	// 将连接登记至 clients，按 ConnPolicy 处理同一公钥的已有连接
+	conn := s.newServerConn(state.clientPub, sess, ws, fr)
+	conn.control = state.heartbeat
+	conn.claims, conn.extra = claims, state.extra
+	evicted, ok := s.addConn(conn)
+	if !ok {
+		if s.isClosing() {
+			_ = conn.CloseWithCode(CloseGoingAway, shutdownReason)
+			return
+		}
+		if s.logger != nil {
+			s.logger.Warn("connection limit reached, rejecting", zap.String("client", conn.peerHex))
+		}
+		_ = conn.CloseWithCode(CloseConnLimit, "connection limit reached")
+		return
+	}
+	go conn.writeLoop()
+	if s.PingInterval > 0 && state.heartbeat {
+		go conn.pingLoop(s.PingInterval)
+	}
+	for _, old := range evicted {
+		if s.logger != nil {
+			s.logger.Info("replacing oldest connection", zap.String("client", old.peerHex), zap.Uint64("conn", old.id))
+		}
+		_ = old.CloseWithCode(CloseConnLimit, "replaced by newer connection")
 	}
-	s.clients[peerHex] = &clientConn{sess: sess, ws: ws}
-	s.mu.Unlock()
 
+	if s.Hooks.OnConnect != nil {
+		s.Hooks.OnConnect(conn)
+	}
 	// 通知业务层新建会话
 	if s.OnSession != nil {
 		s.OnSession(sess)
 	}
 
-	// 强制后续发送使用 BinaryFrame，避免客户端误解为文本
-	ws.PayloadType = websocket.BinaryFrame
+	// ctx 在连接关闭时取消，供 RPC 处理函数感知断线。
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := idleTimeout(s.IdleTimeout, s.PingInterval, state.heartbeat)
 
 	// Simple echo loop: decrypt incoming, print log, then echo back.
-	buf := make([]byte, 1024*64)
+	// 按 WebSocket 消息整条接收，分片记录在 framer 中重组，心跳控制记录在 framer 中处理。
+	var recvErr error
 	for {
-		n, err := ws.Read(buf)
-		if err != nil {
+		if idle > 0 {
+			_ = ws.SetReadDeadline(time.Now().Add(idle))
+		}
+		var frame []byte
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			recvErr = err
+			if idle > 0 && isTimeout(err) {
+				if s.logger != nil {
+					s.logger.Info("idle timeout, closing connection", zap.Uint64("conn", conn.id))
+				}
+				_ = conn.CloseWithCode(CloseIdleTimeout, "idle timeout")
+			}
 			break
 		}
-		frame := buf[:n]
-		plain, err := sess.DecodeRecord(frame)
+		// 限流在解密之前，超额的帧不消耗 AES-GCM
+		if ok, closed := s.allowFrame(conn, len(frame)); !ok {
+			if closed {
+				break
+			}
+			continue
+		}
+		plain, ok, err := fr.decode(ws, frame, conn.writeTimeout)
 		if err != nil {
 			if s.logger != nil {
 				s.logger.Warn("decode error", zap.Error(err))
 			}
+			if s.Hooks.OnDecodeError != nil {
+				s.Hooks.OnDecodeError(conn, err)
+			}
 			continue // skip invalid
 		}
-		if s.logger != nil {
-			s.logger.Debug("recv", zap.Int("len", len(plain)), zap.String("plain", string(plain)))
+		if !ok {
+			continue // 等待剩余分片
 		}
-
-		// 根据是否设置了业务回调决定如何处理消息。
-		var respPlain []byte
-		if s.OnMessage != nil {
-			resp, err := s.OnMessage(sess, plain)
-			if err != nil {
-				if s.logger != nil {
-					s.logger.Warn("OnMessage error", zap.Error(err))
-				}
-				continue // 跳过本条消息
-			}
-			respPlain = resp
-		} else {
-			// 默认行为：直接回显收到的明文
-			respPlain = plain
+		if !s.beginHandler() {
+			continue // 服务器关闭中，不再处理新消息
 		}
+		s.dispatch(ctx, conn, plain)
+		s.handlers.Done()
+	}
+
+	// 连接关闭后仅移除本连接；该公钥的最后一条连接关闭时退出所有主题。
+	// 先取消 ctx，使仍在处理中的订阅请求能发现连接已关闭。
+	cancel()
+	_ = conn.closeWithReason(recvErr)
+	if s.removeConn(conn) {
+		s.unsubscribeAll(state.clientPub)
+	}
+	if s.Hooks.OnDisconnect != nil {
+		s.Hooks.OnDisconnect(conn, conn.closeReason)
+	}
+
+	if s.logger != nil {
+		s.logger.Info("connection closed", zap.Uint64("conn", conn.id))
+	}
+}
+
+// dispatch 处理一条完整的明文消息：RPC 交给 serveRPC，其余交给 OnMessage（未设置时回显）。
+func (s *Server) dispatch(ctx context.Context, conn *ServerConn, plain []byte) {
+	if s.serveRPC(ctx, conn, conn.Send, plain) {
+		return
+	}
+	if s.logger != nil {
+		s.logger.Debug("recv", zap.Int("len", len(plain)), zap.String("plain", string(plain)))
+	}
 
-		if respPlain != nil {
-			outFrame, _ := sess.EncodeRecord(respPlain, 0)
+	// 根据是否设置了业务回调决定如何处理消息。
+	var respPlain []byte
+	if s.OnMessage != nil {
+		resp, err := s.OnMessage(conn.sess, plain)
+		if err != nil {
 			if s.logger != nil {
-				// 注意：切片边界保护
-				first := 16
-				if len(outFrame) < first {
-					first = len(outFrame)
-				}
-				s.logger.Debug("send frame", zap.Int("len", len(outFrame)), zap.String("first_hex", fmt.Sprintf("%x", outFrame[:first])))
+				s.logger.Warn("OnMessage error", zap.Error(err))
+			}
+			if s.Hooks.OnMessageError != nil {
+				s.Hooks.OnMessageError(conn, err)
 			}
-			_ = websocket.Message.Send(ws, outFrame)
+			return // 跳过本条消息
 		}
+		respPlain = resp
+	} else {
+		// 默认行为：直接回显收到的明文
+		respPlain = plain
 	}
 
-	// 连接关闭后清理 clients map
-	s.mu.Lock()
-	delete(s.clients, peerHex)
-	s.mu.Unlock()
-
-	if s.logger != nil {
-		s.logger.Info("connection closed")
+	if respPlain != nil {
+		if s.logger != nil {
+			s.logger.Debug("send", zap.Int("len", len(respPlain)))
+		}
+		if err := conn.Send(respPlain); err != nil && s.logger != nil {
+			s.logger.Warn("send error", zap.Error(err))
+		}
 	}
 }
 
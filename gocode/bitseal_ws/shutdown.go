@@ -0,0 +1,125 @@
+package bitsealws
+
+import (
+	"context"
+	"errors"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+
+	"go.uber.org/zap"
+)
+
+// CloseGoingAway 为服务器关闭时使用的标准 WebSocket Close Code（1001）。
+const CloseGoingAway = 1001
+
+// ErrServerClosed 表示服务器已调用 Shutdown，不再接受新的握手与连接。
+var ErrServerClosed = errors.New("server closed")
+
+// shutdownReason 为 go-away 通知与 Close 帧携带的原因。
+const shutdownReason = "server shutting down"
+
+// Shutdown 优雅地关闭服务器上的所有 BitSeal-WS 连接：
+//  1. 不再接受新握手（返回 503）与新连接（以 1001 关闭），也不再处理新收到的消息；
+//  2. 向声明支持控制记录的客户端发送加密的 go-away 通知（rtc.ControlGoAway）：通知经控制队列交给
+//     各连接的写 goroutine，排在已入队的消息之前，Shutdown 不会因某个客户端写阻塞而等待；
+//  3. 等待正在执行的 OnMessage 与 RPC 处理函数结束，其回复照常发出；
+//  4. 每条连接发完队列中的消息后以 CloseGoingAway 关闭。
+//
+// ctx 结束时立即断开剩余连接（不等待阻塞的写入，也不发送 Close 帧）并返回 ctx.Err()。
+// http.Server.Shutdown 不会跟踪已升级的 WebSocket 连接，应先调用本方法再关闭 http.Server。
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	clear(s.pending)
+	s.mu.Unlock()
+
+	conns := s.allConns()
+	if s.logger != nil {
+		s.logger.Info("shutting down", zap.Int("conns", len(conns)))
+	}
+	for _, c := range conns {
+		if err := ctx.Err(); err != nil {
+			return s.forceClose(err)
+		}
+		if !c.control {
+			continue
+		}
+		if err := c.queueControl(rtc.ControlGoAway, []byte(shutdownReason)); err != nil && s.logger != nil {
+			s.logger.Warn("go-away not sent", zap.Uint64("conn", c.id), zap.Error(err))
+		}
+	}
+
+	handlersDone := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		return s.forceClose(ctx.Err())
+	}
+
+	// 处理函数的回复都已入队；关闭标记排在其后，由写 goroutine 发完后关闭连接
+	for _, c := range conns {
+		if err := ctx.Err(); err != nil {
+			return s.forceClose(err)
+		}
+		c.closeAfterFlush(ctx)
+	}
+	for _, c := range conns {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return s.forceClose(ctx.Err())
+		}
+	}
+	return nil
+}
+
+// forceClose 立即关闭所有剩余连接；写阻塞的连接也不等待。
+func (s *Server) forceClose(err error) error {
+	for _, c := range s.allConns() {
+		c.abort(ErrServerClosed)
+	}
+	if s.logger != nil {
+		s.logger.Warn("shutdown deadline exceeded, connections force-closed", zap.Error(err))
+	}
+	return err
+}
+
+// isClosing 报告是否已调用 Shutdown。
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// beginHandler 登记一个即将执行的消息处理函数；已调用 Shutdown 时返回 false。
+// 与 Shutdown 同在 mu 下判断 closing，保证 handlers.Wait 之后不再有 Add。
+func (s *Server) beginHandler() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+// allConns 返回当前所有连接。
+func (s *Server) allConns() []*ServerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedConns(s.connsByID)
+}
+
+// closeAfterFlush 在发送队列末尾放入关闭标记（nil），写 goroutine 写完之前的消息后
+// 以 CloseGoingAway 关闭连接。
+func (c *ServerConn) closeAfterFlush(ctx context.Context) {
+	select {
+	case c.out <- nil:
+	case <-c.done:
+	case <-ctx.Done():
+	}
+}
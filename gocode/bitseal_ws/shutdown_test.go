@@ -0,0 +1,156 @@
+package bitsealws_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+	ws "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_ws"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.OnMessage = func(sess *rtc.Session, plain []byte) ([]byte, error) {
+			started <- struct{}{}
+			<-release
+			return []byte("done"), nil
+		}
+	})
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	goAway := make(chan string, 1)
+	c.OnGoAway = func(reason string) { goAway <- reason }
+	msgs, readErr := make(chan []byte, 4), make(chan error, 1)
+	go func() {
+		for {
+			msg, err := c.Read()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			msgs <- msg
+		}
+	}()
+
+	if err := c.Write([]byte("work")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+
+	select {
+	case reason := <-goAway:
+		if reason == "" {
+			t.Fatal("empty go-away reason")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no go-away notice")
+	}
+	if _, err := ws.ConnectBitSealWS(fixedPriv(0x44), serverPriv.PubKey(), wsURL); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("handshake during shutdown: %v", err)
+	}
+
+	// The in-flight handler finishes and its reply is delivered before the close.
+	close(release)
+	select {
+	case msg := <-msgs:
+		if string(msg) != "done" {
+			t.Fatalf("reply %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight reply lost")
+	}
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	select {
+	case <-readErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	waitConns(t, server, clientPriv.PubKey(), 0)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.OnMessage = func(sess *rtc.Session, plain []byte) ([]byte, error) {
+			started <- struct{}{}
+			<-release
+			return nil, nil
+		}
+	})
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Write([]byte("stuck")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := readWithin(c, 5*time.Second); err == nil {
+		t.Fatal("connection survived forced shutdown")
+	}
+}
+
+func TestShutdownStalledClient(t *testing.T) {
+	server, serverPriv, wsURL := startServer(t, func(s *ws.Server) {
+		s.SendQueueSize = 4
+		s.Overflow = ws.OverflowDrop
+		s.WriteTimeout = 30 * time.Second
+	})
+	clientPriv := fixedPriv(0x33)
+	c, err := ws.ConnectBitSealWS(clientPriv, serverPriv.PubKey(), wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := waitConns(t, server, clientPriv.PubKey(), 1)[0]
+
+	// The client never reads, so the server's writer blocks on the socket.
+	big := make([]byte, 256*1024)
+	for end := time.Now().Add(500 * time.Millisecond); time.Now().Before(end); {
+		if err := conn.Send(big); err != nil && !errors.Is(err, ws.ErrQueueFull) {
+			t.Fatal(err)
+		}
+	}
+
+	// The go-away is queued rather than written inline, so ctx still bounds Shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Shutdown took %v with a stalled client", d)
+	}
+	waitConns(t, server, clientPriv.PubKey(), 0)
+}
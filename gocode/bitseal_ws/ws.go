@@ -9,11 +9,31 @@ import (
 	"encoding/hex"
 	"encoding/json"
 
+	rtc "github.com/spycat55/BitSeal_Protocol/gocode/bitseal_rtc"
+
 	ec "github.com/bsv-blockchain/go-sdk/primitives/ec"
 )
 
 // BuildHandshakeRequest constructs body+headers like TS side.
 func BuildHandshakeRequest(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, salt string, nonce string) (body string, headers map[string]string, err error) {
+	return BuildHandshakeRequestWithFrag(clientPriv, serverPub, salt, nonce, rtc.FragOptions{})
+}
+
+// BuildHandshakeRequestWithFrag 在握手请求体中额外声明客户端的分片参数
+// （frag_size / max_frags）；零值字段不写入，与 BuildHandshakeRequest 输出一致。
+func BuildHandshakeRequestWithFrag(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, salt string, nonce string, frag rtc.FragOptions) (body string, headers map[string]string, err error) {
+	return BuildHandshakeRequestWithPath(clientPriv, serverPub, DefaultHandshakePath, salt, nonce, frag)
+}
+
+// BuildHandshakeRequestWithPath 同 BuildHandshakeRequestWithFrag，但签名覆盖给定的握手路径，
+// 用于 Server.HandshakePath 或 HandshakeHandler 挂载在非默认路径的服务端（对应 TS 的 opts.path）。
+func BuildHandshakeRequestWithPath(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, path string, salt string, nonce string, frag rtc.FragOptions) (body string, headers map[string]string, err error) {
+	return buildHandshakeRequest(clientPriv, serverPub, path, salt, nonce, frag, false)
+}
+
+// buildHandshakeRequest 构造发往 path 的握手请求，签名覆盖该路径；
+// heartbeat 为 true 时声明支持心跳（"heartbeat":1）。
+func buildHandshakeRequest(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, path string, salt string, nonce string, frag rtc.FragOptions, heartbeat bool) (body string, headers map[string]string, err error) {
 	if salt == "" {
 		return "", nil, errors.New("salt required")
 	}
@@ -21,9 +41,19 @@ func BuildHandshakeRequest(clientPriv *ec.PrivateKey, serverPub *ec.PublicKey, s
 		n, _ := bsweb.RandomNonce()
 		nonce = n
 	}
-	body = fmt.Sprintf("{\"proto\":\"BitSeal-WS.1\",\"pk\":\"%s\",\"salt\":\"%s\",\"nonce\":\"%s\"}",
+	body = fmt.Sprintf("{\"proto\":\"BitSeal-WS.1\",\"pk\":\"%s\",\"salt\":\"%s\",\"nonce\":\"%s\"",
 		fmt.Sprintf("%x", clientPriv.PubKey().Compressed()), salt, nonce)
-	headers, err = bsweb.SignRequest("POST", "/ws/handshake", "", body, clientPriv, serverPub)
+	if frag.FragSize != 0 {
+		body += fmt.Sprintf(",\"frag_size\":%d", frag.FragSize)
+	}
+	if frag.MaxFrags != 0 {
+		body += fmt.Sprintf(",\"max_frags\":%d", frag.MaxFrags)
+	}
+	if heartbeat {
+		body += fmt.Sprintf(",\"heartbeat\":%d", heartbeatVersion)
+	}
+	body += "}"
+	headers, err = bsweb.SignRequest("POST", path, "", body, clientPriv, serverPub)
 	return
 }
 
@@ -50,4 +80,14 @@ func VerifyHandshakeRequest(body, method, uriPath string, headers map[string]str
 	return peerPub, obj.Salt, obj.Nonce, err
 }
 
+// parseFragAdvert 读取握手 JSON 中可选的 frag_size / max_frags 字段。
+// 未声明时返回零值（即默认分片参数）。
+func parseFragAdvert(body []byte) (rtc.FragOptions, error) {
+	var frag rtc.FragOptions
+	if err := json.Unmarshal(body, &frag); err != nil {
+		return rtc.FragOptions{}, err
+	}
+	return frag, nil
+}
+
 // （已移除旧 JWT 相关辅助函数）
@@ -0,0 +1,76 @@
+/** @vitest-environment node */
+// @ts-nocheck
+import { Mux, INITIAL_WINDOW } from './Mux.js'
+import { randomBytes } from 'crypto'
+import { describe, it, expect } from 'vitest'
+
+const hex = (b: Uint8Array) => Buffer.from(b).toString('hex')
+
+// connect two muxes; delivery is async like a real socket
+function pair () {
+  let a: Mux, b: Mux
+  a = new Mux(msg => queueMicrotask(() => b.receive(msg)), { client: true })
+  b = new Mux(msg => queueMicrotask(() => a.receive(msg)), { client: false })
+  return { client: a, server: b }
+}
+
+async function readAll (s) {
+  const parts: number[] = []
+  for (;;) {
+    const chunk = await s.read()
+    if (chunk === null) return Uint8Array.from(parts)
+    parts.push(...chunk)
+  }
+}
+
+describe('mux', () => {
+  // same vectors as gocode/bitseal_mux TestFrameVectors
+  it('frame vectors', async () => {
+    const frames: string[] = []
+    const m = new Mux(msg => frames.push(hex(msg)), { client: true, window: INITIAL_WINDOW + 0x10000 })
+    const s = m.open()
+    await s.write('hi')
+    s.closeWrite()
+    m.receive([0x01, 0, 0, 0, 3, 0, 0, 0, 0])
+    m.receive([0x02, 0, 0, 0, 9, 0, 0, 0, 0, 0x78])
+    expect(frames).toEqual([
+      '010000000100000000',
+      '030000000100010000',
+      '0200000001000000006869',
+      '040000000100000000',
+      '050000000300000001',
+      '050000000900000001'
+    ])
+    expect(() => m.receive([0x7f, 0, 0, 0, 1, 0, 0, 0, 0])).toThrow()
+  })
+
+  it('echo beyond the window', async () => {
+    const { client, server } = pair()
+    server.onStream = async s => {
+      for (;;) {
+        const chunk = await s.read()
+        if (chunk === null) break
+        await s.write(chunk)
+      }
+      s.closeWrite()
+    }
+    const payload = randomBytes(3 * INITIAL_WINDOW + 123)
+    const s = client.open()
+    const writing = s.write(payload).then(() => s.closeWrite())
+    const got = await readAll(s)
+    await writing
+    expect(hex(got)).toBe(hex(payload))
+  })
+
+  it('reset', async () => {
+    const { client, server } = pair()
+    const s = client.open()
+    await s.write('hello')
+    const peer = await server.accept()
+    expect(peer.id).toBe(s.id)
+    expect(Buffer.from(await peer.read()).toString()).toBe('hello')
+    const pending = peer.read()
+    s.reset()
+    await expect(pending).rejects.toThrow(/reset/)
+  })
+})
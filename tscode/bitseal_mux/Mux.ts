@@ -0,0 +1,335 @@
+// @ts-nocheck
+// BitSeal stream multiplexer – TypeScript side of gocode/bitseal_mux.
+//
+// Each mux frame is the plaintext of one BitSeal message:
+//   type(1) | stream_id(4) | value(4) | payload
+//   0x01 OPEN  0x02 DATA  0x03 WINDOW(value = credit)  0x04 CLOSE  0x05 RESET(value = code)
+// Client streams use odd IDs, server streams even IDs. Every stream direction
+// starts with INITIAL_WINDOW bytes of credit, returned by WINDOW frames as the
+// application reads.
+
+export const INITIAL_WINDOW = 256 * 1024
+const HDR_LEN = 9
+export const DEFAULT_MAX_DATA = 16 * 1024 - HDR_LEN
+export const DEFAULT_ACCEPT_BACKLOG = 64
+
+const OPEN = 0x01
+const DATA = 0x02
+const WINDOW = 0x03
+const CLOSE = 0x04
+const RESET = 0x05
+
+export const RESET_CANCEL = 0
+export const RESET_REFUSED = 1
+export const RESET_PROTOCOL = 2
+
+export interface MuxOptions {
+  /** true ⇒ odd stream IDs (the side that connected) */
+  client: boolean
+  /** receive window per stream, >= INITIAL_WINDOW */
+  window?: number
+  /** largest DATA payload per frame */
+  maxData?: number
+  acceptBacklog?: number
+}
+
+/**
+ * Mux – feed every decrypted message to receive(); frames go out through send,
+ * e.g. `new Mux(plain => conn.send(plain), { client: true })` with
+ * `onMessage: plain => { mux.receive(plain) }` from connectBitSealWS.
+ */
+export class Mux {
+  readonly client: boolean
+  readonly window: number
+  readonly maxData: number
+  private send: (msg: Uint8Array) => void
+  private streams = new Map<number, MuxStream>()
+  private nextID: number
+  private backlog: MuxStream[] = []
+  private acceptWaiters: Array<{ resolve: (s: MuxStream) => void, reject: (e: Error) => void }> = []
+  private acceptBacklog: number
+  err: Error | null = null
+
+  /** optional: called for every accepted stream instead of queueing for accept() */
+  onStream: ((s: MuxStream) => void) | null = null
+
+  constructor (send: (msg: Uint8Array) => void, opts: MuxOptions) {
+    this.send = send
+    this.client = opts.client
+    this.window = opts.window ?? INITIAL_WINDOW
+    if (this.window < INITIAL_WINDOW || this.window > 0xFFFFFFFF) throw new Error('invalid window')
+    this.maxData = opts.maxData ?? DEFAULT_MAX_DATA
+    if (this.maxData < 1) throw new Error('invalid maxData')
+    this.acceptBacklog = opts.acceptBacklog ?? DEFAULT_ACCEPT_BACKLOG
+    this.nextID = this.client ? 1 : 2
+  }
+
+  /** open a new stream; data may be written immediately */
+  open (): MuxStream {
+    if (this.err) throw this.err
+    const id = this.nextID
+    if (id > 0xFFFFFFFF - 2) throw new Error('bitseal mux: stream IDs exhausted')
+    this.nextID += 2
+    const s = new MuxStream(this, id)
+    this.streams.set(id, s)
+    this.writeFrame(OPEN, id, 0)
+    this.grantExtra(id)
+    return s
+  }
+
+  /** wait for the next stream opened by the peer */
+  accept (): Promise<MuxStream> {
+    const s = this.backlog.shift()
+    if (s) return Promise.resolve(s)
+    if (this.err) return Promise.reject(this.err)
+    return new Promise((resolve, reject) => this.acceptWaiters.push({ resolve, reject }))
+  }
+
+  /** handle one incoming (decrypted) message; throws and stops the mux on malformed frames */
+  receive (msg: Uint8Array | number[]): void {
+    if (this.err) throw this.err
+    const buf = Uint8Array.from(msg)
+    if (buf.length < HDR_LEN) return this.protocolError('frame shorter than header')
+    const typ = buf[0]
+    const id = readU32(buf, 1)
+    const value = readU32(buf, 5)
+    const payload = buf.subarray(HDR_LEN)
+    if (typ !== DATA && payload.length !== 0) return this.protocolError('frame with unexpected payload')
+    const s = this.streams.get(id)
+
+    switch (typ) {
+      case OPEN:
+        if (s || id === 0 || ((id % 2) === 1) === this.client) {
+          this.writeFrame(RESET, id, RESET_REFUSED)
+          return
+        }
+        this.acceptStream(id)
+        return
+      case DATA:
+        if (!s) {
+          this.writeFrame(RESET, id, RESET_REFUSED)
+          return
+        }
+        s._receiveData(payload)
+        return
+      case WINDOW:
+        s?._receiveWindow(value)
+        return
+      case CLOSE:
+        s?._receiveClose()
+        return
+      case RESET:
+        if (s) {
+          this.streams.delete(id)
+          s._abort(new Error('bitseal mux: stream reset'))
+        }
+        return
+      default:
+        return this.protocolError(`unknown frame type 0x${typ.toString(16)}`)
+    }
+  }
+
+  /** stop the mux and fail all streams */
+  close (err: Error = new Error('bitseal mux closed')): void {
+    if (this.err) return
+    this.err = err
+    for (const s of this.streams.values()) s._abort(err)
+    this.streams.clear()
+    for (const w of this.acceptWaiters) w.reject(err)
+    this.acceptWaiters = []
+  }
+
+  private protocolError (reason: string): never {
+    const err = new Error('bitseal mux: ' + reason)
+    this.close(err)
+    throw err
+  }
+
+  private acceptStream (id: number): void {
+    const s = new MuxStream(this, id)
+    if (this.onStream) {
+      this.streams.set(id, s)
+      this.grantExtra(id)
+      this.onStream(s)
+      return
+    }
+    const waiter = this.acceptWaiters.shift()
+    if (!waiter && this.backlog.length >= this.acceptBacklog) {
+      this.writeFrame(RESET, id, RESET_REFUSED)
+      return
+    }
+    this.streams.set(id, s)
+    this.grantExtra(id)
+    if (waiter) waiter.resolve(s)
+    else this.backlog.push(s)
+  }
+
+  private grantExtra (id: number): void {
+    const extra = this.window - INITIAL_WINDOW
+    if (extra > 0) this.writeFrame(WINDOW, id, extra)
+  }
+
+  /** @internal */
+  _remove (id: number): void {
+    this.streams.delete(id)
+  }
+
+  /** @internal */
+  writeFrame (typ: number, id: number, value: number, payload?: Uint8Array): void {
+    if (this.err) throw this.err
+    const frame = new Uint8Array(HDR_LEN + (payload?.length ?? 0))
+    frame[0] = typ
+    writeU32(frame, 1, id)
+    writeU32(frame, 5, value)
+    if (payload) frame.set(payload, HDR_LEN)
+    this.send(frame)
+  }
+}
+
+export class MuxStream {
+  readonly id: number
+  private mux: Mux
+  private chunks: Uint8Array[] = []
+  private recvWin: number
+  private unacked = 0
+  private credit = INITIAL_WINDOW
+  private readClosed = false
+  private writeClosed = false
+  private localClosed = false
+  private err: Error | null = null
+  private waiters: Array<() => void> = []
+
+  constructor (mux: Mux, id: number) {
+    this.mux = mux
+    this.id = id
+    this.recvWin = mux.window
+  }
+
+  /** next chunk of data; null after the peer's CLOSE */
+  async read (): Promise<Uint8Array | null> {
+    for (;;) {
+      const chunk = this.chunks.shift()
+      if (chunk) {
+        this.unacked += chunk.length
+        if (this.unacked >= this.mux.window / 2 && !this.readClosed) {
+          const grant = this.unacked
+          this.unacked = 0
+          this.recvWin += grant
+          this.mux.writeFrame(WINDOW, this.id, grant)
+        }
+        return chunk
+      }
+      if (this.err) throw this.err
+      if (this.localClosed) throw new Error('bitseal mux: stream closed')
+      if (this.readClosed) return null
+      await this.wait()
+    }
+  }
+
+  /** send data, waiting while the peer's window is exhausted */
+  async write (data: Uint8Array | number[] | string): Promise<void> {
+    const buf = typeof data === 'string' ? new TextEncoder().encode(data) : Uint8Array.from(data)
+    let off = 0
+    while (off < buf.length) {
+      while (!this.err && !this.writeClosed && this.credit === 0) await this.wait()
+      if (this.err) throw this.err
+      if (this.writeClosed) throw new Error('bitseal mux: stream closed')
+      const n = Math.min(buf.length - off, this.mux.maxData, this.credit)
+      this.credit -= n
+      this.mux.writeFrame(DATA, this.id, 0, buf.subarray(off, off + n))
+      off += n
+    }
+  }
+
+  /** half-close: the peer reads EOF, this side can keep reading */
+  closeWrite (): void {
+    if (this.writeClosed || this.err) return
+    this.writeClosed = true
+    if (this.readClosed) this.mux._remove(this.id)
+    this.notify()
+    this.mux.writeFrame(CLOSE, this.id, 0)
+  }
+
+  /** half-close and stop reading; late data is discarded */
+  close (): void {
+    this.localClosed = true
+    const drop = this.chunks.reduce((n, c) => n + c.length, 0)
+    this.chunks = []
+    if (drop > 0 && !this.err) this.creditBack(drop)
+    this.notify()
+    this.closeWrite()
+  }
+
+  /** abort both directions */
+  reset (): void {
+    if (this.err) return
+    this.mux._remove(this.id)
+    this._abort(new Error('bitseal mux: stream reset'))
+    this.mux.writeFrame(RESET, this.id, RESET_CANCEL)
+  }
+
+  /** @internal */
+  _abort (err: Error): void {
+    if (!this.err) {
+      this.err = err
+      this.chunks = []
+    }
+    this.notify()
+  }
+
+  /** @internal */
+  _receiveData (p: Uint8Array): void {
+    if (this.readClosed || p.length > this.recvWin) {
+      this.mux._remove(this.id)
+      this._abort(new Error('bitseal mux: stream reset'))
+      this.mux.writeFrame(RESET, this.id, RESET_PROTOCOL)
+      return
+    }
+    this.recvWin -= p.length
+    if (this.localClosed || this.err) {
+      this.creditBack(p.length)
+      return
+    }
+    this.chunks.push(p.slice())
+    this.notify()
+  }
+
+  /** @internal */
+  _receiveWindow (n: number): void {
+    this.credit = Math.min(this.credit + n, 0xFFFFFFFF)
+    this.notify()
+  }
+
+  /** @internal */
+  _receiveClose (): void {
+    this.readClosed = true
+    if (this.writeClosed) this.mux._remove(this.id)
+    this.notify()
+  }
+
+  private creditBack (n: number): void {
+    this.recvWin += n
+    this.mux.writeFrame(WINDOW, this.id, n)
+  }
+
+  private wait (): Promise<void> {
+    return new Promise(resolve => this.waiters.push(resolve))
+  }
+
+  private notify (): void {
+    const w = this.waiters
+    this.waiters = []
+    for (const resolve of w) resolve()
+  }
+}
+
+function readU32 (b: Uint8Array, off: number): number {
+  return ((b[off] << 24) | (b[off + 1] << 16) | (b[off + 2] << 8) | b[off + 3]) >>> 0
+}
+
+function writeU32 (b: Uint8Array, off: number, v: number): void {
+  b[off] = (v >>> 24) & 0xFF
+  b[off + 1] = (v >>> 16) & 0xFF
+  b[off + 2] = (v >>> 8) & 0xFF
+  b[off + 3] = v & 0xFF
+}
@@ -15,11 +15,18 @@ import { createToken as createSimpleToken, verifyToken } from './SimpleToken'
 /** Generate a 4-byte random salt in hex */
 const randomSalt4 = (): string => toHex(Random(4))
 
-/** Step-1: build POST /ws/handshake body + headers */
+/** Default paths of the handshake POST and the WebSocket Upgrade */
+export const DEFAULT_HANDSHAKE_PATH = '/ws/handshake'
+export const DEFAULT_SOCKET_PATH = '/ws/socket'
+
+/**
+ * Step-1: build POST /ws/handshake body + headers.
+ * `path` is the handshake path covered by the signature (default /ws/handshake).
+ */
 export function buildHandshakeRequest (
   clientPriv: PrivateKey,
   serverPub: PublicKey,
-  opts: Partial<{ ts: string, nonce: string }> = {}
+  opts: Partial<{ ts: string, nonce: string, path: string }> = {}
 ): { body: string, headers: BitSealHeaders, salt: string } {
   const salt = randomSalt4()
   const bodyObj = {
@@ -29,7 +36,7 @@ export function buildHandshakeRequest (
     nonce: opts.nonce ?? toHex(Random(16))
   }
   const body = JSON.stringify(bodyObj)
-  const headers = signRequest('POST', '/ws/handshake', '', body, clientPriv, serverPub, {
+  const headers = signRequest('POST', opts.path ?? DEFAULT_HANDSHAKE_PATH, '', body, clientPriv, serverPub, {
     timestamp: opts.ts,
     nonce: bodyObj.nonce
   })
@@ -95,6 +102,12 @@ export interface ConnectOptions {
   httpBase?: string
   /** custom fetch implementation */
   fetchImpl?: typeof fetch
+  /**
+   * 握手 POST 路径，签名覆盖该路径，须与服务器一致。默认由 wsUrl 推导：
+   * 路径以 /socket 结尾时替换为 /handshake（wss://host/api/v2/ws/socket -> /api/v2/ws/handshake），
+   * 否则为 /ws/handshake。
+   */
+  handshakePath?: string
   /** extra headers to append to POST /ws/handshake */
   extraHeaders?: Record<string, string>
   /** supply a preconstructed salt (hex) – mainly for tests */
@@ -172,11 +185,17 @@ export async function connectBitSealWS (
     httpBase = u.origin
   }
 
+  let handshakePath = opts.handshakePath
+  if (!handshakePath) {
+    const wsPath = new URL(wsUrl).pathname
+    handshakePath = wsPath.endsWith('/socket') ? wsPath.slice(0, -'socket'.length) + 'handshake' : DEFAULT_HANDSHAKE_PATH
+  }
+
   // ---------- Step-1 POST /ws/handshake ----------
   const { body, headers: signedHeaders, salt: saltClientHex } = buildHandshakeRequest(
     clientPriv,
     serverPub,
-    opts.clientSaltHex ? { nonce: undefined } : {}
+    { path: handshakePath }
   )
   if (opts.clientSaltHex) {
     // override generated salt if provided
@@ -184,13 +203,13 @@ export async function connectBitSealWS (
     bodyObj.salt = opts.clientSaltHex
     const newBody = JSON.stringify(bodyObj)
     // need to resign
-    Object.assign(signedHeaders, signRequest('POST', '/ws/handshake', '', newBody, clientPriv, serverPub))
+    Object.assign(signedHeaders, signRequest('POST', handshakePath, '', newBody, clientPriv, serverPub))
   }
 
   const reqHeaders: Record<string, string> = { ...signedHeaders, ...(opts.extraHeaders ?? {}) }
   const controller = new AbortController()
   const timeout = setTimeout(() => controller.abort(), opts.timeoutMs ?? 15000)
-  const res = await fetcher(`${httpBase}/ws/handshake`, {
+  const res = await fetcher(`${httpBase}${handshakePath}`, {
     method: 'POST',
     headers: reqHeaders,
     body,
@@ -206,7 +225,7 @@ export async function connectBitSealWS (
   res.headers.forEach((v, k) => { respHeaders[k] = v })
 
   // verify server signature (BitSeal-WEB)
-  const ok = verifyRequest('POST', '/ws/handshake', '', respText, respHeaders, clientPriv)
+  const ok = verifyRequest('POST', handshakePath, '', respText, respHeaders, clientPriv)
   if (!ok) throw new Error('server BitSeal signature invalid')
 
   const token = respJson.token as string
@@ -289,6 +308,10 @@ export async function connectBitSealWS (
 export interface HandshakeResponseOptions {
   /** override expire seconds for SimpleToken, default 60 */
   expSec?: number
+  /** 令牌 addr 声明（P2PKH 地址）所用网络，默认 mainnet */
+  network?: 'mainnet' | 'testnet'
+  /** 握手路径（签名覆盖该路径），须与客户端 POST 的公开路径一致，默认 /ws/handshake */
+  path?: string
   /** 业务扩展回调：返回要合并进响应 JSON 的键值对（同键覆盖）。*/
   onHandshakeResponse?: (req: {
     clientPub: PublicKey
@@ -314,7 +337,7 @@ export function buildHandshakeResponse (
 
   // Build SimpleToken payload
   const claims = {
-    addr: `pk:${clientPub.encode(true, 'hex')}`,
+    addr: clientPub.toAddress(opts.network === 'testnet' ? [0x6f] : [0x00]),
     salt_s: saltS,
     nonce
   }
@@ -337,7 +360,7 @@ export function buildHandshakeResponse (
   const body = JSON.stringify(respObj)
 
   // Sign headers using BitSeal-WEB helper (same algorithm as Go version)
-  const headers = signRequest('POST', '/ws/handshake', '', body, serverPriv, clientPub)
+  const headers = signRequest('POST', opts.path ?? DEFAULT_HANDSHAKE_PATH, '', body, serverPriv, clientPub)
 
   return { body, headers, token, saltS }
 }
@@ -2,3 +2,4 @@
 export * from "../bitseal_rtc/Fragment";
 export * from "../bitseal_web/BitSeal";
 export * from "../bitseal_ws/BitSealWS";
+export * from "../bitseal_mux/Mux";